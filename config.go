@@ -2,17 +2,37 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 
+	"github.com/john/snapmaker_moonraker/gcode"
+	"github.com/john/snapmaker_moonraker/printer"
+	"github.com/john/snapmaker_moonraker/sacp"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Server   ServerConfig   `yaml:"server"`
+	Auth     AuthConfig     `yaml:"auth"`
 	Printer  PrinterConfig  `yaml:"printer"`
 	Files    FilesConfig    `yaml:"files"`
 	Spoolman SpoolmanConfig `yaml:"spoolman"`
+	GCode    GCodeConfig    `yaml:"gcode"`
+}
+
+type GCodeConfig struct {
+	// Validation controls the pre-flight check run before every print:
+	// "warn" reports problems but prints anyway, "block" refuses to start
+	// a print with errors, "off" skips the check.
+	Validation string `yaml:"validation"`
+	// Transforms are named pass-2 transform stages, run in the order listed
+	// after the built-in tool remap and nozzle shutoff. Stages marked
+	// default run on every print; a print can instead select stages by name.
+	Transforms []gcode.StageConfig `yaml:"transforms"`
+	// Standby lowers the idle nozzle of a multi-tool print after each tool
+	// change and re-heats it shortly before it is needed again.
+	Standby gcode.StandbyConfig `yaml:"standby"`
 }
 
 type SpoolmanConfig struct {
@@ -24,6 +44,41 @@ type SpoolmanConfig struct {
 type ServerConfig struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
+	// SSLPort serves HTTPS alongside HTTP when non-zero.
+	SSLPort int `yaml:"ssl_port"`
+	// SSLCertificatePath and SSLKeyPath are the PEM certificate and key.
+	// Left empty, a self-signed pair is generated in the data directory.
+	// Either file changing is picked up without a restart.
+	SSLCertificatePath string `yaml:"ssl_certificate_path"`
+	SSLKeyPath         string `yaml:"ssl_key_path"`
+	// RedirectHTTP redirects plain HTTP requests to HTTPS, except those
+	// from this host (a local reverse proxy).
+	RedirectHTTP bool `yaml:"redirect_http"`
+	// UnixSocket serves the JSON-RPC API on a Unix socket, for local
+	// clients, at UnixSocketPath (default .moonraker_data/comms/moonraker.sock).
+	UnixSocket     bool   `yaml:"unix_socket"`
+	UnixSocketPath string `yaml:"unix_socket_path"`
+}
+
+type AuthConfig struct {
+	// Enabled requires API clients to be authorized. Without it anyone who
+	// can reach the server may use it.
+	Enabled bool `yaml:"enabled"`
+	// TrustedClients are addresses or CIDR ranges that may use the API
+	// without logging in. Web pages served from them may use it too.
+	TrustedClients []string `yaml:"trusted_clients"`
+	// CORSDomains are the origins of other web pages allowed to use the
+	// API from a browser, e.g. "*.local" or "http://*.lan:*".
+	CORSDomains []string `yaml:"cors_domains"`
+	// ForceLogins makes trusted clients log in too once a user exists.
+	ForceLogins bool `yaml:"force_logins"`
+	// TrustedRole and APIKeyRole are the roles of trusted clients and of
+	// the API key: viewer (watch only), operator (prints, G-code, files)
+	// or admin (also users, services and the database).
+	TrustedRole string `yaml:"trusted_role"`
+	APIKeyRole  string `yaml:"api_key_role"`
+	// Guest lets clients that haven't logged in watch, as viewers.
+	Guest bool `yaml:"guest"`
 }
 
 type PrinterConfig struct {
@@ -32,6 +87,15 @@ type PrinterConfig struct {
 	Model string `yaml:"model"`
 	// PollInterval is how often to poll printer status in seconds.
 	PollInterval int `yaml:"poll_interval"`
+	// PrintMode is how prints are sent: "upload" stores the file on the
+	// printer and starts it there, "stream" keeps it on the bridge and sends
+	// it a command at a time so it can be changed while printing.
+	PrintMode string `yaml:"print_mode"`
+	// StreamWindow is how many commands a streamed print keeps in flight.
+	StreamWindow int `yaml:"stream_window"`
+	// UploadChunkKB is the data sent per SACP upload chunk, in KB. The
+	// printer takes up to 60.
+	UploadChunkKB int `yaml:"upload_chunk_kb"`
 }
 
 type FilesConfig struct {
@@ -40,20 +104,43 @@ type FilesConfig struct {
 	// ConfigDir is the directory for printer configuration files.
 	// Defaults to ../config relative to GCodeDir.
 	ConfigDir string `yaml:"config_dir"`
+	// CacheSize bounds the processed-file cache, in MB; 0 disables it.
+	CacheSize int `yaml:"cache_size_mb"`
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Host: "0.0.0.0",
-			Port: 7125,
+			Host:       "0.0.0.0",
+			Port:       7125,
+			UnixSocket: true,
+		},
+		Auth: AuthConfig{
+			Enabled: true,
+			// Only this host: LAN clients log in unless trusted_clients
+			// is widened.
+			TrustedClients: []string{"127.0.0.0/8", "::1/128"},
+			CORSDomains: []string{
+				"*.lan", "*.local", "*://localhost", "*://localhost:*",
+				"*://my.mainsail.xyz", "*://app.fluidd.xyz",
+			},
+			TrustedRole: "admin",
+			APIKeyRole:  "admin",
 		},
 		Printer: PrinterConfig{
-			PollInterval: 5,
-			Model:        "Snapmaker J1S",
+			PollInterval:  5,
+			Model:         "Snapmaker J1S",
+			PrintMode:     "upload",
+			StreamWindow:  printer.DefaultStreamWindow,
+			UploadChunkKB: sacp.DataLen / 1024,
 		},
 		Files: FilesConfig{
-			GCodeDir: "gcodes",
+			GCodeDir:  "gcodes",
+			CacheSize: 2048,
+		},
+		GCode: GCodeConfig{
+			Validation: "warn",
+			Standby:    gcode.StandbyConfig{Preheat: 30},
 		},
 	}
 }
@@ -70,6 +157,57 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
 
+	switch cfg.Printer.PrintMode {
+	case "upload", "stream":
+	default:
+		return nil, fmt.Errorf("invalid printer.print_mode %q (want upload or stream)", cfg.Printer.PrintMode)
+	}
+	if cfg.Printer.StreamWindow < 1 || cfg.Printer.StreamWindow > printer.MaxStreamWindow {
+		return nil, fmt.Errorf("invalid printer.stream_window %d (want 1 to %d)", cfg.Printer.StreamWindow, printer.MaxStreamWindow)
+	}
+
+	if cfg.Server.SSLPort < 0 || cfg.Server.SSLPort > 65535 || cfg.Server.SSLPort == cfg.Server.Port {
+		return nil, fmt.Errorf("invalid server.ssl_port %d", cfg.Server.SSLPort)
+	}
+	if (cfg.Server.SSLCertificatePath == "") != (cfg.Server.SSLKeyPath == "") {
+		return nil, fmt.Errorf("server.ssl_certificate_path and server.ssl_key_path must be set together")
+	}
+	if cfg.Server.RedirectHTTP && cfg.Server.SSLPort == 0 {
+		return nil, fmt.Errorf("server.redirect_http needs server.ssl_port")
+	}
+
+	for _, c := range cfg.Auth.TrustedClients {
+		if _, _, err := net.ParseCIDR(c); err != nil && net.ParseIP(c) == nil {
+			return nil, fmt.Errorf("invalid auth.trusted_clients entry %q (want an address or CIDR range)", c)
+		}
+	}
+
+	for name, r := range map[string]string{"trusted_role": cfg.Auth.TrustedRole, "api_key_role": cfg.Auth.APIKeyRole} {
+		switch r {
+		case "viewer", "operator", "admin":
+		default:
+			return nil, fmt.Errorf("invalid auth.%s %q (want viewer, operator or admin)", name, r)
+		}
+	}
+
+	if cfg.Files.CacheSize < 0 {
+		return nil, fmt.Errorf("invalid files.cache_size_mb %d", cfg.Files.CacheSize)
+	}
+	if err := sacp.CheckChunkSize(cfg.Printer.UploadChunkKB * 1024); err != nil {
+		return nil, fmt.Errorf("invalid printer.upload_chunk_kb: %w", err)
+	}
+	switch cfg.GCode.Validation {
+	case "warn", "block", "off":
+	default:
+		return nil, fmt.Errorf("invalid gcode.validation %q (want warn, block or off)", cfg.GCode.Validation)
+	}
+	if err := cfg.GCode.Standby.Check(); err != nil {
+		return nil, fmt.Errorf("gcode.standby: %w", err)
+	}
+	if err := gcode.CheckStages(cfg.GCode.Transforms); err != nil {
+		return nil, fmt.Errorf("invalid gcode.transforms: %w", err)
+	}
+
 	// Resolve relative gcode dir to absolute path.
 	if !filepath.IsAbs(cfg.Files.GCodeDir) {
 		dir, _ := os.Getwd()
@@ -2,6 +2,7 @@ package files
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -10,8 +11,13 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/john/snapmaker_moonraker/gcode"
 )
 
+// ErrInvalidPath is returned for paths that lead outside the storage roots.
+var ErrInvalidPath = errors.New("invalid path")
+
 // Manager handles local gcode file storage.
 type Manager struct {
 	gcodeDir  string
@@ -48,6 +54,10 @@ func (m *Manager) ListFiles(root string) []map[string]interface{} {
 		if err != nil || info.IsDir() {
 			return nil
 		}
+		// Hidden files are bridge bookkeeping (print indexes, processing temps).
+		if strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
 
 		relPath, _ := filepath.Rel(dir, path)
 		// Use forward slashes for consistency.
@@ -97,6 +107,9 @@ func (m *Manager) GetDirectory(root, path string) map[string]interface{} {
 			if err != nil {
 				continue
 			}
+			if !entry.IsDir() && strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
 			if entry.IsDir() {
 				dirs = append(dirs, map[string]interface{}{
 					"dirname":  entry.Name(),
@@ -204,6 +217,8 @@ func (m *Manager) SaveFromReader(root, filename string, src io.Reader) (int64, e
 	if err != nil {
 		return 0, fmt.Errorf("creating file: %w", err)
 	}
+	// A replaced file's print index no longer matches it.
+	os.Remove(gcode.IndexPath(path))
 	closeOK := false
 	defer func() {
 		if !closeOK {
@@ -233,6 +248,22 @@ func (m *Manager) FilePath(root, filename string) string {
 	return filepath.Join(m.GetRootPath(root), filepath.FromSlash(filename))
 }
 
+// RootOf returns the root path lies in, or "" if it is in neither. A
+// request's path can name one root and lead into the other with "..".
+func (m *Manager) RootOf(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for _, root := range []string{"gcodes", "config"} {
+		dir, _ := filepath.Abs(m.GetRootPath(root))
+		if abs == dir || strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return ""
+}
+
 // FindByBasename walks root looking for a file whose name matches basename.
 // The J1S firmware reports just the basename of the active print over SACP,
 // so when the bridge needs to locate the source file (e.g., to compute total
@@ -286,7 +317,7 @@ func (m *Manager) DeleteDirectory(root, dirPath string) error {
 	absRoot, _ := filepath.Abs(m.GetRootPath(root))
 	absPath, _ := filepath.Abs(path)
 	if !strings.HasPrefix(absPath, absRoot) {
-		return fmt.Errorf("invalid path: %s", dirPath)
+		return fmt.Errorf("%w: %s", ErrInvalidPath, dirPath)
 	}
 
 	return os.Remove(path)
@@ -303,13 +334,18 @@ func (m *Manager) MoveFile(source, dest string) error {
 	srcOk := strings.HasPrefix(absSrc, absGcode+string(filepath.Separator)) || strings.HasPrefix(absSrc, absConfig+string(filepath.Separator))
 	dstOk := strings.HasPrefix(absDst, absGcode+string(filepath.Separator)) || strings.HasPrefix(absDst, absConfig+string(filepath.Separator))
 	if !srcOk || !dstOk {
-		return fmt.Errorf("invalid path")
+		return ErrInvalidPath
 	}
 
 	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 		return fmt.Errorf("creating destination directory: %w", err)
 	}
-	return os.Rename(source, dest)
+	if err := os.Rename(source, dest); err != nil {
+		return err
+	}
+	// The print index, if any, follows its file.
+	os.Rename(gcode.IndexPath(source), gcode.IndexPath(dest))
+	return nil
 }
 
 // ResolvePath resolves a root/path pair to an absolute filesystem path.
@@ -332,16 +368,20 @@ func (m *Manager) DeleteFile(root, filename string) error {
 	absRoot, _ := filepath.Abs(m.GetRootPath(root))
 	absPath, _ := filepath.Abs(path)
 	if !strings.HasPrefix(absPath, absRoot) {
-		return fmt.Errorf("invalid path: %s", filename)
+		return fmt.Errorf("%w: %s", ErrInvalidPath, filename)
 	}
 
-	return os.Remove(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	os.Remove(gcode.IndexPath(path))
+	return nil
 }
 
 // ParseFilamentByLine reads a gcode file and returns cumulative filament extruded (mm)
 // indexed by line number (0-based). Handles both absolute (M82) and relative (M83) extrusion.
 func ParseFilamentByLine(path string) ([]float64, error) {
-	perTool, err := ParseFilamentByLinePerTool(path)
+	perTool, err := ParseFilamentByLinePerTool(path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -357,7 +397,8 @@ func ParseFilamentByLine(path string) ([]float64, error) {
 // ParseFilamentByLinePerTool reads a gcode file and returns per-tool cumulative filament
 // extruded (mm) indexed by line number (0-based). Returns [2][]float64 for T0 and T1.
 // Handles tool changes (T0/T1), absolute (M82) and relative (M83) extrusion modes.
-func ParseFilamentByLinePerTool(path string) ([2][]float64, error) {
+// toolFor maps the file's tool numbers to physical heads; nil remaps T2/T3 -> T0/T1.
+func ParseFilamentByLinePerTool(path string, toolFor func(int) int) ([2][]float64, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return [2][]float64{}, err
@@ -367,7 +408,10 @@ func ParseFilamentByLinePerTool(path string) ([2][]float64, error) {
 	var result [2][]float64
 	var cumulative [2]float64
 	var lastAbsE [2]float64
-	currentTool := 0
+	if toolFor == nil {
+		toolFor = func(t int) int { return t % 2 }
+	}
+	currentTool := toolFor(0)
 	relative := false // default is absolute extrusion
 
 	scanner := bufio.NewScanner(f)
@@ -385,7 +429,7 @@ func ParseFilamentByLinePerTool(path string) ([2][]float64, error) {
 		// Tool change commands.
 		if len(upper) >= 2 && upper[0] == 'T' && upper[1] >= '0' && upper[1] <= '9' {
 			if t, err := strconv.Atoi(upper[1:]); err == nil {
-				currentTool = t % 2 // Remap T2/T3 -> T0/T1 consistent with gcode processor
+				currentTool = toolFor(t) // Consistent with the gcode processor's tool map
 			}
 			result[0] = append(result[0], cumulative[0])
 			result[1] = append(result[1], cumulative[1])
@@ -0,0 +1,344 @@
+package gcode
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cacheVersion is part of every cache key. Bump it when a change to the
+// processing makes earlier output wrong, so cached files are redone.
+const cacheVersion = 2
+
+// Cache keeps processed files, with their line count and print index, so a
+// print can start without processing its file again. Entries are keyed by
+// the source content hash, the printer model and the processing options:
+// any change to the file or the settings misses the cache. Storing an entry
+// drops older ones made from the same path, and the least recently used
+// entries go once the cache outgrows its size limit.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu     sync.Mutex
+	hashes map[string]sourceHash  // content hashes by source path
+	inUse  map[string]int         // keys being printed, kept from eviction
+	busy   map[string]*cacheBuild // keys being processed
+}
+
+// sourceHash is a content hash, valid while the file's size and
+// modification time are unchanged.
+type sourceHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+type cacheBuild struct {
+	done  chan struct{}
+	entry *CacheEntry
+	err   error
+}
+
+// CacheEntry is a processed file in the cache. Release it once the file is
+// no longer needed.
+type CacheEntry struct {
+	Key    string      `json:"key"`
+	Source string      `json:"source"` // path the entry was made from
+	Lines  uint32      `json:"lines"`  // total output lines
+	Size   int64       `json:"size"`   // processed file size
+	MD5    string      `json:"md5"`    // processed file MD5, hex
+	Path   string      `json:"-"`      // processed file
+	Index  *PrintIndex `json:"-"`      // nil if the source was already processed
+
+	cache *Cache
+}
+
+const (
+	cacheEntryFile     = "entry.json"
+	cacheProcessedFile = "processed.gcode"
+	cacheIndexFile     = "index.json"
+)
+
+// NewCache opens the cache in dir, creating it if needed. maxBytes bounds
+// the total size of the processed files kept.
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating gcode cache: %w", err)
+	}
+	// Builds interrupted by a restart leave their temp directories behind.
+	if tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp")); err == nil {
+		for _, t := range tmps {
+			os.RemoveAll(t)
+		}
+	}
+	return &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		hashes:   make(map[string]sourceHash),
+		inUse:    make(map[string]int),
+		busy:     make(map[string]*cacheBuild),
+	}, nil
+}
+
+// Key returns the cache key of srcPath processed with opts. The content
+// hash is remembered while the file is unchanged.
+func (c *Cache) Key(srcPath string, opts Options) (string, error) {
+	hash, err := c.contentHash(srcPath)
+	if err != nil {
+		return "", err
+	}
+	settings, err := json.Marshal(struct {
+		Version        int
+		Model          string
+		Stages         []StageConfig
+		Standby        StandbyConfig
+		IDEXMode       string
+		ToolMap        ToolMap
+		ExcludeObjects []string
+		ResumeOffset   int64
+		Pauses         []PauseAt
+	}{cacheVersion, opts.Model, opts.Stages, opts.Standby, opts.IDEXMode, opts.ToolMap,
+		opts.ExcludeObjects, opts.ResumeOffset, opts.Pauses})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(hash), settings...))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+func (c *Cache) contentHash(srcPath string) (string, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	h, ok := c.hashes[srcPath]
+	c.mu.Unlock()
+	if ok && h.size == info.Size() && h.modTime.Equal(info.ModTime()) {
+		return h.hash, nil
+	}
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %w", srcPath, err)
+	}
+	h = sourceHash{size: info.Size(), modTime: info.ModTime(), hash: hex.EncodeToString(sum.Sum(nil))}
+	c.mu.Lock()
+	c.hashes[srcPath] = h
+	c.mu.Unlock()
+	return h.hash, nil
+}
+
+// Lookup returns the entry for key, if cached. The entry is held until
+// released.
+func (c *Cache) Lookup(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.load(key)
+	if err != nil {
+		return nil, false
+	}
+	c.inUse[key]++
+	return e, true
+}
+
+// load reads an entry from disk and marks it used; must hold mu.
+func (c *Cache) load(key string) (*CacheEntry, error) {
+	dir := filepath.Join(c.dir, key)
+	data, err := os.ReadFile(filepath.Join(dir, cacheEntryFile))
+	if err != nil {
+		return nil, err
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	// Files that were already processed are copied through without an
+	// index.
+	if idx, err := LoadIndex(filepath.Join(dir, cacheIndexFile)); err == nil {
+		e.Index = idx
+	}
+	e.Path = filepath.Join(dir, cacheProcessedFile)
+	if _, err := os.Stat(e.Path); err != nil {
+		return nil, err
+	}
+	e.cache = c
+	now := time.Now()
+	os.Chtimes(filepath.Join(dir, cacheEntryFile), now, now)
+	return &e, nil
+}
+
+// Process returns the cached entry for srcPath processed with opts,
+// processing it first if needed. Concurrent calls for the same key share
+// one processing run. The entry is held until released.
+func (c *Cache) Process(srcPath string, opts Options) (*CacheEntry, error) {
+	key, err := c.Key(srcPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if e, err := c.load(key); err == nil {
+		c.inUse[key]++
+		c.mu.Unlock()
+		return e, nil
+	}
+	if b, ok := c.busy[key]; ok {
+		c.mu.Unlock()
+		<-b.done
+		if b.err != nil {
+			return nil, b.err
+		}
+		return c.hold(b.entry), nil
+	}
+	b := &cacheBuild{done: make(chan struct{})}
+	c.busy[key] = b
+	c.mu.Unlock()
+
+	b.entry, b.err = c.build(key, srcPath, opts)
+
+	c.mu.Lock()
+	delete(c.busy, key)
+	c.mu.Unlock()
+	close(b.done)
+	if b.err != nil {
+		return nil, b.err
+	}
+	e := c.hold(b.entry)
+	c.evict(srcPath, key)
+	return e, nil
+}
+
+// hold marks an entry used and returns a copy for the caller.
+func (c *Cache) hold(e *CacheEntry) *CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inUse[e.Key]++
+	held := *e
+	return &held
+}
+
+// build processes srcPath into a new entry directory.
+func (c *Cache) build(key, srcPath string, opts Options) (*CacheEntry, error) {
+	start := time.Now()
+	tmp, err := os.MkdirTemp(c.dir, key+"-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("creating cache entry: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	opts.IndexPath = filepath.Join(tmp, cacheIndexFile)
+	sum := md5.New()
+	opts.Hash = sum
+	lines, err := ProcessFile(srcPath, filepath.Join(tmp, cacheProcessedFile), opts)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.Join(tmp, cacheProcessedFile))
+	if err != nil {
+		return nil, err
+	}
+	e := &CacheEntry{Key: key, Source: srcPath, Lines: lines, Size: info.Size(), MD5: hex.EncodeToString(sum.Sum(nil))}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, cacheEntryFile), data, 0644); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(c.dir, key)
+	os.RemoveAll(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, fmt.Errorf("storing cache entry: %w", err)
+	}
+	c.mu.Lock()
+	loaded, err := c.load(key)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("gcode cache: processed %s in %s (%d lines)", filepath.Base(srcPath), time.Since(start).Round(time.Millisecond), lines)
+	return loaded, nil
+}
+
+// Release lets the entry be evicted again.
+func (e *CacheEntry) Release() {
+	c := e.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inUse[e.Key]--; c.inUse[e.Key] <= 0 {
+		delete(c.inUse, e.Key)
+	}
+}
+
+// Forget drops the entries made from srcPath, for a file that was deleted
+// or replaced.
+func (c *Cache) Forget(srcPath string) {
+	c.evict(srcPath, "")
+}
+
+// evict drops entries made from srcPath other than keep, then the least
+// recently used entries beyond the size limit. Entries in use stay.
+func (c *Cache) evict(srcPath, keep string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.hashes, srcPath)
+
+	type cached struct {
+		key  string
+		used time.Time
+		size int64
+	}
+	var entries []cached
+	var total int64
+	dirs, _ := os.ReadDir(c.dir)
+	for _, d := range dirs {
+		if !d.IsDir() || filepath.Ext(d.Name()) == ".tmp" {
+			continue
+		}
+		key := d.Name()
+		path := filepath.Join(c.dir, key, cacheEntryFile)
+		info, err := os.Stat(path)
+		data, err2 := os.ReadFile(path)
+		var e CacheEntry
+		if err != nil || err2 != nil || json.Unmarshal(data, &e) != nil {
+			os.RemoveAll(filepath.Join(c.dir, key))
+			continue
+		}
+		if e.Source == srcPath && key != keep && c.inUse[key] == 0 {
+			os.RemoveAll(filepath.Join(c.dir, key))
+			continue
+		}
+		entries = append(entries, cached{key, info.ModTime(), e.Size})
+		total += e.Size
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if e.key == keep || c.inUse[e.key] > 0 {
+			continue
+		}
+		os.RemoveAll(filepath.Join(c.dir, e.key))
+		total -= e.size
+		log.Printf("gcode cache: evicted %s", e.key)
+	}
+}
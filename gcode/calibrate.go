@@ -0,0 +1,551 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Calibration print kinds, see GenerateCalibration.
+const (
+	CalibrationIDEXOffset = "idex_offset"
+	CalibrationTempTower  = "temp_tower"
+	CalibrationFlowCube   = "flow_cube"
+	CalibrationRetraction = "retraction_tower"
+	CalibrationFirstLayer = "first_layer"
+)
+
+// CalibrationKinds lists the calibration prints GenerateCalibration writes.
+var CalibrationKinds = []string{
+	CalibrationIDEXOffset, CalibrationTempTower, CalibrationFlowCube,
+	CalibrationRetraction, CalibrationFirstLayer,
+}
+
+// CalibrationParams parameterises a calibration print. Zero values take
+// the defaults for the material (see Defaults).
+type CalibrationParams struct {
+	Kind     string
+	Tool     int // head to print with; idex_offset uses both
+	Material string
+
+	NozzleTemp     float64
+	BedTemp        float64
+	NozzleDiameter float64
+	LayerHeight    float64
+
+	// TempStart, TempEnd and TempStep set the temperature tower blocks,
+	// bottom to top.
+	TempStart, TempEnd, TempStep float64
+	// RetractStart, RetractEnd and RetractStep set the retraction tower
+	// sections in mm, bottom to top.
+	RetractStart, RetractEnd, RetractStep float64
+	// Flow is the extrusion multiplier of the flow cube.
+	Flow float64
+}
+
+// calibrationMaterial holds print defaults for a material: nozzle and bed
+// temperature, and the temperature tower range.
+type calibrationMaterial struct {
+	nozzle, bed         float64
+	towerHigh, towerLow float64
+}
+
+var calibrationMaterials = map[string]calibrationMaterial{
+	"PLA":  {210, 60, 230, 190},
+	"PETG": {240, 80, 260, 220},
+	"ABS":  {250, 100, 270, 230},
+	"ASA":  {255, 100, 275, 235},
+	"TPU":  {225, 50, 240, 210},
+	"PA":   {260, 90, 280, 240},
+}
+
+const (
+	calFilamentArea   = math.Pi * 1.75 * 1.75 / 4 // mm² of 1.75 mm filament
+	calPrintFeed      = 1800                      // mm/min
+	calFirstFeed      = 1200
+	calTravelFeed     = 9000
+	calRetractFeed    = 2400
+	calDefaultRetract = 0.8
+	calMaxSteps       = 15  // tower sections
+	calBlockHeight    = 8.0 // temperature tower block, mm
+	calSectionHeight  = 5.0 // retraction tower section, mm
+)
+
+// Defaults fills in unset parameters from the material and normalises the
+// material name.
+func (p *CalibrationParams) Defaults() {
+	p.Material = strings.ToUpper(strings.TrimSpace(p.Material))
+	if p.Material == "" {
+		p.Material = "PLA"
+	}
+	m, known := calibrationMaterials[p.Material]
+	if p.NozzleTemp == 0 && known {
+		p.NozzleTemp = m.nozzle
+	}
+	if p.BedTemp == 0 && known {
+		p.BedTemp = m.bed
+	}
+	if p.NozzleDiameter == 0 {
+		p.NozzleDiameter = 0.4
+	}
+	if p.LayerHeight == 0 {
+		p.LayerHeight = math.Round(p.NozzleDiameter*50) / 100
+	}
+	if p.TempStep == 0 {
+		p.TempStep = 5
+	}
+	if p.TempStart == 0 && p.TempEnd == 0 {
+		if known {
+			p.TempStart, p.TempEnd = m.towerHigh, m.towerLow
+		} else {
+			p.TempStart, p.TempEnd = p.NozzleTemp+20, p.NozzleTemp-20
+		}
+	}
+	if p.RetractStep == 0 {
+		p.RetractStep = 0.2
+	}
+	if p.RetractStart == 0 && p.RetractEnd == 0 {
+		p.RetractStart, p.RetractEnd = 0.2, 2.0
+	}
+	if p.Flow == 0 {
+		p.Flow = 1
+	}
+}
+
+// Check reports parameters the print can't be made with on the profile.
+func (p *CalibrationParams) Check(profile Profile) error {
+	known := false
+	for _, k := range CalibrationKinds {
+		known = known || k == p.Kind
+	}
+	switch {
+	case !known:
+		return fmt.Errorf("unknown calibration %q (want %s)", p.Kind, strings.Join(CalibrationKinds, ", "))
+	case p.Tool < 0 || p.Tool >= profile.Toolheads:
+		return fmt.Errorf("tool T%d: %s has %d toolheads", p.Tool, profile.Name, profile.Toolheads)
+	case p.Kind == CalibrationIDEXOffset && profile.Toolheads < 2:
+		return fmt.Errorf("%s needs two toolheads", p.Kind)
+	case p.NozzleTemp <= 0 || p.BedTemp < 0:
+		return fmt.Errorf("no default temperatures for %s; set the nozzle and bed temperature", p.Material)
+	case p.NozzleTemp > profile.MaxHotendTemp || p.TempStart > profile.MaxHotendTemp || p.TempEnd > profile.MaxHotendTemp:
+		return fmt.Errorf("nozzle temperature above the %s limit of %.0f°C", profile.Name, profile.MaxHotendTemp)
+	case p.BedTemp > profile.MaxBedTemp:
+		return fmt.Errorf("bed temperature %.0f°C above the %s limit of %.0f°C", p.BedTemp, profile.Name, profile.MaxBedTemp)
+	case p.NozzleDiameter < 0.1 || p.NozzleDiameter > 1.2:
+		return fmt.Errorf("nozzle diameter %.2f mm out of range", p.NozzleDiameter)
+	case p.LayerHeight <= 0 || p.LayerHeight > p.NozzleDiameter*0.8:
+		return fmt.Errorf("layer height %.2f mm out of range for a %.2f mm nozzle", p.LayerHeight, p.NozzleDiameter)
+	case p.Flow < 0.5 || p.Flow > 1.5:
+		return fmt.Errorf("flow %.2f out of range (0.5 to 1.5)", p.Flow)
+	}
+	if p.Kind == CalibrationTempTower {
+		if p.TempStep <= 0 || p.TempEnd < 150 || p.TempStart < 150 {
+			return fmt.Errorf("temperature tower range %.0f-%.0f°C step %.0f is invalid", p.TempStart, p.TempEnd, p.TempStep)
+		}
+		n := calSteps(p.TempStart, p.TempEnd, p.TempStep)
+		if n > calMaxSteps {
+			return fmt.Errorf("temperature tower has %d blocks, at most %d", n, calMaxSteps)
+		}
+		if height := float64(n) * calBlockHeight; height > profile.BedZ {
+			return fmt.Errorf("temperature tower is %.0f mm tall, the %s builds %.0f mm", height, profile.Name, profile.BedZ)
+		}
+	}
+	if p.Kind == CalibrationRetraction {
+		if p.RetractStep <= 0 || p.RetractStart < 0 || p.RetractEnd < 0 || p.RetractStart > 10 || p.RetractEnd > 10 {
+			return fmt.Errorf("retraction range %.2f-%.2f mm step %.2f is invalid", p.RetractStart, p.RetractEnd, p.RetractStep)
+		}
+		n := calSteps(p.RetractStart, p.RetractEnd, p.RetractStep)
+		if n > calMaxSteps {
+			return fmt.Errorf("retraction tower has %d sections, at most %d", n, calMaxSteps)
+		}
+		if height := float64(n) * calSectionHeight; height > profile.BedZ {
+			return fmt.Errorf("retraction tower is %.0f mm tall, the %s builds %.0f mm", height, profile.Name, profile.BedZ)
+		}
+	}
+	return nil
+}
+
+// FileName returns a file name describing the print.
+func (p *CalibrationParams) FileName() string {
+	switch p.Kind {
+	case CalibrationIDEXOffset:
+		return fmt.Sprintf("%s_%s.gcode", p.Kind, p.Material)
+	case CalibrationTempTower:
+		return fmt.Sprintf("%s_%s_T%d_%.0f-%.0f.gcode", p.Kind, p.Material, p.Tool, p.TempStart, p.TempEnd)
+	case CalibrationFlowCube:
+		return fmt.Sprintf("%s_%s_T%d_%.0f.gcode", p.Kind, p.Material, p.Tool, p.Flow*100)
+	}
+	return fmt.Sprintf("%s_%s_T%d.gcode", p.Kind, p.Material, p.Tool)
+}
+
+// calSteps returns the number of values from start to end in steps of
+// step, in either direction.
+func calSteps(start, end, step float64) int {
+	return int(math.Floor(math.Abs(end-start)/step+1e-6)) + 1
+}
+
+// calStep returns the i-th value from start towards end.
+func calStep(start, end, step float64, i int) float64 {
+	if end < start {
+		step = -step
+	}
+	return start + float64(i)*step
+}
+
+// GenerateCalibration writes a calibration print for the model's profile.
+// The output is plain slicer-style gcode with the metadata comments the
+// header scan reads, so printing it takes the normal processing path.
+func GenerateCalibration(w io.Writer, model string, p CalibrationParams) error {
+	profile := ProfileForModel(model)
+	p.Defaults()
+	if err := p.Check(profile); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	c := newCalWriter(bw, p)
+	tools := []int{p.Tool}
+	if p.Kind == CalibrationIDEXOffset {
+		tools = []int{0, 1}
+	}
+	c.start(profile, tools)
+
+	cx, cy := profile.BedX/2, profile.BedY/2
+	switch p.Kind {
+	case CalibrationIDEXOffset:
+		c.idexOffset(cx, cy)
+	case CalibrationTempTower:
+		c.tempTower(cx, cy)
+	case CalibrationFlowCube:
+		c.flowCube(cx, cy)
+	case CalibrationRetraction:
+		c.retractionTower(cx, cy)
+	case CalibrationFirstLayer:
+		c.firstLayer(profile)
+	}
+
+	c.end(tools)
+	return bw.Flush()
+}
+
+// calWriter writes toolpaths with relative extrusion.
+type calWriter struct {
+	w         *bufio.Writer
+	p         CalibrationParams
+	x, y      float64
+	z         float64
+	width     float64 // extrusion width
+	flow      float64
+	feed      float64
+	retract   float64
+	retracted bool
+	layer     int
+	time      float64 // estimated print time of the moves, seconds
+}
+
+func newCalWriter(w *bufio.Writer, p CalibrationParams) *calWriter {
+	return &calWriter{
+		w:       w,
+		p:       p,
+		width:   p.NozzleDiameter * 1.125,
+		flow:    1,
+		feed:    calFirstFeed,
+		retract: calDefaultRetract,
+	}
+}
+
+func (c *calWriter) cmd(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format, args...)
+	c.w.WriteByte('\n')
+}
+
+var calTitles = map[string]string{
+	CalibrationIDEXOffset: "IDEX XY offset",
+	CalibrationTempTower:  "Temperature tower",
+	CalibrationFlowCube:   "Flow cube",
+	CalibrationRetraction: "Retraction tower",
+	CalibrationFirstLayer: "First layer squares",
+}
+
+// start writes the metadata comments, heats the tools used, homes and
+// primes.
+func (c *calWriter) start(profile Profile, tools []int) {
+	p := c.p
+	c.cmd("; %s calibration for %s, %s, generated by snapmaker_moonraker", calTitles[p.Kind], profile.Name, p.Material)
+	c.cmd("; filament_type = %s;%s", p.Material, p.Material)
+	c.cmd("; nozzle_diameter = %.2f,%.2f", p.NozzleDiameter, p.NozzleDiameter)
+	c.cmd("; layer_height = %.2f", p.LayerHeight)
+	c.cmd("; retract_length = %.2f,%.2f", calDefaultRetract, calDefaultRetract)
+	temp := p.NozzleTemp
+	if p.Kind == CalibrationTempTower {
+		temp = p.TempStart
+	}
+	c.cmd("M140 S%.0f", p.BedTemp)
+	for _, t := range tools {
+		c.cmd("M104 T%d S%.0f", t, temp)
+	}
+	c.cmd("G28")
+	c.cmd("M190 S%.0f", p.BedTemp)
+	for _, t := range tools {
+		c.cmd("M109 T%d S%.0f", t, temp)
+	}
+	c.cmd("G90")
+	c.cmd("M83")
+	c.cmd("M107")
+
+	// Prime each head along the front edge, at first layer height so the
+	// prime lines count as part of the first layer.
+	c.z = p.LayerHeight
+	for i, t := range tools {
+		if i > 0 {
+			c.retractNow()
+		}
+		c.cmd("T%d", t)
+		c.cmd("G0 Z%.3f F600", c.z)
+		y := 5 + float64(i)*3
+		c.moveTo(10, y)
+		c.flow = 1.5
+		c.lineTo(10+math.Min(80, profile.BedX/3), y)
+		c.flow = 1
+	}
+}
+
+// end turns the heaters off and parks.
+func (c *calWriter) end(tools []int) {
+	c.retractNow()
+	c.cmd("G0 Z%.3f F600", c.z+5)
+	for _, t := range tools {
+		c.cmd("M104 T%d S0", t)
+	}
+	c.cmd("M140 S0")
+	c.cmd("M107")
+	c.cmd("G28 X")
+	c.cmd("M84")
+	// Read by the header scan; PrusaSlicer also writes it at the end.
+	c.cmd("; estimated printing time = %.0f", c.time)
+}
+
+// nextLayer moves up to z and marks a layer change.
+func (c *calWriter) nextLayer(z float64) {
+	c.layer++
+	c.z = z
+	c.cmd(";LAYER_CHANGE")
+	c.cmd(";Z:%.3f", z)
+	c.cmd("G0 Z%.3f F600", z)
+	c.feed = calPrintFeed
+	if c.layer == 1 {
+		c.feed = calFirstFeed
+	}
+	if c.layer == 2 {
+		c.cmd("M106 S255")
+	}
+}
+
+// layerHeight returns the height of the layer being printed.
+func (c *calWriter) layerHeight() float64 {
+	if c.layer <= 1 {
+		return math.Max(c.z, c.p.LayerHeight)
+	}
+	return c.p.LayerHeight
+}
+
+func (c *calWriter) retractNow() {
+	if !c.retracted && c.retract > 0 {
+		c.cmd("G1 E-%.3f F%d", c.retract, calRetractFeed)
+		c.retracted = true
+	}
+}
+
+// moveTo travels to x, y, retracting for longer moves.
+func (c *calWriter) moveTo(x, y float64) {
+	if math.Hypot(x-c.x, y-c.y) > 2 {
+		c.retractNow()
+	}
+	c.cmd("G0 X%.3f Y%.3f F%d", x, y, calTravelFeed)
+	c.time += math.Hypot(x-c.x, y-c.y) / calTravelFeed * 60
+	c.x, c.y = x, y
+}
+
+// lineTo extrudes a line to x, y.
+func (c *calWriter) lineTo(x, y float64) {
+	if c.retracted {
+		c.cmd("G1 E%.3f F%d", c.retract, calRetractFeed)
+		c.retracted = false
+	}
+	e := math.Hypot(x-c.x, y-c.y) * c.width * c.layerHeight() / calFilamentArea * c.flow
+	c.cmd("G1 X%.3f Y%.3f E%.5f F%.0f", x, y, e, c.feed)
+	c.time += math.Hypot(x-c.x, y-c.y) / c.feed * 60
+	c.x, c.y = x, y
+}
+
+// rect extrudes the outline of a rectangle.
+func (c *calWriter) rect(x0, y0, x1, y1 float64) {
+	c.moveTo(x0, y0)
+	c.lineTo(x1, y0)
+	c.lineTo(x1, y1)
+	c.lineTo(x0, y1)
+	c.lineTo(x0, y0)
+}
+
+// walls extrudes n outlines inwards from the rectangle centred on cx, cy,
+// returning the area left inside them.
+func (c *calWriter) walls(cx, cy, w, h float64, n int) (x0, y0, x1, y1 float64) {
+	x0, y0, x1, y1 = cx-w/2, cy-h/2, cx+w/2, cy+h/2
+	for i := 0; i < n; i++ {
+		inset := c.width * (float64(i) + 0.5)
+		c.rect(x0+inset, y0+inset, x1-inset, y1-inset)
+	}
+	inset := c.width * float64(n)
+	return x0 + inset, y0 + inset, x1 - inset, y1 - inset
+}
+
+// fill extrudes a zigzag over a rectangle.
+func (c *calWriter) fill(x0, y0, x1, y1 float64) {
+	y := y0 + c.width/2
+	c.moveTo(x0, y)
+	for i := 0; y <= y1-c.width/2+1e-6; i++ {
+		if i > 0 {
+			c.lineTo(c.x, y)
+		}
+		if i%2 == 0 {
+			c.lineTo(x1, y)
+		} else {
+			c.lineTo(x0, y)
+		}
+		y += c.width
+	}
+}
+
+// block extrudes a solid-bottomed rectangle with two walls, the first
+// layer filled.
+func (c *calWriter) block(cx, cy, w, h float64) {
+	x0, y0, x1, y1 := c.walls(cx, cy, w, h, 2)
+	if c.layer == 1 {
+		c.fill(x0, y0, x1, y1)
+	}
+}
+
+// idexOffset prints a vernier for X and one for Y. T0 prints lines 3 mm
+// apart and T1 lines 3.1 mm apart, touching end to end; the pair that
+// lines up gives T1's offset from T0.
+func (c *calWriter) idexOffset(cx, cy float64) {
+	const lines, pitch, vernier, length = 5, 3.0, 3.1, 10.0
+	c.cmd("; Find the T0/T1 line pair that lines up, counting from the long centre")
+	c.cmd("; line: +n to the right (X) or to the back (Y) means T1 prints n x 0.1 mm")
+	c.cmd("; too far towards negative; raise its offset on that axis by n x 0.1 mm.")
+	xc, yc := cx-25, cy // X vernier: vertical lines
+	yx, yy := cx+25, cy // Y vernier: horizontal lines
+	for _, z := range []float64{c.p.LayerHeight, 2 * c.p.LayerHeight} {
+		c.nextLayer(z)
+		for _, t := range []int{0, 1} {
+			c.retractNow()
+			c.cmd("T%d", t)
+			p := pitch
+			if t == 1 {
+				p = vernier
+			}
+			for i := -lines; i <= lines; i++ {
+				l := length
+				if i == 0 {
+					l += 3
+				}
+				x := xc + float64(i)*p
+				if t == 0 {
+					c.moveTo(x, yc)
+					c.lineTo(x, yc+l)
+				} else {
+					c.moveTo(x, yc)
+					c.lineTo(x, yc-l)
+				}
+			}
+			for i := -lines; i <= lines; i++ {
+				l := length
+				if i == 0 {
+					l += 3
+				}
+				y := yy + float64(i)*p
+				if t == 0 {
+					c.moveTo(yx, y)
+					c.lineTo(yx-l, y)
+				} else {
+					c.moveTo(yx, y)
+					c.lineTo(yx+l, y)
+				}
+			}
+		}
+	}
+}
+
+// tempTower prints a block per temperature, hottest first by default.
+func (c *calWriter) tempTower(cx, cy float64) {
+	p := c.p
+	blocks := calSteps(p.TempStart, p.TempEnd, p.TempStep)
+	layers := int(math.Round(calBlockHeight / p.LayerHeight))
+	for b := 0; b < blocks; b++ {
+		temp := calStep(p.TempStart, p.TempEnd, p.TempStep, b)
+		c.cmd("; TEMPERATURE %.0f (block %d from the bottom)", temp, b+1)
+		c.cmd("M104 T%d S%.0f", p.Tool, temp)
+		for l := 0; l < layers; l++ {
+			c.nextLayer(float64(b*layers+l+1) * p.LayerHeight)
+			c.block(cx, cy, 30, 10)
+		}
+	}
+}
+
+// flowCube prints a hollow 20 mm cube with two walls at the flow
+// multiplier; each wall should measure 2 x the extrusion width.
+func (c *calWriter) flowCube(cx, cy float64) {
+	p := c.p
+	c.cmd("; Walls should measure %.2f mm at flow %.2f", 2*c.width, p.Flow)
+	layers := int(math.Round(20 / p.LayerHeight))
+	for l := 0; l < layers; l++ {
+		c.nextLayer(float64(l+1) * p.LayerHeight)
+		c.flow = p.Flow
+		c.block(cx, cy, 20, 20)
+	}
+	c.flow = 1
+}
+
+// retractionTower prints two towers 40 mm apart, with travel between them
+// on every layer and a longer retraction every 5 mm of height.
+func (c *calWriter) retractionTower(cx, cy float64) {
+	p := c.p
+	sections := calSteps(p.RetractStart, p.RetractEnd, p.RetractStep)
+	layers := int(math.Round(calSectionHeight / p.LayerHeight))
+	for s := 0; s < sections; s++ {
+		retract := calStep(p.RetractStart, p.RetractEnd, p.RetractStep, s)
+		c.cmd("; RETRACTION %.2f mm (section %d from the bottom)", retract, s+1)
+		if c.retracted {
+			// Prime with the old distance before changing it.
+			c.cmd("G1 E%.3f F%d", c.retract, calRetractFeed)
+			c.retracted = false
+		}
+		c.retract = retract
+		for l := 0; l < layers; l++ {
+			c.nextLayer(float64(s*layers+l+1) * p.LayerHeight)
+			c.block(cx-20, cy, 10, 10)
+			c.block(cx+20, cy, 10, 10)
+		}
+	}
+	c.retract = calDefaultRetract
+}
+
+// firstLayer prints filled squares in the corners and the centre of the
+// bed, in one layer.
+func (c *calWriter) firstLayer(profile Profile) {
+	size := math.Min(30, math.Min(profile.BedX, profile.BedY)/6)
+	margin := size/2 + 15
+	c.nextLayer(c.p.LayerHeight)
+	for _, pos := range [][2]float64{
+		{margin, margin},
+		{profile.BedX - margin, margin},
+		{profile.BedX / 2, profile.BedY / 2},
+		{margin, profile.BedY - margin},
+		{profile.BedX - margin, profile.BedY - margin},
+	} {
+		x0, y0, x1, y1 := c.walls(pos[0], pos[1], size, size, 1)
+		c.fill(x0, y0, x1, y1)
+	}
+}
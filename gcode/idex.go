@@ -0,0 +1,252 @@
+package gcode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// planIDEXConversion checks that a single-tool file can be printed in the
+// requested Duplication or Mirror mode and records the conversion in meta:
+// the part must fit in half the bed width, and if it sits outside the left
+// half it is shifted to the middle of it. The part is measured from the
+// slicer's print bounds, or failing that from extruding moves, so purge
+// lines at the bed edge don't count. Must run before finalizeMetadata, which
+// then copies T0's settings to T1 for the header.
+func planIDEXConversion(meta *metadata, opts Options) error {
+	mode := opts.IDEXMode
+	if mode != IDEXModeDuplication && mode != IDEXModeMirror {
+		return fmt.Errorf("IDEX conversion: unsupported mode %q", mode)
+	}
+	if meta.idexMode != "" {
+		return fmt.Errorf("IDEX conversion: file already selects %s mode", meta.idexMode)
+	}
+	if !opts.ToolMap.IsDefault() {
+		return fmt.Errorf("IDEX conversion: can't be combined with a tool map")
+	}
+	if meta.maxToolNum > 0 || meta.toolsUsed[1] || meta.filamentMM[1] > 0 {
+		return fmt.Errorf("IDEX conversion: file uses more than one tool")
+	}
+	if meta.partMinX > meta.partMaxX {
+		return fmt.Errorf("IDEX conversion: file has no extruding moves")
+	}
+
+	half := ProfileForModel(opts.Model).PrintWidth(mode)
+	width := meta.partMaxX - meta.partMinX
+	if width > half {
+		return fmt.Errorf("IDEX conversion: part is %.1f mm wide but %s mode fits %.0f mm", width, mode, half)
+	}
+
+	shift := 0.0
+	if meta.partMinX < 0 || meta.partMaxX > half {
+		shift = (half-width)/2 - meta.partMinX
+	}
+	// Everything else (travel, purge lines) is clamped into the half bed.
+	meta.minX = clamp(meta.minX+shift, 0, half)
+	meta.maxX = clamp(meta.maxX+shift, 0, half)
+	meta.shiftX = shift
+	meta.halfWidth = half
+	meta.idexMode = mode
+	meta.idexConvert = true
+	return nil
+}
+
+// idexConvertStage rewrites a single-tool body for Duplication or Mirror
+// mode: it activates the mode with M605 after the last homing move before
+// printing, shifts absolute X coordinates into the left half of the bed, and
+// repeats every T0 temperature command for T1. Shifted moves that would
+// leave the half bed (purge lines at the edge) are clamped to it and lose
+// their extrusion, so they don't dump filament in one spot at the edge.
+type idexConvertStage struct {
+	passStage
+	activate  string
+	homeLine  int
+	shiftX    float64
+	halfWidth float64
+	relative  bool
+	relativeE bool
+}
+
+func newIDEXConvertStage(meta *metadata, model string) *idexConvertStage {
+	activate := "M605 S3 ; IDEX Mirror mode (converted)"
+	if meta.idexMode == IDEXModeDuplication {
+		activate = "M605 S2"
+		if off := ProfileForModel(model).DuplicationOffset; off > 0 {
+			activate += fmt.Sprintf(" X%s R0", formatCoord(off))
+		}
+		activate += " ; IDEX Duplication mode (converted)"
+	}
+	return &idexConvertStage{
+		passStage: passStage{"idex_convert"},
+		activate:  activate,
+		homeLine:  meta.homeLine,
+		shiftX:    meta.shiftX,
+		halfWidth: meta.halfWidth,
+	}
+}
+
+func (s *idexConvertStage) begin(emit emitFunc) error {
+	if s.homeLine < 0 {
+		return emit(s.activate)
+	}
+	return nil
+}
+
+func (s *idexConvertStage) line(idx int, line string, emit emitFunc) error {
+	codePart, commentPart := splitCode(line)
+	fields := strings.Fields(codePart)
+	if len(fields) == 0 {
+		return emit(line)
+	}
+	cmd := strings.ToUpper(fields[0])
+
+	switch cmd {
+	case "G90":
+		s.relative, s.relativeE = false, false
+	case "G91":
+		s.relative, s.relativeE = true, true
+	case "M82":
+		s.relativeE = false
+	case "M83":
+		s.relativeE = true
+	case "G28":
+		if err := emit(line); err != nil {
+			return err
+		}
+		if idx == s.homeLine {
+			return emit(s.activate)
+		}
+		return nil
+	case "G0", "G1", "G2", "G3":
+		if !s.relative {
+			return s.shiftMove(fields, commentPart, line, emit)
+		}
+	case "G92":
+		// G92 redefines the logical position; shift it by the same amount
+		// but don't clamp, it isn't a move.
+		if s.shiftX != 0 {
+			out, _ := shiftParam(fields, commentPart, 'X', s.shiftX, math.Inf(-1), math.Inf(1), line)
+			return emit(out)
+		}
+	case "M104", "M109":
+		if err := emit(line); err != nil {
+			return err
+		}
+		if toolParam(fields) == 0 {
+			return emit(withToolParam(fields, 1, commentPart))
+		}
+		return nil
+	}
+	return emit(line)
+}
+
+// shiftMove shifts a move's X into the half bed. A move that had to be
+// clamped is emitted without its E; in absolute extrusion a G92 then sets
+// E to where the move would have left it, so the next move extrudes only
+// its own share.
+func (s *idexConvertStage) shiftMove(fields []string, commentPart, line string, emit emitFunc) error {
+	out, clamped := shiftParam(fields, commentPart, 'X', s.shiftX, 0, s.halfWidth, line)
+	if !clamped {
+		return emit(out)
+	}
+	kept := []string{fields[0]}
+	e := ""
+	for _, f := range fields[1:] {
+		if len(f) >= 2 && (f[0] == 'E' || f[0] == 'e') {
+			e = f[1:]
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if e == "" {
+		return emit(out)
+	}
+	out = strings.Join(kept, " ")
+	if commentPart != "" {
+		out += " " + commentPart
+	}
+	if err := emit(out); err != nil {
+		return err
+	}
+	if !s.relativeE {
+		return emit("G92 E" + e + " ; extrusion dropped outside the half bed")
+	}
+	return nil
+}
+
+// shiftParam adds delta to one axis parameter of a command and clamps the
+// result to [lo, hi], returning original unchanged if the parameter is absent.
+// It reports whether the value had to be clamped.
+func shiftParam(fields []string, commentPart string, axis byte, delta, lo, hi float64, original string) (string, bool) {
+	changed, clamped := false, false
+	for i, f := range fields[1:] {
+		if len(f) < 2 || (f[0] != axis && f[0] != axis+32) {
+			continue
+		}
+		v, err := strconv.ParseFloat(f[1:], 64)
+		if err != nil {
+			continue
+		}
+		c := clamp(v+delta, lo, hi)
+		if c != v+delta {
+			clamped = true
+		}
+		fields[i+1] = string(axis) + formatCoord(c)
+		changed = true
+	}
+	if !changed {
+		return original, false
+	}
+	out := strings.Join(fields, " ")
+	if commentPart != "" {
+		out += " " + commentPart
+	}
+	return out, clamped
+}
+
+// toolParam returns the T parameter of a temperature command, 0 if absent
+// (the file only ever selects T0), or -1 if malformed.
+func toolParam(fields []string) int {
+	for _, f := range fields[1:] {
+		if len(f) >= 2 && (f[0] == 'T' || f[0] == 't') {
+			n, err := strconv.Atoi(f[1:])
+			if err != nil {
+				return -1
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+// withToolParam rebuilds a temperature command targeting the given tool.
+func withToolParam(fields []string, tool int, commentPart string) string {
+	out := []string{fields[0], fmt.Sprintf("T%d", tool)}
+	for _, f := range fields[1:] {
+		if len(f) >= 1 && (f[0] == 'T' || f[0] == 't') {
+			continue
+		}
+		out = append(out, f)
+	}
+	s := strings.Join(out, " ")
+	if commentPart != "" {
+		s += " " + commentPart
+	}
+	return s
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+// formatCoord formats a coordinate with up to three decimals, trimming
+// trailing zeros the way slicers do.
+func formatCoord(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 3, 64)
+	s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,394 @@
+package gcode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrintIndex describes a processed file in terms of its output line numbers
+// (1-based, header included), which is what the printer reports while
+// printing. ProcessFile builds it and saves it beside the source file.
+type PrintIndex struct {
+	Lines       int       `json:"lines"`        // total output lines
+	TotalLayers int       `json:"total_layers"` // layer count
+	LayerStarts []int     `json:"layer_starts"` // output line where each layer begins
+	LayerZ      []float64 `json:"layer_z"`      // Z height of each layer
+
+	// Estimated print time, and a sampled map of estimated elapsed time
+	// (TimeSecs) at output lines (TimeLines), interpolated in between.
+	EstimatedTime float64   `json:"estimated_time"`
+	TimeLines     []int     `json:"time_lines"`
+	TimeSecs      []float64 `json:"time_secs"`
+
+	// Size of the source file, and a sampled map of source byte offsets
+	// (Offsets) and 1-based source lines (SourceLines) at output lines
+	// (OffsetLines), interpolated in between.
+	SourceSize  int64   `json:"source_size"`
+	OffsetLines []int   `json:"offset_lines"`
+	Offsets     []int64 `json:"offsets"`
+	SourceLines []int   `json:"source_lines"`
+
+	// Points where the bridge pauses the print (see pauseStage), and the
+	// output lines where the extrusion mode changes to relative or not.
+	Pauses       []Pause `json:"pauses,omitempty"`
+	ModeLines    []int   `json:"mode_lines,omitempty"`
+	ModeRelative []bool  `json:"mode_relative,omitempty"`
+
+	// Labelled objects and those left out of this print, and the object
+	// being printed from each output line in ObjectLines on ("" between
+	// objects). ObjectKind is the kind of label the file is followed by.
+	Objects     []Object `json:"objects,omitempty"`
+	Excluded    []string `json:"excluded,omitempty"`
+	ObjectLines []int    `json:"object_lines,omitempty"`
+	ObjectNames []string `json:"object_names,omitempty"`
+	ObjectKind  int      `json:"object_kind,omitempty"`
+}
+
+// IndexPath returns where the print index of srcPath is kept: a hidden file
+// next to it, so it follows the file through the gcodes tree.
+func IndexPath(srcPath string) string {
+	return filepath.Join(filepath.Dir(srcPath), "."+filepath.Base(srcPath)+".index")
+}
+
+// LoadIndex reads a print index saved by ProcessFile.
+func LoadIndex(path string) (*PrintIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var idx PrintIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("parsing print index %s: %w", path, err)
+	}
+	return &idx, nil
+}
+
+// Save writes the index to path.
+func (x *PrintIndex) Save(path string) error {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Layer returns the 1-based layer being printed at output line, or 0 before
+// the first layer starts.
+func (x *PrintIndex) Layer(line int) int {
+	return sort.Search(len(x.LayerStarts), func(i int) bool { return x.LayerStarts[i] > line })
+}
+
+// Elapsed returns the estimated print time, in seconds, to reach output
+// line.
+func (x *PrintIndex) Elapsed(line int) float64 {
+	i := sort.SearchInts(x.TimeLines, line)
+	switch {
+	case len(x.TimeLines) == 0:
+		return 0
+	case i == len(x.TimeLines):
+		return x.EstimatedTime
+	case x.TimeLines[i] == line:
+		return x.TimeSecs[i]
+	}
+	prevLine, prevSecs := 0, 0.0
+	if i > 0 {
+		prevLine, prevSecs = x.TimeLines[i-1], x.TimeSecs[i-1]
+	}
+	frac := float64(line-prevLine) / float64(x.TimeLines[i]-prevLine)
+	return prevSecs + frac*(x.TimeSecs[i]-prevSecs)
+}
+
+// FilePosition returns the byte offset in the source file of the line the
+// printer is at when it reports output line, as Klipper's virtual_sdcard
+// would for the file it reads.
+func (x *PrintIndex) FilePosition(line int) int64 {
+	if line >= x.Lines {
+		return x.SourceSize
+	}
+	i := sort.SearchInts(x.OffsetLines, line)
+	if i < len(x.OffsetLines) && x.OffsetLines[i] == line {
+		return x.Offsets[i]
+	}
+	prevLine, prevOff := 0, int64(0)
+	if i > 0 {
+		prevLine, prevOff = x.OffsetLines[i-1], x.Offsets[i-1]
+	}
+	nextLine, nextOff := x.Lines, x.SourceSize
+	if i < len(x.OffsetLines) {
+		nextLine, nextOff = x.OffsetLines[i], x.Offsets[i]
+	}
+	if nextLine <= prevLine {
+		return prevOff
+	}
+	return prevOff + int64(float64(line-prevLine)/float64(nextLine-prevLine)*float64(nextOff-prevOff))
+}
+
+// CurrentObject returns the name of the object being printed at output
+// line, or "" if none.
+func (x *PrintIndex) CurrentObject(line int) string {
+	i := sort.Search(len(x.ObjectLines), func(i int) bool { return x.ObjectLines[i] > line })
+	if i == 0 {
+		return ""
+	}
+	return x.ObjectNames[i-1]
+}
+
+// RelativeE reports whether the file extrudes in relative mode (M83) at
+// output line.
+func (x *PrintIndex) RelativeE(line int) bool {
+	i := sort.Search(len(x.ModeLines), func(i int) bool { return x.ModeLines[i] > line })
+	return i > 0 && x.ModeRelative[i-1]
+}
+
+// Progress returns the time-based progress (0.0-1.0) at output line, or -1
+// if the index has no time estimate.
+func (x *PrintIndex) Progress(line int) float64 {
+	if x.EstimatedTime <= 0 {
+		return -1
+	}
+	return math.Min(x.Elapsed(line)/x.EstimatedTime, 1)
+}
+
+// layerEpsilon ignores Z differences below this (mm) when detecting layers.
+const layerEpsilon = 1e-4
+
+// timeSampleStep is the moveTimer interval (seconds) between time map
+// samples; the printer's line feed is much coarser than that anyway.
+const timeSampleStep = 2.0
+
+// offsetSampleStep is the number of source bytes between byte offset
+// samples, which keeps the index small for large files.
+const offsetSampleStep = 8 * 1024
+
+// timeAnchor pins the moveTimer clock at a slicer M73 marker to the time the
+// slicer says has elapsed there.
+type timeAnchor struct {
+	clock, elapsed float64
+}
+
+// indexStage is the last stage of the write pass: it sees exactly the lines
+// that reach the output, so its line numbers include the header and every
+// line the other stages insert. A new layer starts at the first extruding
+// move above the previous layer, so Z hops don't count. If the file sets
+// layers itself with SET_PRINT_STATS_INFO, those win. That command is
+// Klipper-only, so it is turned into a comment for the printer.
+//
+// Byte offsets are sampled at the first output line of a source line, so
+// lines other stages insert map to the source line they precede.
+//
+// The time map samples a moveTimer. If the slicer left M73 R markers (found
+// in pass 1 by source line, so M73 lines the progress stage inserts don't
+// count) the clock is stretched piecewise to match them. Files with only
+// M73 P markers are stretched to match the percentages of the slicer's
+// total estimate, or of the clock's own total without one. Otherwise the
+// clock is scaled to the slicer's total estimate, if any.
+type indexStage struct {
+	passStage
+	index    *PrintIndex
+	out      int // output line number of the last emitted line
+	timer    *moveTimer
+	layerZ   float64
+	explicit bool // the file sets CURRENT_LAYER itself
+
+	remaining     map[int]float64 // from metadata.remaining
+	percent       map[int]float64 // from metadata.percent
+	estimatedTime float64
+	lastIdx       int
+	lastSample    float64
+	anchors       []timeAnchor
+	pctAnchors    []timeAnchor // elapsed holds the fraction done
+
+	offset     int64 // byte offset of the current source line
+	lastOffset int64
+	newSource  bool // no output line yet for the current source line
+
+	objects objectTracker
+}
+
+func newIndexStage(headerLines int, meta *metadata, opts Options) *indexStage {
+	return &indexStage{
+		passStage:     passStage{"print_index"},
+		index:         &PrintIndex{Objects: meta.objects, Excluded: opts.ExcludeObjects, ObjectKind: meta.objectKind},
+		objects:       objectTracker{kind: meta.objectKind},
+		out:           headerLines,
+		timer:         newMoveTimer(),
+		layerZ:        -1,
+		remaining:     meta.remaining,
+		percent:       meta.percent,
+		estimatedTime: meta.estimatedTime,
+		lastIdx:       -1,
+		lastOffset:    -offsetSampleStep,
+	}
+}
+
+func (s *indexStage) sourceOffset(offset int64) {
+	s.offset = offset
+	s.newSource = true
+}
+
+func (s *indexStage) line(idx int, line string, emit emitFunc) error {
+	codePart, _ := splitCode(line)
+	upper := strings.ToUpper(codePart)
+	s.out++
+	s.sampleTime(idx)
+	if s.newSource {
+		s.newSource = false
+		if s.offset-s.lastOffset >= offsetSampleStep {
+			s.index.OffsetLines = append(s.index.OffsetLines, s.out)
+			s.index.Offsets = append(s.index.Offsets, s.offset)
+			s.index.SourceLines = append(s.index.SourceLines, idx+1)
+			s.lastOffset = s.offset
+		}
+	}
+
+	if len(s.index.Objects) > 0 && s.objects.update(strings.TrimSpace(line)) {
+		s.index.ObjectLines = append(s.index.ObjectLines, s.out)
+		s.index.ObjectNames = append(s.index.ObjectNames, s.objects.current)
+	}
+
+	if p, ok := parsePauseMarker(line); ok {
+		p.Line = s.out
+		p.RelativeE, p.E = s.timer.relativeE, s.timer.pos[3]
+		s.index.Pauses = append(s.index.Pauses, p)
+	}
+
+	if strings.HasPrefix(upper, "SET_PRINT_STATS_INFO") {
+		s.printStatsInfo(upper)
+		return emit("; " + strings.TrimSpace(line))
+	}
+
+	prevE, prevRelative := s.timer.pos[3], s.timer.relativeE
+	s.timer.line(upper)
+	if s.timer.relativeE != prevRelative {
+		s.index.ModeLines = append(s.index.ModeLines, s.out)
+		s.index.ModeRelative = append(s.index.ModeRelative, s.timer.relativeE)
+	}
+	if !s.explicit && startsLayer(upper, s.timer, prevE, s.layerZ) {
+		s.layerZ = s.timer.pos[2]
+		s.index.LayerStarts = append(s.index.LayerStarts, s.out)
+		s.index.LayerZ = append(s.index.LayerZ, s.layerZ)
+	}
+	return emit(line)
+}
+
+// startsLayer reports whether a line the timer has just run is the first
+// extruding move above layerZ, which starts a new layer. prevE is the E
+// position before the line.
+func startsLayer(upper string, t *moveTimer, prevE, layerZ float64) bool {
+	return isG0G1(upper) && t.pos[3] > prevE && t.pos[2] > layerZ+layerEpsilon
+}
+
+// printStatsInfo applies SET_PRINT_STATS_INFO TOTAL_LAYER=n CURRENT_LAYER=n.
+func (s *indexStage) printStatsInfo(upper string) {
+	for _, f := range strings.Fields(upper)[1:] {
+		key, val, ok := strings.Cut(f, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch key {
+		case "TOTAL_LAYER":
+			s.index.TotalLayers = n
+		case "CURRENT_LAYER":
+			if !s.explicit {
+				s.explicit = true
+				s.index.LayerStarts, s.index.LayerZ = nil, nil
+			}
+			for len(s.index.LayerStarts) < n {
+				s.index.LayerStarts = append(s.index.LayerStarts, s.out)
+				s.index.LayerZ = append(s.index.LayerZ, s.timer.pos[2])
+			}
+		}
+	}
+}
+
+// sampleTime records the clock before the line at s.out runs, so the time
+// map gives the time at which each line starts.
+func (s *indexStage) sampleTime(idx int) {
+	clock := s.timer.elapsed
+	if idx != s.lastIdx {
+		s.lastIdx = idx
+		if r, ok := s.remaining[idx]; ok {
+			s.anchors = append(s.anchors, timeAnchor{clock: clock, elapsed: -r})
+			s.addSample(clock)
+			return
+		}
+		if p, ok := s.percent[idx]; ok && len(s.remaining) == 0 {
+			s.pctAnchors = append(s.pctAnchors, timeAnchor{clock: clock, elapsed: p / 100})
+			s.addSample(clock)
+			return
+		}
+	}
+	if clock-s.lastSample >= timeSampleStep {
+		s.addSample(clock)
+	}
+}
+
+func (s *indexStage) addSample(clock float64) {
+	s.index.TimeLines = append(s.index.TimeLines, s.out)
+	s.index.TimeSecs = append(s.index.TimeSecs, clock)
+	s.lastSample = clock
+}
+
+func (s *indexStage) end(emit emitFunc) error {
+	s.index.Lines = s.out
+	s.index.SourceSize = s.offset
+	if s.index.TotalLayers == 0 {
+		s.index.TotalLayers = len(s.index.LayerStarts)
+	}
+
+	// Final sample, then convert the clock samples into estimated time.
+	clock := s.timer.elapsed
+	s.index.TimeLines = append(s.index.TimeLines, s.out)
+	s.index.TimeSecs = append(s.index.TimeSecs, clock)
+	if len(s.anchors) == 0 && len(s.pctAnchors) > 0 {
+		total := s.estimatedTime
+		if total <= 0 {
+			total = clock
+		}
+		for _, a := range s.pctAnchors {
+			s.anchors = append(s.anchors, timeAnchor{clock: a.clock, elapsed: a.elapsed*total - total})
+		}
+	}
+	if len(s.anchors) > 0 {
+		// Anchors hold -remaining; the first one fixes the total.
+		total := s.anchors[0].clock - s.anchors[0].elapsed
+		for i := range s.anchors {
+			s.anchors[i].elapsed += total
+		}
+		for i, c := range s.index.TimeSecs {
+			s.index.TimeSecs[i] = anchoredTime(s.anchors, c)
+		}
+	} else if s.estimatedTime > 0 && clock > 0 {
+		for i := range s.index.TimeSecs {
+			s.index.TimeSecs[i] *= s.estimatedTime / clock
+		}
+	}
+	s.index.EstimatedTime = s.index.TimeSecs[len(s.index.TimeSecs)-1]
+	return nil
+}
+
+// anchoredTime maps a moveTimer clock value to estimated elapsed time by
+// interpolating between anchors; outside them the clock runs unscaled.
+func anchoredTime(anchors []timeAnchor, clock float64) float64 {
+	i := sort.Search(len(anchors), func(i int) bool { return anchors[i].clock > clock })
+	if i == 0 {
+		return clock
+	}
+	prev := anchors[i-1]
+	if i == len(anchors) {
+		return prev.elapsed + (clock - prev.clock)
+	}
+	next := anchors[i]
+	// next.clock > prev.clock, or sort.Search would have stopped earlier.
+	return prev.elapsed + (clock-prev.clock)/(next.clock-prev.clock)*(next.elapsed-prev.elapsed)
+}
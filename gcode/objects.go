@@ -0,0 +1,587 @@
+package gcode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Object is a printed object labelled in a gcode file, in the shape
+// Klipper's exclude_object module reports it.
+type Object struct {
+	Name    string      `json:"name"`
+	Center  []float64   `json:"center,omitempty"`
+	Polygon [][]float64 `json:"polygon,omitempty"`
+}
+
+// Object label kinds. Files labelled for Klipper carry EXCLUDE_OBJECT_*
+// commands; PrusaSlicer and OrcaSlicer otherwise leave "; printing object"
+// comments. When a file has both, the commands win since their names are
+// the ones Klipper frontends know.
+const (
+	labelCommand = iota
+	labelComment
+)
+
+// objectMarker recognises an object start or end label in a trimmed line,
+// including EXCLUDE_OBJECT commands that a stage has already commented out.
+// Names are normalised the way Klipper does: upper case, no spaces. An
+// EXCLUDE_OBJECT_END without NAME returns an empty name.
+func objectMarker(trimmed string) (name string, start bool, kind int, ok bool) {
+	text := trimmed
+	commented := strings.HasPrefix(text, ";")
+	if commented {
+		text = strings.TrimSpace(strings.TrimLeft(text, ";"))
+	}
+	upper := strings.ToUpper(text)
+
+	switch {
+	case strings.HasPrefix(upper, "EXCLUDE_OBJECT_START"):
+		return commandParam(upper, "NAME"), true, labelCommand, true
+	case strings.HasPrefix(upper, "EXCLUDE_OBJECT_END"):
+		return commandParam(upper, "NAME"), false, labelCommand, true
+	case !commented:
+		return "", false, 0, false
+	case strings.HasPrefix(upper, "PRINTING OBJECT "):
+		return normalizeObjectName(text[len("printing object "):]), true, labelComment, true
+	case strings.HasPrefix(upper, "STOP PRINTING OBJECT "):
+		return normalizeObjectName(text[len("stop printing object "):]), false, labelComment, true
+	}
+	return "", false, 0, false
+}
+
+// normalizeObjectName upper-cases a label and replaces whitespace with
+// underscores so it can be used as an EXCLUDE_OBJECT NAME.
+func normalizeObjectName(s string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(s), "_"))
+}
+
+// commandParam returns the value of KEY=value in an upper-cased Klipper
+// command line, or "" if absent.
+func commandParam(upper, key string) string {
+	for _, f := range strings.Fields(upper)[1:] {
+		if k, v, ok := strings.Cut(f, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// objectTracker follows which object the lines of a file belong to.
+type objectTracker struct {
+	kind    int // label kind to follow
+	current string
+}
+
+// update applies a marker on trimmed, if any, and reports whether the line
+// was a marker of the followed kind.
+func (t *objectTracker) update(trimmed string) bool {
+	name, start, kind, ok := objectMarker(trimmed)
+	if !ok || kind != t.kind {
+		return false
+	}
+	if start {
+		t.current = name
+	} else if name == "" || name == t.current {
+		t.current = ""
+	}
+	return true
+}
+
+// objectScanner collects objects during pass 1: EXCLUDE_OBJECT_DEFINE
+// shapes, and the extent of each object's extruding moves for objects
+// defined only by labels.
+type objectScanner struct {
+	trackers [2]objectTracker
+	seen     [2][]string
+	extents  [2]map[string]*[4]float64 // min X, min Y, max X, max Y
+	defined  map[string]Object
+}
+
+func newObjectScanner() *objectScanner {
+	return &objectScanner{
+		trackers: [2]objectTracker{{kind: labelCommand}, {kind: labelComment}},
+		extents:  [2]map[string]*[4]float64{{}, {}},
+		defined:  map[string]Object{},
+	}
+}
+
+func (s *objectScanner) line(trimmed string) {
+	if strings.HasPrefix(strings.ToUpper(trimmed), "EXCLUDE_OBJECT_DEFINE") {
+		if obj, ok := parseObjectDefine(trimmed); ok {
+			s.defined[obj.Name] = obj
+			s.add(labelCommand, obj.Name)
+		}
+		return
+	}
+	for k := range s.trackers {
+		if s.trackers[k].update(trimmed) && s.trackers[k].current != "" {
+			s.add(k, s.trackers[k].current)
+		}
+	}
+}
+
+func (s *objectScanner) add(kind int, name string) {
+	if _, ok := s.extents[kind][name]; !ok {
+		s.seen[kind] = append(s.seen[kind], name)
+		s.extents[kind][name] = &[4]float64{math.MaxFloat64, math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}
+	}
+}
+
+// extrude records an extruding move ending at x, y.
+func (s *objectScanner) extrude(x, y float64) {
+	for k := range s.trackers {
+		if e := s.extents[k][s.trackers[k].current]; e != nil {
+			e[0], e[1] = math.Min(e[0], x), math.Min(e[1], y)
+			e[2], e[3] = math.Max(e[2], x), math.Max(e[3], y)
+		}
+	}
+}
+
+// finish returns the objects in the order they were first seen, and the
+// label kind stages should follow.
+func (s *objectScanner) finish() ([]Object, int) {
+	kind := labelCommand
+	if len(s.seen[labelCommand]) == 0 {
+		kind = labelComment
+	}
+	var objects []Object
+	for _, name := range s.seen[kind] {
+		if obj, ok := s.defined[name]; ok && len(obj.Polygon) > 0 {
+			objects = append(objects, obj)
+			continue
+		}
+		obj := Object{Name: name}
+		if e := s.extents[kind][name]; e[0] <= e[2] {
+			obj.Center = []float64{(e[0] + e[2]) / 2, (e[1] + e[3]) / 2}
+			obj.Polygon = [][]float64{{e[0], e[1]}, {e[2], e[1]}, {e[2], e[3]}, {e[0], e[3]}}
+		}
+		objects = append(objects, obj)
+	}
+	return objects, kind
+}
+
+// parseObjectDefine parses EXCLUDE_OBJECT_DEFINE NAME=x CENTER=x,y
+// POLYGON=[[x,y],...].
+func parseObjectDefine(line string) (Object, bool) {
+	codePart, _ := splitCode(line)
+	var obj Object
+	for _, f := range strings.Fields(codePart)[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(k) {
+		case "NAME":
+			obj.Name = strings.ToUpper(v)
+		case "CENTER":
+			var c []float64
+			for _, part := range strings.Split(v, ",") {
+				n, err := strconv.ParseFloat(part, 64)
+				if err != nil {
+					c = nil
+					break
+				}
+				c = append(c, n)
+			}
+			if len(c) == 2 {
+				obj.Center = c
+			}
+		case "POLYGON":
+			var poly [][]float64
+			if json.Unmarshal([]byte(v), &poly) == nil {
+				obj.Polygon = poly
+			}
+		}
+	}
+	return obj, obj.Name != ""
+}
+
+// ScanObjects lists the objects labelled in a gcode file, so a print can be
+// started with some of them excluded.
+func ScanObjects(srcPath string) ([]Object, error) {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, _, err := scanFile(f, nil)
+	if err != nil {
+		return nil, err
+	}
+	return meta.objects, nil
+}
+
+// CheckExcludeObjects returns an error naming the first of names that the
+// file's objects don't include.
+func CheckExcludeObjects(objects []Object, names []string) error {
+	known := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		known[o.Name] = true
+	}
+	for _, n := range names {
+		if !known[n] {
+			return fmt.Errorf("unknown object %q", n)
+		}
+	}
+	return nil
+}
+
+// Defaults for moves the bridge adds around skipped segments (mm/min).
+const (
+	resyncTravelFeedrate  = 6000
+	resyncRetractFeedrate = 2400
+	resumeZFeedrate       = 600
+)
+
+// excludeStage drops the moves of excluded objects. Everything else in
+// their segments (temperatures, fans, tool changes) still runs. Skipped
+// moves are tracked so that, when printing continues, the bridge restores
+// what the rest of the file assumes: Z and XY position, the feedrate, the E
+// position in absolute mode and the retraction state. EXCLUDE_OBJECT
+// commands are Klipper-only, so they are commented out for the printer.
+type excludeStage struct {
+	passStage
+	tracker  objectTracker
+	excluded map[string]bool
+	skipping bool
+	timer    *moveTimer
+
+	retracted    bool // the file's retraction state
+	fwRetract    bool // the file retracts with G10/G11
+	retractLen   float64
+	retractF     float64
+	entryPos     [4]float64 // printer position when skipping started
+	entryFeed    float64
+	entryRetract bool
+}
+
+func newExcludeStage(kind int, names []string) *excludeStage {
+	excluded := make(map[string]bool, len(names))
+	for _, n := range names {
+		excluded[n] = true
+	}
+	return &excludeStage{
+		passStage: passStage{"exclude_object"},
+		tracker:   objectTracker{kind: kind},
+		excluded:  excluded,
+		timer:     newMoveTimer(),
+		retractF:  resyncRetractFeedrate,
+	}
+}
+
+func (s *excludeStage) line(idx int, line string, emit emitFunc) error {
+	trimmed := strings.TrimSpace(line)
+	if s.tracker.update(trimmed) {
+		if err := s.transition(emit); err != nil {
+			return err
+		}
+	}
+	upper := strings.ToUpper(trimmed)
+	if strings.HasPrefix(upper, "EXCLUDE_OBJECT") {
+		return emit("; " + trimmed)
+	}
+
+	codePart, _ := splitCode(trimmed)
+	codeUpper := strings.ToUpper(codePart)
+	fields := strings.Fields(codeUpper)
+	prev := s.timer.pos
+	s.timer.line(codeUpper)
+	s.trackRetraction(fields, prev)
+
+	if s.skipping && len(fields) > 0 {
+		switch fields[0] {
+		case "G0", "G1", "G2", "G3", "G10", "G11", "G92":
+			return nil
+		}
+	}
+	return emit(line)
+}
+
+// trackRetraction follows the file's retraction state: an E-only move
+// backwards retracts, forwards (or any extruding move) primes.
+func (s *excludeStage) trackRetraction(fields []string, prev [4]float64) {
+	if len(fields) == 0 {
+		return
+	}
+	switch fields[0] {
+	case "G10":
+		s.retracted, s.fwRetract = true, true
+	case "G11":
+		s.retracted, s.fwRetract = false, true
+	case "G0", "G1":
+		delta := s.timer.pos[3] - prev[3]
+		if delta == 0 {
+			return
+		}
+		moved := s.timer.pos[0] != prev[0] || s.timer.pos[1] != prev[1] || s.timer.pos[2] != prev[2]
+		switch {
+		case moved:
+			s.retracted = delta < 0
+		case delta < 0:
+			s.retracted = true
+			s.retractLen = -delta
+			if f := paramFloat(fields, 'F'); !math.IsNaN(f) && f > 0 {
+				s.retractF = f
+			}
+		default:
+			s.retracted = false
+		}
+	}
+}
+
+// transition starts or stops skipping after an object marker.
+func (s *excludeStage) transition(emit emitFunc) error {
+	skip := s.excluded[s.tracker.current]
+	if skip == s.skipping {
+		return nil
+	}
+	s.skipping = skip
+	if skip {
+		s.entryPos = s.timer.pos
+		s.entryFeed = s.timer.feedrate
+		s.entryRetract = s.retracted
+		return emit(fmt.Sprintf("; excluded object %s", s.tracker.current))
+	}
+	return s.resync(emit)
+}
+
+// resync brings the printer from where skipping started to where the file
+// now expects it.
+func (s *excludeStage) resync(emit emitFunc) error {
+	pos := s.timer.pos
+	var lines []string
+	if pos[2] != s.entryPos[2] && pos[2] > s.entryPos[2] {
+		lines = append(lines, fmt.Sprintf("G0 Z%s F%d", formatCoord(pos[2]), resumeZFeedrate))
+	}
+	if pos[0] != s.entryPos[0] || pos[1] != s.entryPos[1] {
+		lines = append(lines, fmt.Sprintf("G0 X%s Y%s F%d", formatCoord(pos[0]), formatCoord(pos[1]), resyncTravelFeedrate))
+	}
+	if pos[2] != s.entryPos[2] && pos[2] < s.entryPos[2] {
+		lines = append(lines, fmt.Sprintf("G0 Z%s F%d", formatCoord(pos[2]), resumeZFeedrate))
+	}
+
+	// Retraction: the printer is in the state it was in when skipping
+	// started; the file expects s.retracted.
+	var d float64
+	switch {
+	case s.retracted == s.entryRetract:
+	case s.fwRetract && s.retracted:
+		lines = append(lines, "G10")
+	case s.fwRetract:
+		lines = append(lines, "G11")
+	case s.retracted:
+		d = -s.retractLen
+	default:
+		d = s.retractLen
+	}
+	if s.timer.relativeE {
+		if d != 0 {
+			lines = append(lines, fmt.Sprintf("G1 E%.5f F%.0f", d, s.retractF))
+		}
+	} else {
+		if d != 0 {
+			lines = append(lines,
+				fmt.Sprintf("G92 E%.5f", pos[3]-d),
+				fmt.Sprintf("G1 E%.5f F%.0f", pos[3], s.retractF))
+		} else {
+			lines = append(lines, fmt.Sprintf("G92 E%.5f", pos[3]))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("G1 F%.0f", s.timer.feedrate))
+
+	for _, l := range lines {
+		if err := emit(l + " ; resync after excluded object"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObjectFilter leaves excluded objects out of a processed file as it is sent
+// line by line, for prints the bridge streams to the printer itself. Unlike
+// Options.ExcludeObjects, objects can be excluded while the print runs.
+type ObjectFilter struct {
+	mu    sync.Mutex
+	stage *excludeStage
+}
+
+// NewObjectFilter returns a filter for the processed file idx describes,
+// with nothing excluded yet.
+func NewObjectFilter(idx *PrintIndex) *ObjectFilter {
+	return &ObjectFilter{stage: newExcludeStage(idx.ObjectKind, nil)}
+}
+
+// Exclude leaves the named object out from the next line on, including the
+// rest of it if it is being printed.
+func (f *ObjectFilter) Exclude(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.stage
+	s.excluded[name] = true
+	// Starting to skip only notes the object in a comment.
+	s.transition(func(string) error { return nil })
+}
+
+// Line passes one line of the file through the filter.
+func (f *ObjectFilter) Line(line string, emit func(string) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stage.line(0, line, emit)
+}
+
+// resumeStage cuts a file down to the part from a source byte offset on,
+// for continuing a stopped print: everything before is dropped, but the
+// state it sets up (temperatures, fans, tool, IDEX mode, position) is
+// tracked and restored by a short prologue. Z is not homed since the part
+// is still on the bed; the head lifts clear before homing X and Y.
+type resumeStage struct {
+	passStage
+	from    int64
+	offset  int64
+	resumed bool
+	timer   *moveTimer
+
+	tool     int
+	hotend   map[int]float64
+	bed      float64
+	fans     map[string]string // M106 line per P parameter
+	idexLine string
+}
+
+func newResumeStage(from int64, firstTool int) *resumeStage {
+	return &resumeStage{
+		passStage: passStage{"resume"},
+		from:      from,
+		timer:     newMoveTimer(),
+		tool:      firstTool,
+		hotend:    map[int]float64{},
+		fans:      map[string]string{},
+	}
+}
+
+func (s *resumeStage) sourceOffset(offset int64) {
+	s.offset = offset
+}
+
+func (s *resumeStage) line(idx int, line string, emit emitFunc) error {
+	if s.resumed {
+		return emit(line)
+	}
+	if s.offset < s.from {
+		s.track(line)
+		return nil
+	}
+	s.resumed = true
+	for _, l := range s.prologue() {
+		if err := emit(l); err != nil {
+			return err
+		}
+	}
+	return emit(line)
+}
+
+// track records the state a skipped line sets up.
+func (s *resumeStage) track(line string) {
+	codePart, _ := splitCode(line)
+	upper := strings.ToUpper(codePart)
+	fields := strings.Fields(upper)
+	if len(fields) == 0 {
+		return
+	}
+	s.timer.line(upper)
+
+	switch cmd := fields[0]; {
+	case len(cmd) >= 2 && cmd[0] == 'T':
+		if n, err := strconv.Atoi(cmd[1:]); err == nil {
+			s.tool = n
+		}
+	case cmd == "M104" || cmd == "M109":
+		tool := s.tool
+		if t := paramFloat(fields, 'T'); !math.IsNaN(t) {
+			tool = int(t)
+		}
+		if v := paramFloat(fields, 'S'); !math.IsNaN(v) {
+			s.hotend[tool] = v
+		}
+	case cmd == "M140" || cmd == "M190":
+		if v := paramFloat(fields, 'S'); !math.IsNaN(v) {
+			s.bed = v
+		}
+	case cmd == "M106":
+		s.fans[fanParam(fields)] = codePart
+	case cmd == "M107":
+		delete(s.fans, fanParam(fields))
+	case cmd == "M605":
+		s.idexLine = codePart
+	}
+}
+
+func fanParam(fields []string) string {
+	for _, f := range fields[1:] {
+		if len(f) >= 2 && f[0] == 'P' {
+			return f[1:]
+		}
+	}
+	return ""
+}
+
+// prologue restores the tracked state before the first kept line.
+func (s *resumeStage) prologue() []string {
+	out := []string{fmt.Sprintf("; resuming print at source byte %d", s.offset)}
+	if s.idexLine != "" {
+		out = append(out, s.idexLine)
+	}
+	tools := make([]int, 0, len(s.hotend))
+	for t := range s.hotend {
+		tools = append(tools, t)
+	}
+	sort.Ints(tools)
+	if s.bed > 0 {
+		out = append(out, fmt.Sprintf("M140 S%.0f", s.bed))
+	}
+	for _, t := range tools {
+		out = append(out, fmt.Sprintf("M104 S%.0f T%d", s.hotend[t], t))
+	}
+	if s.bed > 0 {
+		out = append(out, fmt.Sprintf("M190 S%.0f", s.bed))
+	}
+	for _, t := range tools {
+		if s.hotend[t] > 0 {
+			out = append(out, fmt.Sprintf("M109 S%.0f T%d", s.hotend[t], t))
+		}
+	}
+
+	pos := s.timer.pos
+	out = append(out,
+		fmt.Sprintf("T%d", s.tool),
+		"G91",
+		fmt.Sprintf("G0 Z2 F%d ; lift clear of the part", resumeZFeedrate),
+		"G90",
+		"G28 X Y",
+		fmt.Sprintf("G0 X%s Y%s F%d", formatCoord(pos[0]), formatCoord(pos[1]), resyncTravelFeedrate),
+		fmt.Sprintf("G0 Z%s F%d", formatCoord(pos[2]), resumeZFeedrate),
+	)
+	if s.timer.relativeE {
+		out = append(out, "M83")
+	} else {
+		out = append(out, "M82", fmt.Sprintf("G92 E%.5f", pos[3]))
+	}
+	if s.timer.relative {
+		out = append(out, "G91")
+	}
+	keys := make([]string, 0, len(s.fans))
+	for k := range s.fans {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out = append(out, s.fans[k])
+	}
+	return append(out, fmt.Sprintf("G1 F%.0f", s.timer.feedrate))
+}
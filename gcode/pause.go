@@ -0,0 +1,236 @@
+package gcode
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PauseAt schedules a pause before the given layer (1-based), before the
+// first layer at or above a Z height, or before a line (1-based) of the
+// source file. Exactly one of the fields is set.
+type PauseAt struct {
+	Layer int     `json:"layer,omitempty"`
+	Z     float64 `json:"z,omitempty"`
+	Line  int     `json:"line,omitempty"`
+}
+
+// ParsePauseAt parses "layer:5", "z:12.4" or "line:3000".
+func ParsePauseAt(spec string) (PauseAt, error) {
+	kind, val, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok {
+		kind, val, ok = strings.Cut(strings.TrimSpace(spec), "=")
+	}
+	if !ok {
+		return PauseAt{}, fmt.Errorf("pause %q: expected layer:<n>, z:<mm> or line:<n>", spec)
+	}
+	val = strings.TrimSpace(val)
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "layer":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return PauseAt{}, fmt.Errorf("pause %q: layer must be a positive number", spec)
+		}
+		return PauseAt{Layer: n}, nil
+	case "z":
+		z, err := strconv.ParseFloat(val, 64)
+		if err != nil || z <= 0 {
+			return PauseAt{}, fmt.Errorf("pause %q: z must be a positive height", spec)
+		}
+		return PauseAt{Z: z}, nil
+	case "line":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return PauseAt{}, fmt.Errorf("pause %q: line must be a positive number", spec)
+		}
+		return PauseAt{Line: n}, nil
+	}
+	return PauseAt{}, fmt.Errorf("pause %q: expected layer:<n>, z:<mm> or line:<n>", spec)
+}
+
+func (p PauseAt) String() string {
+	switch {
+	case p.Layer > 0:
+		return fmt.Sprintf("layer %d", p.Layer)
+	case p.Z > 0:
+		return fmt.Sprintf("Z %s", formatCoord(p.Z))
+	}
+	return fmt.Sprintf("line %d", p.Line)
+}
+
+// Pause is a point in a processed file where the bridge pauses the print:
+// the printer has no pause it will act on from a file, so the bridge pauses
+// it over SACP once it reports reaching Line.
+type Pause struct {
+	Line   int    `json:"line"`   // output line
+	Reason string `json:"reason"` // e.g. "layer 5" or "M600"
+	// FilamentChange is set for M600: the user is prompted to unload, load
+	// and purge filament on Tool before resuming.
+	FilamentChange bool `json:"filament_change,omitempty"`
+	Tool           int  `json:"tool,omitempty"`
+	// Extrusion mode and E position the file expects after the pause, to
+	// restore after moving filament.
+	RelativeE bool    `json:"relative_e,omitempty"`
+	E         float64 `json:"e,omitempty"`
+}
+
+// pauseDwell is how long (seconds) the printer waits at a pause point. It
+// reports its line every two seconds, so this gives the bridge time to see
+// the pause point and pause before the next move.
+const pauseDwell = 10
+
+// pauseMarker tags the first line of a pause block; indexStage records the
+// output line of each one.
+const pauseMarker = "; bridge pause: "
+
+// pauseStage inserts pause blocks before scheduled layers, heights and
+// lines, and replaces M600 filament changes with one. A block finishes the
+// queued moves and then dwells, so the head stands still at the pause point
+// while the bridge pauses the print. Layers are detected as in indexStage,
+// or follow SET_PRINT_STATS_INFO CURRENT_LAYER if the file sets it.
+type pauseStage struct {
+	passStage
+	pauses   []PauseAt
+	done     []bool
+	timer    *moveTimer
+	layerZ   float64
+	layer    int
+	explicit bool
+	tools    ToolMap
+	tool     int // physical head in use
+}
+
+func newPauseStage(pauses []PauseAt, tools ToolMap) *pauseStage {
+	return &pauseStage{
+		passStage: passStage{"pause"},
+		pauses:    pauses,
+		done:      make([]bool, len(pauses)),
+		timer:     newMoveTimer(),
+		layerZ:    -1,
+		tools:     tools,
+		tool:      tools.Tool(0),
+	}
+}
+
+func (s *pauseStage) line(idx int, line string, emit emitFunc) error {
+	codePart, _ := splitCode(line)
+	upper := strings.ToUpper(codePart)
+	fields := strings.Fields(upper)
+
+	if len(fields) > 0 && fields[0] == "M600" {
+		tool := s.tool
+		if t := paramFloat(fields, 'T'); !math.IsNaN(t) {
+			tool = s.tools.Tool(int(t))
+		}
+		return s.emitPause(emit, "M600", true, tool)
+	}
+	if len(fields) > 0 && len(fields[0]) >= 2 && fields[0][0] == 'T' {
+		if n, err := strconv.Atoi(fields[0][1:]); err == nil {
+			s.tool = n
+		}
+	}
+
+	newLayer := false
+	if strings.HasPrefix(upper, "SET_PRINT_STATS_INFO") {
+		if n, err := strconv.Atoi(commandParam(upper, "CURRENT_LAYER")); err == nil && n > s.layer {
+			s.explicit = true
+			s.layer = n
+			s.layerZ = s.timer.pos[2]
+			newLayer = true
+		}
+	}
+	prevE := s.timer.pos[3]
+	s.timer.line(upper)
+	if !s.explicit && startsLayer(upper, s.timer, prevE, s.layerZ) {
+		s.layer++
+		s.layerZ = s.timer.pos[2]
+		newLayer = true
+	}
+
+	// Pauses that fall on the same line share one block.
+	var reasons []string
+	for i, p := range s.pauses {
+		if s.done[i] {
+			continue
+		}
+		due := p.Line == idx+1
+		if newLayer {
+			due = due || p.Layer == s.layer || (p.Z > 0 && s.layerZ >= p.Z-layerEpsilon)
+		}
+		if due {
+			s.done[i] = true
+			reasons = append(reasons, p.String())
+		}
+	}
+	if len(reasons) > 0 {
+		if err := s.emitPause(emit, strings.Join(reasons, ", "), false, s.tool); err != nil {
+			return err
+		}
+	}
+	return emit(line)
+}
+
+func (s *pauseStage) emitPause(emit emitFunc, reason string, filamentChange bool, tool int) error {
+	kind := "pause"
+	if filamentChange {
+		kind = fmt.Sprintf("filament change T%d", tool)
+	}
+	if err := emit(fmt.Sprintf("M400 %s%s at %s", pauseMarker, kind, reason)); err != nil {
+		return err
+	}
+	return emit(fmt.Sprintf("G4 S%d ; waiting for the bridge to pause", pauseDwell))
+}
+
+// parsePauseMarker reads a pause block's first line.
+func parsePauseMarker(line string) (Pause, bool) {
+	i := strings.Index(line, pauseMarker)
+	if i < 0 {
+		return Pause{}, false
+	}
+	text := line[i+len(pauseMarker):]
+	kind, reason, ok := strings.Cut(text, " at ")
+	if !ok {
+		return Pause{}, false
+	}
+	p := Pause{Reason: reason}
+	if t, ok := strings.CutPrefix(kind, "filament change T"); ok {
+		p.FilamentChange = true
+		p.Tool, _ = strconv.Atoi(t)
+	}
+	return p, true
+}
+
+// PauseLine returns the output line at which a pause scheduled during the
+// print should happen, or 0 if the index can't place it. Source lines are
+// interpolated between the byte offset samples, so line pauses are
+// approximate.
+func (x *PrintIndex) PauseLine(p PauseAt) int {
+	switch {
+	case p.Layer > 0:
+		if p.Layer <= len(x.LayerStarts) {
+			return x.LayerStarts[p.Layer-1]
+		}
+	case p.Z > 0:
+		for i, z := range x.LayerZ {
+			if z >= p.Z-layerEpsilon {
+				return x.LayerStarts[i]
+			}
+		}
+	case p.Line > 0:
+		i := sort.SearchInts(x.SourceLines, p.Line)
+		if i == len(x.SourceLines) {
+			return 0
+		}
+		prevSrc, prevOut := 0, 0
+		if i > 0 {
+			prevSrc, prevOut = x.SourceLines[i-1], x.OffsetLines[i-1]
+		}
+		if x.SourceLines[i] == prevSrc {
+			return x.OffsetLines[i]
+		}
+		return prevOut + (p.Line-prevSrc)*(x.OffsetLines[i]-prevOut)/(x.SourceLines[i]-prevSrc)
+	}
+	return 0
+}
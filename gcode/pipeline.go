@@ -0,0 +1,552 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Stage types accepted in StageConfig.Type.
+const (
+	StageReplace             = "replace"
+	StageInject              = "inject"
+	StageClampTemperature    = "clamp_temperature"
+	StageOverrideTemperature = "override_temperature"
+	StageStrip               = "strip"
+	StageProgress            = "progress"
+)
+
+// StageConfig defines a named transform stage from the config file. Only the
+// fields relevant to Type are used.
+type StageConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Default stages run on every print that doesn't select stages by name.
+	Default bool `yaml:"default"`
+
+	// replace: Go regexp applied to each whole line; the replacement may use
+	// $1-style group references and may contain "\n" to emit several lines.
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+
+	// inject: lines written before the first and after the last body line.
+	Start []string `yaml:"start"`
+	End   []string `yaml:"end"`
+
+	// clamp_temperature / override_temperature: "extruder" (default) or "bed".
+	// Clamping keeps non-zero targets within [Min, Max] (0 = no limit);
+	// override replaces every non-zero target with Temperature.
+	Heater      string  `yaml:"heater"`
+	Min         float64 `yaml:"min"`
+	Max         float64 `yaml:"max"`
+	Temperature float64 `yaml:"temperature"`
+
+	// strip: command words (e.g. "M900") to comment out.
+	Commands []string `yaml:"commands"`
+}
+
+// CheckStages validates a list of stage definitions: names must be present
+// and unique, types known, and type-specific settings well formed.
+func CheckStages(cfgs []StageConfig) error {
+	seen := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return fmt.Errorf("transform stage of type %q has no name", cfg.Type)
+		}
+		if seen[cfg.Name] {
+			return fmt.Errorf("duplicate transform stage name %q", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if _, err := newStage(cfg, &metadata{}, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectStages picks the stages to run for one print. A nil names list
+// selects the stages marked Default; otherwise exactly the named stages run.
+// Either way they run in config order, so the pipeline order is defined in
+// one place.
+func SelectStages(cfgs []StageConfig, names []string) ([]StageConfig, error) {
+	if names == nil {
+		var out []StageConfig
+		for _, cfg := range cfgs {
+			if cfg.Default {
+				out = append(out, cfg)
+			}
+		}
+		return out, nil
+	}
+
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+	var out []StageConfig
+	for _, cfg := range cfgs {
+		if want[cfg.Name] {
+			out = append(out, cfg)
+			delete(want, cfg.Name)
+		}
+	}
+	for n := range want {
+		return nil, fmt.Errorf("unknown transform stage %q", n)
+	}
+	return out, nil
+}
+
+// emitFunc passes a line to the next stage of the pipeline (or the output).
+type emitFunc func(line string) error
+
+// stage is one step of the pass-2 pipeline. Each source line flows through
+// the stages in order; a stage may pass it on, rewrite it, drop it, or emit
+// extra lines around it. idx is the 0-based source line index the line
+// originated from, which is what the pass-1 line numbers refer to.
+type stage interface {
+	name() string
+	begin(emit emitFunc) error
+	line(idx int, line string, emit emitFunc) error
+	end(emit emitFunc) error
+}
+
+// metaAdjuster is implemented by stages whose rewrites change values that
+// appear in the header, so the header matches the transformed body.
+type metaAdjuster interface {
+	adjustMeta(meta *metadata)
+}
+
+// offsetObserver is implemented by stages that need to know where in the
+// source file they are: runPipeline reports the byte offset of each source
+// line before passing it down, and the source size before end runs.
+type offsetObserver interface {
+	sourceOffset(offset int64)
+}
+
+// passStage provides no-op begin/end for stages that only rewrite lines.
+type passStage struct{ stageName string }
+
+func (p passStage) name() string              { return p.stageName }
+func (p passStage) begin(emit emitFunc) error { return nil }
+func (p passStage) end(emit emitFunc) error   { return nil }
+
+// buildStages assembles the pipeline for one pass: the built-in tool remap,
+// nozzle shutoff, standby temperatures, IDEX conversion, object exclusion and
+// pauses, followed by the user-configured stages and, when resuming, the cut
+// to the resume point (last, so it drops whatever the earlier stages add up
+// front).
+// Stages carry per-pass state, so every pass needs a fresh set.
+func buildStages(meta *metadata, srcLines int, opts Options) ([]stage, error) {
+	var stages []stage
+	if meta.maxToolNum > 1 || !opts.ToolMap.IsDefault() {
+		stages = append(stages, &toolRemapStage{passStage: passStage{"tool_remap"}, tools: opts.ToolMap})
+	}
+	stages = append(stages, &nozzleShutoffStage{
+		passStage:    passStage{"nozzle_shutoff"},
+		lastToolLine: meta.lastToolLine,
+		currentTool:  opts.ToolMap.Tool(0),
+	})
+	if opts.Standby.Temperature > 0 && len(meta.toolChanges) > 1 {
+		stages = append(stages, newStandbyStage(meta, opts))
+	}
+	if meta.idexConvert {
+		stages = append(stages, newIDEXConvertStage(meta, opts.Model))
+	}
+	if len(meta.objects) > 0 {
+		stages = append(stages, newExcludeStage(meta.objectKind, opts.ExcludeObjects))
+	}
+	if len(opts.Pauses) > 0 || meta.filamentChanges > 0 {
+		stages = append(stages, newPauseStage(opts.Pauses, opts.ToolMap))
+	}
+
+	for _, cfg := range opts.Stages {
+		st, err := newStage(cfg, meta, srcLines)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, st)
+	}
+	if opts.ResumeOffset > 0 {
+		stages = append(stages, newResumeStage(opts.ResumeOffset, opts.ToolMap.Tool(0)))
+	}
+	return stages, nil
+}
+
+// newStage builds a user-configured stage.
+func newStage(cfg StageConfig, meta *metadata, srcLines int) (stage, error) {
+	base := passStage{cfg.Name}
+	switch cfg.Type {
+	case StageReplace:
+		if cfg.Pattern == "" {
+			return nil, fmt.Errorf("transform %q: pattern is required", cfg.Name)
+		}
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("transform %q: %w", cfg.Name, err)
+		}
+		return &replaceStage{passStage: base, re: re, replacement: cfg.Replacement}, nil
+
+	case StageInject:
+		return &injectStage{passStage: base, start: cfg.Start, finish: cfg.End}, nil
+
+	case StageClampTemperature, StageOverrideTemperature:
+		bed := false
+		switch strings.ToLower(cfg.Heater) {
+		case "", "extruder":
+		case "bed", "heater_bed":
+			bed = true
+		default:
+			return nil, fmt.Errorf("transform %q: unknown heater %q", cfg.Name, cfg.Heater)
+		}
+		st := &temperatureStage{passStage: base, bed: bed}
+		if cfg.Type == StageOverrideTemperature {
+			if cfg.Temperature <= 0 {
+				return nil, fmt.Errorf("transform %q: temperature must be positive", cfg.Name)
+			}
+			st.min, st.max = cfg.Temperature, cfg.Temperature
+		} else {
+			if cfg.Min < 0 || cfg.Max < 0 || (cfg.Max > 0 && cfg.Min > cfg.Max) {
+				return nil, fmt.Errorf("transform %q: invalid min/max", cfg.Name)
+			}
+			st.min, st.max = cfg.Min, cfg.Max
+		}
+		return st, nil
+
+	case StageStrip:
+		if len(cfg.Commands) == 0 {
+			return nil, fmt.Errorf("transform %q: commands is required", cfg.Name)
+		}
+		cmds := make(map[string]bool, len(cfg.Commands))
+		for _, c := range cfg.Commands {
+			cmds[strings.ToUpper(strings.TrimSpace(c))] = true
+		}
+		return &stripStage{passStage: base, commands: cmds}, nil
+
+	case StageProgress:
+		return &progressStage{passStage: base, srcLines: srcLines, estimatedTime: meta.estimatedTime, last: -1}, nil
+	}
+	return nil, fmt.Errorf("transform %q: unknown type %q", cfg.Name, cfg.Type)
+}
+
+// runPipeline streams src through the stages into sink.
+func runPipeline(src io.Reader, stages []stage, sink emitFunc) error {
+	idx := 0
+	emits := make([]emitFunc, len(stages)+1)
+	emits[len(stages)] = sink
+	for k := len(stages) - 1; k >= 0; k-- {
+		st, next := stages[k], emits[k+1]
+		emits[k] = func(s string) error { return st.line(idx, s, next) }
+	}
+
+	for k, st := range stages {
+		if err := st.begin(emits[k+1]); err != nil {
+			return fmt.Errorf("%s: %w", st.name(), err)
+		}
+	}
+
+	var observers []offsetObserver
+	for _, st := range stages {
+		if o, ok := st.(offsetObserver); ok {
+			observers = append(observers, o)
+		}
+	}
+
+	// Track the byte offset of each source line; the split function sees
+	// the real line endings, which Text() strips.
+	var lineStart, consumed int64
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), scanBufMax)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineStart = consumed
+		}
+		consumed += int64(advance)
+		return advance, token, err
+	})
+	for ; scanner.Scan(); idx++ {
+		for _, o := range observers {
+			o.sourceOffset(lineStart)
+		}
+		if err := emits[0](scanner.Text()); err != nil {
+			return err
+		}
+	}
+	for _, o := range observers {
+		o.sourceOffset(consumed)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for k, st := range stages {
+		if err := st.end(emits[k+1]); err != nil {
+			return fmt.Errorf("%s: %w", st.name(), err)
+		}
+	}
+	return nil
+}
+
+// splitCode separates a trimmed gcode line into its code and comment parts.
+func splitCode(line string) (codePart, commentPart string) {
+	trimmed := strings.TrimSpace(line)
+	if idx := strings.IndexByte(trimmed, ';'); idx >= 0 {
+		return strings.TrimSpace(trimmed[:idx]), trimmed[idx:]
+	}
+	return trimmed, ""
+}
+
+// toolRemapStage maps the file's tools onto the physical heads (by default
+// folding T2+ onto T0/T1) on tool changes and on the T/P parameters of
+// temperature and fan commands.
+type toolRemapStage struct {
+	passStage
+	tools ToolMap
+}
+
+// begin selects the head T0 maps to, since a file that never issues a tool
+// change prints with whichever head is active.
+func (s *toolRemapStage) begin(emit emitFunc) error {
+	if t := s.tools.Tool(0); t != 0 {
+		return emit(fmt.Sprintf("T%d ; tool map %s", t, s.tools))
+	}
+	return nil
+}
+
+func (s *toolRemapStage) line(idx int, line string, emit emitFunc) error {
+	codePart, commentPart := splitCode(line)
+	if codePart == "" {
+		return emit(line)
+	}
+	upper := strings.ToUpper(codePart)
+
+	if len(upper) >= 2 && upper[0] == 'T' {
+		if n, err := strconv.Atoi(upper[1:]); err == nil && s.tools.Tool(n) != n {
+			out := fmt.Sprintf("T%d", s.tools.Tool(n))
+			if commentPart != "" {
+				out += " " + commentPart
+			}
+			return emit(out)
+		}
+		return emit(line)
+	}
+
+	if strings.HasPrefix(upper, "M104 ") || strings.HasPrefix(upper, "M109 ") {
+		return emit(remapParam(line, codePart, commentPart, 'T', s.tools))
+	}
+	if strings.HasPrefix(upper, "M106 ") || strings.HasPrefix(upper, "M107 ") {
+		return emit(remapParam(line, codePart, commentPart, 'P', s.tools))
+	}
+	return emit(line)
+}
+
+// nozzleShutoffStage turns off a nozzle's heater at the tool change after
+// which it is never used again, using the pass-1 lastToolLine indices.
+type nozzleShutoffStage struct {
+	passStage
+	lastToolLine [2]int
+	currentTool  int
+}
+
+func (s *nozzleShutoffStage) line(idx int, line string, emit emitFunc) error {
+	codePart, _ := splitCode(line)
+	upper := strings.ToUpper(codePart)
+	if len(upper) < 2 || upper[0] != 'T' {
+		return emit(line)
+	}
+	n, err := strconv.Atoi(upper[1:])
+	if err != nil {
+		return emit(line)
+	}
+
+	prevTool := s.currentTool % 2
+	s.currentTool = n
+	newTool := n % 2
+	if err := emit(line); err != nil {
+		return err
+	}
+
+	// Unused nozzle shutoff: if the previous tool won't be used again after
+	// this point, turn off its heater.
+	if prevTool != newTool && s.lastToolLine[prevTool] >= 0 && s.lastToolLine[prevTool] <= idx {
+		return emit(fmt.Sprintf("M104 S0 T%d ; shutoff unused nozzle", prevTool))
+	}
+	return nil
+}
+
+// replaceStage applies a regexp search/replace to every line.
+type replaceStage struct {
+	passStage
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (s *replaceStage) line(idx int, line string, emit emitFunc) error {
+	out := s.re.ReplaceAllString(line, s.replacement)
+	if out == line {
+		return emit(line)
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if err := emit(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// injectStage writes fixed blocks at the start and end of the body.
+type injectStage struct {
+	passStage
+	start, finish []string
+}
+
+func (s *injectStage) begin(emit emitFunc) error {
+	for _, l := range s.start {
+		if err := emit(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *injectStage) line(idx int, line string, emit emitFunc) error {
+	return emit(line)
+}
+
+func (s *injectStage) end(emit emitFunc) error {
+	for _, l := range s.finish {
+		if err := emit(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// temperatureStage clamps (min < max) or overrides (min == max) the non-zero
+// targets of extruder or bed temperature commands. Zero targets are heater
+// shutoffs and are left alone.
+type temperatureStage struct {
+	passStage
+	bed      bool
+	min, max float64
+}
+
+func (s *temperatureStage) apply(v float64) float64 {
+	if v <= 0 {
+		return v
+	}
+	if s.min > 0 && v < s.min {
+		v = s.min
+	}
+	if s.max > 0 && v > s.max {
+		v = s.max
+	}
+	return v
+}
+
+func (s *temperatureStage) line(idx int, line string, emit emitFunc) error {
+	codePart, commentPart := splitCode(line)
+	fields := strings.Fields(codePart)
+	if len(fields) < 2 {
+		return emit(line)
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "M104", "M109":
+		if s.bed {
+			return emit(line)
+		}
+	case "M140", "M190":
+		if !s.bed {
+			return emit(line)
+		}
+	default:
+		return emit(line)
+	}
+
+	changed := false
+	for i, f := range fields[1:] {
+		if len(f) < 2 || (f[0] != 'S' && f[0] != 's' && f[0] != 'R' && f[0] != 'r') {
+			continue
+		}
+		v, err := strconv.ParseFloat(f[1:], 64)
+		if err != nil {
+			continue
+		}
+		if nv := s.apply(v); nv != v {
+			fields[i+1] = f[:1] + strconv.FormatFloat(nv, 'f', -1, 64)
+			changed = true
+		}
+	}
+	if !changed {
+		return emit(line)
+	}
+	out := strings.Join(fields, " ")
+	if commentPart != "" {
+		out += " " + commentPart
+	}
+	return emit(out)
+}
+
+func (s *temperatureStage) adjustMeta(meta *metadata) {
+	if s.bed {
+		meta.bedTemp = s.apply(meta.bedTemp)
+		return
+	}
+	for i := range meta.nozzleTemp {
+		meta.nozzleTemp[i] = s.apply(meta.nozzleTemp[i])
+	}
+}
+
+// stripStage comments out commands the firmware doesn't accept. The line is
+// kept as a comment so the output still shows what the slicer asked for.
+type stripStage struct {
+	passStage
+	commands map[string]bool
+}
+
+func (s *stripStage) line(idx int, line string, emit emitFunc) error {
+	codePart, _ := splitCode(line)
+	fields := strings.Fields(codePart)
+	if len(fields) == 0 || !s.commands[strings.ToUpper(fields[0])] {
+		return emit(line)
+	}
+	return emit("; stripped: " + strings.TrimSpace(line))
+}
+
+// progressStage inserts M73 progress lines whenever the integer percentage
+// of source lines processed changes, with remaining minutes derived from the
+// slicer's time estimate when one is available.
+type progressStage struct {
+	passStage
+	srcLines      int
+	estimatedTime float64
+	last          int
+}
+
+func (s *progressStage) m73(pct int) string {
+	if s.estimatedTime <= 0 {
+		return fmt.Sprintf("M73 P%d", pct)
+	}
+	remaining := math.Ceil(s.estimatedTime * float64(100-pct) / 100 / 60)
+	return fmt.Sprintf("M73 P%d R%.0f", pct, remaining)
+}
+
+func (s *progressStage) line(idx int, line string, emit emitFunc) error {
+	if s.srcLines > 0 {
+		if pct := idx * 100 / s.srcLines; pct != s.last {
+			s.last = pct
+			if err := emit(s.m73(pct)); err != nil {
+				return err
+			}
+		}
+	}
+	return emit(line)
+}
+
+func (s *progressStage) end(emit emitFunc) error {
+	return emit(s.m73(100))
+}
@@ -3,6 +3,7 @@ package gcode
 import (
 	"bufio"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math"
@@ -31,17 +32,39 @@ type metadata struct {
 	retraction       [2]float64
 	switchRetraction [2]float64
 	maxToolNum       int
-	lastToolLine     [2]int // last source line index where each (remapped) tool is active
-	thumbnail        string // data URI (data:image/png;base64,...) extracted from slicer thumbnails
-	idexMode         string // IDEX mode detected from M605: "Default", "Duplication", "Mirror"
+	lastToolLine     [2]int  // last source line index where each (remapped) tool is active
+	thumbnail        string  // data URI (data:image/png;base64,...) extracted from slicer thumbnails
+	idexMode         string  // IDEX mode detected from M605: "Default", "Duplication", "Mirror"
+	homeLine         int     // last G28 before the first extrusion, -1 if none
+	partMinX         float64 // X extent of the printed part: slicer print bounds
+	partMaxX         float64 // if present, else the extent of extruding moves
+	partBoundsSet    bool    // partMinX/partMaxX came from slicer comments
+	idexConvert      bool    // rewrite a single-tool file into idexMode (see idex.go)
+	shiftX           float64 // X offset applied by the conversion
+	halfWidth        float64 // usable X width in the converted mode
+	toolChanges      []toolChange
+	moveTime         float64         // kinematic estimate of the whole file, seconds
+	remaining        map[int]float64 // slicer M73 R markers: source line -> seconds left
+	percent          map[int]float64 // slicer M73 P markers: source line -> percent done
+	objects          []Object        // labelled objects, see objects.go
+	objectKind       int             // label kind the objects came from
+	filamentChanges  int             // M600 commands
 }
 
-// toolChangeEvent records a tool change at a specific source line so the
-// shutoff-insertion count can be computed after lastToolLine is finalized.
-type toolChangeEvent struct {
-	lineIdx int
-	prev    int
-	new     int
+// toolChange records a switch of the active physical head during pass 1.
+type toolChange struct {
+	line int     // source line index of the T command
+	tool int     // physical head selected
+	time float64 // moveTimer clock at the change, seconds
+}
+
+// timeScale converts moveTimer seconds into the slicer's estimate, which
+// accounts for acceleration; 1 when the file carries no estimate.
+func (m *metadata) timeScale() float64 {
+	if m.estimatedTime > 0 && m.moveTime > 0 {
+		return m.estimatedTime / m.moveTime
+	}
+	return 1
 }
 
 // scanBufMax bounds the size of any single gcode line. Default bufio.Scanner
@@ -49,15 +72,48 @@ type toolChangeEvent struct {
 // occasionally emit very long inline comments.
 const scanBufMax = 1 << 20 // 1 MB
 
+// Options controls how ProcessFile transforms a file for the printer.
+type Options struct {
+	// Model is the printer model; it selects the V0 or V1 header.
+	Model string
+	// Stages are user-configured transform stages, run in order after the
+	// built-in stages (see buildStages).
+	Stages []StageConfig
+	// Standby lowers idle nozzles between tool changes; zero disables it.
+	Standby StandbyConfig
+	// IDEXMode, when IDEXModeDuplication or IDEXModeMirror, converts a
+	// single-tool file into that mode so both heads print a copy.
+	IDEXMode string
+	// ToolMap assigns the file's tools to physical heads; nil folds T2+
+	// onto T0/T1 by parity.
+	ToolMap ToolMap
+	// IndexPath, if set, is where ProcessFile saves the PrintIndex of its
+	// output (see IndexPath).
+	IndexPath string
+	// ExcludeObjects names labelled objects (see Object) whose moves are
+	// left out of the print.
+	ExcludeObjects []string
+	// ResumeOffset, if positive, starts the print at this source byte
+	// offset, restoring temperatures and position first (see resumeStage).
+	ResumeOffset int64
+	// Pauses schedules pauses by layer, height or source line. M600 in the
+	// file always pauses (see pauseStage).
+	Pauses []PauseAt
+	// Hash, if set, is fed the output as it is written, so the upload
+	// checksum needs no second read of the file.
+	Hash hash.Hash
+}
+
 // ProcessFile reads gcode from srcPath, writes a Snapmaker-compatible processed
 // version to dstPath, and returns the total number of lines in the output
-// (header + body). It runs in two streaming passes over the source file with
+// (header + body). It runs in three streaming passes over the source file with
 // a memory footprint independent of file size — typically a few MB regardless
-// of how large the input gcode is.
+// of how large the input gcode is: a metadata scan, a dry run of the transform
+// pipeline to count body lines for the header, and the real transform.
 //
 // If the source already contains a ";Header Start" marker near the top, it is
 // copied through unchanged for idempotency.
-func ProcessFile(srcPath, dstPath, printerModel string) (uint32, error) {
+func ProcessFile(srcPath, dstPath string, opts Options) (uint32, error) {
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return 0, fmt.Errorf("opening source gcode: %w", err)
@@ -73,18 +129,13 @@ func ProcessFile(srcPath, dstPath, printerModel string) (uint32, error) {
 	}
 	if alreadyProcessed {
 		log.Printf("gcode: header already present, skipping processing")
-		return copyThrough(src, dstPath)
+		return copyThrough(src, dstPath, opts.Hash)
 	}
 
-	// Pass 1: scan metadata, extract thumbnail, count source lines, record tool
-	// changes for the shutoff line-count calculation.
-	meta, srcLines, toolChanges, err := scanFile(src)
+	meta, srcLines, bodyLines, err := planFile(src, opts)
 	if err != nil {
-		return 0, fmt.Errorf("scanning gcode: %w", err)
+		return 0, err
 	}
-	finalizeMetadata(meta)
-
-	bodyLines := srcLines + countShutoffs(toolChanges, meta)
 
 	idexLabel := "Default"
 	if meta.idexMode != "" {
@@ -98,7 +149,7 @@ func ProcessFile(srcPath, dstPath, printerModel string) (uint32, error) {
 		log.Printf("gcode: extracted thumbnail (%d bytes)", len(meta.thumbnail))
 	}
 
-	// Pass 2: write header, then stream-transform the body into the output.
+	// Pass 3: write header, then stream-transform the body into the output.
 	if _, err := src.Seek(0, io.SeekStart); err != nil {
 		return 0, err
 	}
@@ -114,15 +165,37 @@ func ProcessFile(srcPath, dstPath, printerModel string) (uint32, error) {
 		}
 	}()
 
-	bw := bufio.NewWriterSize(dst, 256*1024)
+	var out io.Writer = dst
+	if opts.Hash != nil {
+		out = io.MultiWriter(dst, opts.Hash)
+	}
+	bw := bufio.NewWriterSize(out, 256*1024)
 
-	header := buildHeader(meta, printerModel, bodyLines)
+	header := buildHeader(meta, opts.Model, bodyLines)
 	if _, err := bw.WriteString(header); err != nil {
 		return 0, err
 	}
 	headerLines := strings.Count(header, "\n")
 
-	if err := transformFile(src, bw, meta); err != nil {
+	stages, err := buildStages(meta, srcLines, opts)
+	if err != nil {
+		return 0, err
+	}
+	index := newIndexStage(headerLines, meta, opts)
+	stages = append(stages, index)
+	names := make([]string, len(stages))
+	for i, st := range stages {
+		names[i] = st.name()
+	}
+	log.Printf("gcode: pipeline %s", strings.Join(names, " → "))
+
+	err = runPipeline(src, stages, func(line string) error {
+		if _, err := bw.WriteString(line); err != nil {
+			return err
+		}
+		return bw.WriteByte('\n')
+	})
+	if err != nil {
 		return 0, fmt.Errorf("transforming gcode: %w", err)
 	}
 
@@ -134,19 +207,25 @@ func ProcessFile(srcPath, dstPath, printerModel string) (uint32, error) {
 	}
 	closeOK = true
 
-	log.Printf("gcode: %s header prepended (%d bytes), output %d body lines",
-		headerVersion(printerModel), len(header), bodyLines)
+	log.Printf("gcode: %s header prepended (%d bytes), output %d body lines, %d layers",
+		headerVersion(opts.Model), len(header), bodyLines, index.index.TotalLayers)
+
+	if opts.IndexPath != "" {
+		if err := index.index.Save(opts.IndexPath); err != nil {
+			log.Printf("gcode: saving print index: %v", err)
+		}
+	}
 
 	return uint32(headerLines + bodyLines), nil
 }
 
 // CountProcessedLines returns the line count that ProcessFile would write for
-// srcPath, by running pass 1 (metadata scan) only — no output is written. Use
-// this when the bridge needs to recover the post-processing line count for a
+// srcPath with the same options, without writing any output. Use this when
+// the bridge needs to recover the post-processing line count for a
 // touchscreen-initiated print after a restart, where the file on disk is the
 // raw source and a naive newline count would miss the V0/V1 header and the
-// nozzle-shutoff lines that pass 2 inserts.
-func CountProcessedLines(srcPath, printerModel string) (uint32, error) {
+// lines the transform pipeline inserts.
+func CountProcessedLines(srcPath string, opts Options) (uint32, error) {
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return 0, fmt.Errorf("opening source gcode: %w", err)
@@ -164,18 +243,59 @@ func CountProcessedLines(srcPath, printerModel string) (uint32, error) {
 		return countNewlines(src)
 	}
 
-	meta, srcLines, toolChanges, err := scanFile(src)
+	meta, _, bodyLines, err := planFile(src, opts)
 	if err != nil {
-		return 0, fmt.Errorf("scanning gcode: %w", err)
+		return 0, err
 	}
-	finalizeMetadata(meta)
-
-	bodyLines := srcLines + countShutoffs(toolChanges, meta)
-	header := buildHeader(meta, printerModel, bodyLines)
+	header := buildHeader(meta, opts.Model, bodyLines)
 	headerLines := strings.Count(header, "\n")
 	return uint32(headerLines + bodyLines), nil
 }
 
+// planFile runs pass 1 (metadata scan) and pass 2 (a dry run of the transform
+// pipeline that only counts the lines it would write). Counting by running
+// the real stages keeps the header's line total exact whatever the stages
+// insert or drop. The returned metadata already reflects stage adjustments.
+func planFile(src io.ReadSeeker, opts Options) (*metadata, int, int, error) {
+	meta, srcLines, err := scanFile(src, opts.ToolMap)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("scanning gcode: %w", err)
+	}
+	applyToolMap(meta, opts.ToolMap)
+	if err := CheckExcludeObjects(meta.objects, opts.ExcludeObjects); err != nil {
+		return nil, 0, 0, err
+	}
+	if opts.IDEXMode != "" {
+		if err := planIDEXConversion(meta, opts); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	finalizeMetadata(meta)
+
+	stages, err := buildStages(meta, srcLines, opts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for _, st := range stages {
+		if a, ok := st.(metaAdjuster); ok {
+			a.adjustMeta(meta)
+		}
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, 0, err
+	}
+	bodyLines := 0
+	err = runPipeline(src, stages, func(string) error {
+		bodyLines++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("counting transformed lines: %w", err)
+	}
+	return meta, srcLines, bodyLines, nil
+}
+
 func countNewlines(r io.Reader) (uint32, error) {
 	buf := make([]byte, 64*1024)
 	var count uint32
@@ -213,14 +333,18 @@ func peekAlreadyProcessed(src io.Reader) (bool, error) {
 }
 
 // copyThrough streams src to dstPath and returns the number of newlines copied.
-func copyThrough(src io.Reader, dstPath string) (uint32, error) {
+func copyThrough(src io.Reader, dstPath string, h hash.Hash) (uint32, error) {
 	dst, err := os.Create(dstPath)
 	if err != nil {
 		return 0, err
 	}
 	defer dst.Close()
 
-	bw := bufio.NewWriterSize(dst, 256*1024)
+	var out io.Writer = dst
+	if h != nil {
+		out = io.MultiWriter(dst, h)
+	}
+	bw := bufio.NewWriterSize(out, 256*1024)
 	cw := &lineCountingWriter{w: bw}
 	if _, err := io.Copy(cw, src); err != nil {
 		return 0, err
@@ -246,20 +370,6 @@ func (c *lineCountingWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-// countShutoffs returns the number of nozzle-shutoff lines that will be inserted
-// during pass 2, given the finalized lastToolLine values from pass 1.
-func countShutoffs(events []toolChangeEvent, meta *metadata) int {
-	count := 0
-	for _, tc := range events {
-		prevR := tc.prev % 2
-		newR := tc.new % 2
-		if prevR != newR && meta.lastToolLine[prevR] >= 0 && meta.lastToolLine[prevR] <= tc.lineIdx {
-			count++
-		}
-	}
-	return count
-}
-
 // finalizeMetadata applies the post-scan defaults, tool usage inference from
 // filament extrusion, and IDEX Copy/Mirror compensation that buildHeader needs.
 func finalizeMetadata(meta *metadata) {
@@ -296,9 +406,9 @@ func finalizeMetadata(meta *metadata) {
 }
 
 // scanFile is pass 1: streams over src line-by-line, gathering metadata,
-// extracting the slicer thumbnail (if any), counting source lines, and
-// recording tool change events.
-func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
+// extracting the slicer thumbnail (if any), and counting source lines.
+// Per-tool values are recorded against the physical head tools maps to.
+func scanFile(src io.Reader, tools ToolMap) (*metadata, int, error) {
 	meta := &metadata{
 		minX:             math.MaxFloat64,
 		minY:             math.MaxFloat64,
@@ -311,15 +421,21 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 		retraction:       [2]float64{0.8, 0.8},
 		switchRetraction: [2]float64{0, 0},
 		lastToolLine:     [2]int{-1, -1},
+		homeLine:         -1,
+		partMinX:         math.MaxFloat64,
+		partMaxX:         -math.MaxFloat64,
 	}
 
 	currentTool := 0
+	activeTool := tools.Tool(0)
+	timer := newMoveTimer()
 	relative := false
 	var lastAbsE [2]float64
 	var prevZ float64
 	zMoves := 0
-
-	var toolChanges []toolChangeEvent
+	extruded := false
+	var lastX, lastY float64
+	objects := newObjectScanner()
 
 	// Thumbnail extraction state: we keep the last completed thumbnail block,
 	// matching the original behaviour (slicers emit small + large variants;
@@ -361,6 +477,8 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 			continue
 		}
 
+		objects.line(trimmed)
+
 		// Pure comment line.
 		if strings.HasPrefix(trimmed, ";") {
 			scanComment(trimmed, meta)
@@ -378,22 +496,32 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 		}
 
 		upper := strings.ToUpper(codePart)
+		elapsed := timer.line(upper)
 
 		// Tool change (T0, T1, T2, ...).
 		if len(upper) >= 2 && upper[0] == 'T' {
 			if n, err := strconv.Atoi(upper[1:]); err == nil {
-				toolChanges = append(toolChanges, toolChangeEvent{lineIdx: i, prev: currentTool, new: n})
 				currentTool = n
 				if n > meta.maxToolNum {
 					meta.maxToolNum = n
 				}
-				remapped := n % 2
+				remapped := tools.Tool(n)
 				meta.toolsUsed[remapped] = true
 				meta.lastToolLine[remapped] = i
+				if remapped != activeTool {
+					meta.toolChanges = append(meta.toolChanges, toolChange{line: i, tool: remapped, time: elapsed})
+					activeTool = remapped
+				}
 				continue
 			}
 		}
 
+		// Homing: remember the last one before printing starts, which is
+		// where IDEX conversion activates the copy/mirror mode.
+		if !extruded && (upper == "G28" || strings.HasPrefix(upper, "G28 ")) {
+			meta.homeLine = i
+		}
+
 		// Extrusion mode.
 		switch upper {
 		case "M82":
@@ -406,7 +534,7 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 
 		// G92 — position reset (track E axis for absolute extrusion).
 		if strings.HasPrefix(upper, "G92") {
-			remapped := currentTool % 2
+			remapped := tools.Tool(currentTool)
 			for _, f := range strings.Fields(codePart) {
 				if len(f) >= 2 && (f[0] == 'E' || f[0] == 'e') {
 					if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
@@ -432,16 +560,38 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 			}
 		}
 
+		if upper == "M600" || strings.HasPrefix(upper, "M600 ") {
+			meta.filamentChanges++
+		}
+
+		// Slicer progress markers: M73 P<percent> R<minutes left>.
+		if strings.HasPrefix(upper, "M73 ") {
+			fields := strings.Fields(upper)
+			if r := paramFloat(fields, 'R'); !math.IsNaN(r) {
+				if meta.remaining == nil {
+					meta.remaining = make(map[int]float64)
+				}
+				meta.remaining[i] = r * 60
+			}
+			if p := paramFloat(fields, 'P'); !math.IsNaN(p) {
+				if meta.percent == nil {
+					meta.percent = make(map[int]float64)
+				}
+				meta.percent[i] = p
+			}
+		}
+
 		// Temperature commands.
 		if strings.HasPrefix(upper, "M104 ") || strings.HasPrefix(upper, "M109 ") {
-			scanTempCommand(codePart, currentTool, meta, false)
+			scanTempCommand(codePart, currentTool, meta, false, tools)
 		} else if strings.HasPrefix(upper, "M140 ") || strings.HasPrefix(upper, "M190 ") {
-			scanTempCommand(codePart, currentTool, meta, true)
+			scanTempCommand(codePart, currentTool, meta, true, tools)
 		}
 
 		// G0/G1 move commands.
 		if isG0G1(upper) {
-			remapped := currentTool % 2
+			remapped := tools.Tool(currentTool)
+			extruding := false
 			for _, f := range strings.Fields(codePart)[1:] {
 				if len(f) < 2 {
 					continue
@@ -453,6 +603,7 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 				switch f[0] {
 				case 'X', 'x':
 					meta.hasCoords = true
+					lastX = val
 					if val < meta.minX {
 						meta.minX = val
 					}
@@ -461,6 +612,7 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 					}
 				case 'Y', 'y':
 					meta.hasCoords = true
+					lastY = val
 					if val < meta.minY {
 						meta.minY = val
 					}
@@ -485,121 +637,39 @@ func scanFile(src io.Reader) (*metadata, int, []toolChangeEvent, error) {
 					if relative {
 						if val > 0 {
 							meta.filamentMM[remapped] += val
+							extruding = true
 						}
 					} else {
 						if val > lastAbsE[remapped] {
 							meta.filamentMM[remapped] += val - lastAbsE[remapped]
+							extruding = true
 						}
 						lastAbsE[remapped] = val
 					}
 				}
 			}
+			if extruding {
+				extruded = true
+				objects.extrude(lastX, lastY)
+				if !meta.partBoundsSet {
+					meta.partMinX = math.Min(meta.partMinX, lastX)
+					meta.partMaxX = math.Max(meta.partMaxX, lastX)
+				}
+			}
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, 0, nil, err
+		return nil, 0, err
 	}
 
 	if lastThumb != "" {
 		meta.thumbnail = "data:image/png;base64," + lastThumb
 	}
+	meta.moveTime = timer.elapsed
+	meta.objects, meta.objectKind = objects.finish()
 
-	return meta, i, toolChanges, nil
-}
-
-// transformFile is pass 2: streams src → out applying tool remap and inserting
-// nozzle shutoffs at the same source line indices as the legacy implementation.
-func transformFile(src io.Reader, out *bufio.Writer, meta *metadata) error {
-	needRemap := meta.maxToolNum > 1
-	currentTool := 0
-
-	scanner := bufio.NewScanner(src)
-	scanner.Buffer(make([]byte, 64*1024), scanBufMax)
-
-	writeLine := func(s string) error {
-		if _, err := out.WriteString(s); err != nil {
-			return err
-		}
-		return out.WriteByte('\n')
-	}
-
-	i := 0
-	for ; scanner.Scan(); i++ {
-		line := scanner.Text()
-		trimmed := strings.TrimSpace(line)
-
-		codePart := trimmed
-		commentPart := ""
-		if idx := strings.IndexByte(trimmed, ';'); idx >= 0 {
-			commentPart = trimmed[idx:]
-			codePart = strings.TrimSpace(trimmed[:idx])
-		}
-
-		if codePart == "" {
-			if err := writeLine(line); err != nil {
-				return err
-			}
-			continue
-		}
-
-		upper := strings.ToUpper(codePart)
-
-		// Tool change.
-		if len(upper) >= 2 && upper[0] == 'T' {
-			if n, err := strconv.Atoi(upper[1:]); err == nil {
-				prevTool := currentTool % 2
-				currentTool = n
-				newTool := n % 2
-
-				if needRemap && n > 1 {
-					out := fmt.Sprintf("T%d", newTool)
-					if commentPart != "" {
-						out += " " + commentPart
-					}
-					if err := writeLine(out); err != nil {
-						return err
-					}
-				} else {
-					if err := writeLine(line); err != nil {
-						return err
-					}
-				}
-
-				// Unused nozzle shutoff: if the previous tool won't be used
-				// again after this point, turn off its heater.
-				if prevTool != newTool && meta.lastToolLine[prevTool] >= 0 && meta.lastToolLine[prevTool] <= i {
-					if err := writeLine(fmt.Sprintf("M104 S0 T%d ; shutoff unused nozzle", prevTool)); err != nil {
-						return err
-					}
-				}
-
-				continue
-			}
-		}
-
-		// Remap T param on M104/M109.
-		if needRemap && (strings.HasPrefix(upper, "M104 ") || strings.HasPrefix(upper, "M109 ")) {
-			if err := writeLine(remapParam(line, codePart, commentPart, 'T')); err != nil {
-				return err
-			}
-			continue
-		}
-
-		// Remap P param on M106/M107.
-		if needRemap && (strings.HasPrefix(upper, "M106 ") || strings.HasPrefix(upper, "M107 ")) {
-			if err := writeLine(remapParam(line, codePart, commentPart, 'P')); err != nil {
-				return err
-			}
-			continue
-		}
-
-		if err := writeLine(line); err != nil {
-			return err
-		}
-	}
-
-	return scanner.Err()
+	return meta, i, nil
 }
 
 // isG0G1 returns true if the uppercased line is a G0 or G1 move command.
@@ -622,6 +692,14 @@ func scanComment(comment string, meta *metadata) {
 		return
 	}
 
+	// ;MINX:12.3 / ;MAXX:45.6 (Cura print bounds).
+	if strings.HasPrefix(lower, "minx:") || strings.HasPrefix(lower, "maxx:") {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(s[5:]), 64); err == nil {
+			setPartBound(meta, lower[:3] == "min", v)
+		}
+		return
+	}
+
 	// Key = value pairs.
 	idx := strings.Index(s, "=")
 	if idx < 0 {
@@ -635,6 +713,11 @@ func scanComment(comment string, meta *metadata) {
 		if v, err := strconv.ParseFloat(val, 64); err == nil && meta.layerHeight == 0 {
 			meta.layerHeight = v
 		}
+	case "min_x", "max_x":
+		// Print bounds from the SMFix-compatible end gcode comments.
+		if v, err := strconv.ParseFloat(val, 64); err == nil {
+			setPartBound(meta, key == "min_x", v)
+		}
 	case "estimated printing time", "estimated printing time (normal mode)":
 		if meta.estimatedTime == 0 {
 			meta.estimatedTime = parseDuration(val)
@@ -686,8 +769,22 @@ func scanComment(comment string, meta *metadata) {
 	}
 }
 
+// setPartBound records a slicer-reported X print bound, replacing any
+// extent gathered from extruding moves.
+func setPartBound(meta *metadata, isMin bool, v float64) {
+	if !meta.partBoundsSet {
+		meta.partBoundsSet = true
+		meta.partMinX, meta.partMaxX = math.MaxFloat64, -math.MaxFloat64
+	}
+	if isMin {
+		meta.partMinX = v
+	} else {
+		meta.partMaxX = v
+	}
+}
+
 // scanTempCommand extracts temperature values from M104/M109/M140/M190 commands.
-func scanTempCommand(line string, currentTool int, meta *metadata, isBed bool) {
+func scanTempCommand(line string, currentTool int, meta *metadata, isBed bool, tools ToolMap) {
 	fields := strings.Fields(line)
 	sVal := 0.0
 	tVal := currentTool
@@ -714,7 +811,7 @@ func scanTempCommand(line string, currentTool int, meta *metadata, isBed bool) {
 			meta.bedTempSet = true
 		}
 	} else {
-		remapped := tVal % 2
+		remapped := tools.Tool(tVal)
 		if !meta.nozzleTempSet[remapped] && sVal > 0 {
 			meta.nozzleTemp[remapped] = sVal
 			meta.nozzleTempSet[remapped] = true
@@ -725,8 +822,8 @@ func scanTempCommand(line string, currentTool int, meta *metadata, isBed bool) {
 	}
 }
 
-// remapParam rewrites a parameter (T or P) with values > 1 using mod 2.
-func remapParam(original, codePart, commentPart string, param byte) string {
+// remapParam rewrites a tool parameter (T or P) to the physical head.
+func remapParam(original, codePart, commentPart string, param byte, tools ToolMap) string {
 	fields := strings.Fields(codePart)
 	changed := false
 	upper := param
@@ -734,8 +831,8 @@ func remapParam(original, codePart, commentPart string, param byte) string {
 
 	for i, f := range fields {
 		if len(f) >= 2 && (f[0] == upper || f[0] == lower) {
-			if n, err := strconv.Atoi(f[1:]); err == nil && n > 1 {
-				fields[i] = fmt.Sprintf("%c%d", upper, n%2)
+			if n, err := strconv.Atoi(f[1:]); err == nil && tools.Tool(n) != n {
+				fields[i] = fmt.Sprintf("%c%d", upper, tools.Tool(n))
 				changed = true
 			}
 		}
@@ -0,0 +1,56 @@
+package gcode
+
+import "strings"
+
+// Profile describes the physical limits of a printer model. It is used by
+// the pre-flight validator and by anything that needs the build volume
+// rather than the bounds reported by a particular gcode file.
+type Profile struct {
+	Name string
+	// Build volume in mm, measured from the origin.
+	BedX, BedY, BedZ float64
+	// Heater limits in °C.
+	MaxHotendTemp float64
+	MaxBedTemp    float64
+	// Toolheads is the number of independent extruders the model can carry.
+	Toolheads int
+	// DuplicationOffset is the X distance between the heads in Duplication
+	// mode (the M605 S2 X parameter), 0 to leave it to the firmware.
+	DuplicationOffset float64
+}
+
+// profiles lists the known models, matched by a case-insensitive substring
+// of the configured printer model. Order matters: the first match wins.
+var profiles = []struct {
+	match   string
+	profile Profile
+}{
+	{"j1", Profile{Name: "Snapmaker J1", BedX: 300, BedY: 200, BedZ: 200, MaxHotendTemp: 300, MaxBedTemp: 100, Toolheads: 2, DuplicationOffset: 162}},
+	{"artisan", Profile{Name: "Snapmaker Artisan", BedX: 400, BedY: 400, BedZ: 400, MaxHotendTemp: 300, MaxBedTemp: 110, Toolheads: 2}},
+	{"a350", Profile{Name: "Snapmaker A350", BedX: 320, BedY: 350, BedZ: 330, MaxHotendTemp: 275, MaxBedTemp: 100, Toolheads: 2}},
+	{"a250", Profile{Name: "Snapmaker A250", BedX: 230, BedY: 250, BedZ: 235, MaxHotendTemp: 275, MaxBedTemp: 100, Toolheads: 2}},
+	{"a150", Profile{Name: "Snapmaker A150", BedX: 160, BedY: 160, BedZ: 145, MaxHotendTemp: 275, MaxBedTemp: 100, Toolheads: 2}},
+}
+
+// ProfileForModel returns the machine profile for a printer model string.
+// Unknown models fall back to the J1 profile, since that is the printer the
+// bridge is primarily built for.
+func ProfileForModel(model string) Profile {
+	lower := strings.ToLower(model)
+	for _, p := range profiles {
+		if strings.Contains(lower, p.match) {
+			return p.profile
+		}
+	}
+	return profiles[0].profile
+}
+
+// PrintWidth returns the usable X width for the given IDEX mode. In
+// Duplication and Mirror modes both heads print at once, so each head only
+// gets half the bed.
+func (p Profile) PrintWidth(idexMode string) float64 {
+	if idexMode == IDEXModeDuplication || idexMode == IDEXModeMirror {
+		return p.BedX / 2
+	}
+	return p.BedX
+}
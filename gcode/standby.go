@@ -0,0 +1,153 @@
+package gcode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// StandbyConfig controls idle-nozzle temperatures in multi-tool prints.
+type StandbyConfig struct {
+	// Temperature the idle nozzle drops to after a tool change; 0 disables
+	// standby.
+	Temperature float64 `yaml:"temperature"`
+	// Preheat is how many seconds of estimated print time before its next
+	// use the idle nozzle is heated back to its print temperature.
+	Preheat float64 `yaml:"preheat"`
+}
+
+// Check validates the standby settings.
+func (c StandbyConfig) Check() error {
+	if c.Temperature < 0 {
+		return fmt.Errorf("standby temperature must not be negative")
+	}
+	if c.Preheat < 0 {
+		return fmt.Errorf("standby preheat must not be negative")
+	}
+	return nil
+}
+
+// standbyStage drops the nozzle that was just parked to the standby
+// temperature and re-heats it Preheat seconds before the next change back to
+// it. Timing comes from the pass-1 tool change list and a moveTimer fed the
+// same lines, so the count and write passes insert identical lines. Idle gaps
+// shorter than the preheat lead are left alone, as is a nozzle that is never
+// used again (nozzleShutoffStage turns that one off).
+type standbyStage struct {
+	passStage
+	standby   float64
+	lead      float64 // preheat lead in moveTimer seconds
+	changes   []toolChange
+	next      int // index of the next change in changes
+	current   int
+	timer     *moveTimer
+	temp      [2]float64 // print temperature last set for each head
+	pending   [2]bool    // head is in standby awaiting preheat
+	preheatAt [2]float64 // moveTimer clock at which to preheat
+}
+
+func newStandbyStage(meta *metadata, opts Options) *standbyStage {
+	return &standbyStage{
+		passStage: passStage{"standby"},
+		standby:   opts.Standby.Temperature,
+		lead:      opts.Standby.Preheat / meta.timeScale(),
+		changes:   meta.toolChanges,
+		current:   opts.ToolMap.Tool(0),
+		timer:     newMoveTimer(),
+		temp:      meta.nozzleTemp,
+	}
+}
+
+func (s *standbyStage) line(idx int, line string, emit emitFunc) error {
+	codePart, _ := splitCode(line)
+	upper := strings.ToUpper(codePart)
+	now := s.timer.line(upper)
+
+	if s.next < len(s.changes) && s.changes[s.next].line == idx {
+		if err := s.toolChange(line, emit); err != nil {
+			return err
+		}
+	} else {
+		s.scanTemp(upper)
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+
+	for t := 0; t < 2; t++ {
+		if s.pending[t] && now >= s.preheatAt[t] {
+			s.pending[t] = false
+			if err := emit(fmt.Sprintf("M104 S%.0f T%d ; preheat", s.temp[t], t)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toolChange emits the T line for the change at s.next and parks the head
+// it replaces.
+func (s *standbyStage) toolChange(line string, emit emitFunc) error {
+	ch := s.changes[s.next]
+	s.next++
+
+	// The estimate ran ahead of the print: make sure the head is back at
+	// temperature before it is used.
+	if s.pending[ch.tool] {
+		s.pending[ch.tool] = false
+		if err := emit(fmt.Sprintf("M109 S%.0f T%d ; preheat", s.temp[ch.tool], ch.tool)); err != nil {
+			return err
+		}
+	}
+	if err := emit(line); err != nil {
+		return err
+	}
+
+	prev := s.current
+	s.current = ch.tool
+	if s.next >= len(s.changes) {
+		return nil
+	}
+	// With two heads the next change always returns to the parked one.
+	back := s.changes[s.next]
+	if back.time-ch.time <= s.lead || s.temp[prev] <= s.standby {
+		return nil
+	}
+	s.pending[prev] = true
+	s.preheatAt[prev] = back.time - s.lead
+	return emit(fmt.Sprintf("M104 S%.0f T%d ; standby", s.standby, prev))
+}
+
+// scanTemp tracks the print temperature of each head. A temperature the file
+// sets for a parked head replaces the pending preheat.
+func (s *standbyStage) scanTemp(upper string) {
+	fields := strings.Fields(upper)
+	if len(fields) == 0 || (fields[0] != "M104" && fields[0] != "M109") {
+		return
+	}
+	tool := s.current
+	temp := math.NaN()
+	for _, f := range fields[1:] {
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case 'T':
+			if n, err := strconv.Atoi(f[1:]); err == nil {
+				tool = n % 2
+			}
+		case 'S':
+			if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
+				temp = v
+			}
+		}
+	}
+	if math.IsNaN(temp) {
+		return
+	}
+	s.pending[tool] = false
+	if temp > 0 {
+		s.temp[tool] = temp
+	}
+}
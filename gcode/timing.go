@@ -0,0 +1,112 @@
+package gcode
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultFeedrate is assumed (mm/min) until the file sets one with F.
+const defaultFeedrate = 1500
+
+// moveTimer estimates elapsed print time from move lengths and feedrates.
+// It ignores acceleration, so it runs short of the real print time; callers
+// that have the slicer's estimate scale it (see metadata.timeScale). Pass 1
+// and the transform stages feed it the same lines so their clocks agree.
+type moveTimer struct {
+	pos       [4]float64 // X, Y, Z, E
+	feedrate  float64    // mm/min
+	relative  bool       // G91
+	relativeE bool       // M83
+	elapsed   float64    // seconds
+}
+
+func newMoveTimer() *moveTimer {
+	return &moveTimer{feedrate: defaultFeedrate}
+}
+
+// line advances the clock by one line of code (uppercased, comment
+// stripped) and returns the elapsed time after it.
+func (t *moveTimer) line(upper string) float64 {
+	fields := strings.Fields(upper)
+	if len(fields) == 0 {
+		return t.elapsed
+	}
+	switch fields[0] {
+	case "G90":
+		t.relative, t.relativeE = false, false
+	case "G91":
+		t.relative, t.relativeE = true, true
+	case "M82":
+		t.relativeE = false
+	case "M83":
+		t.relativeE = true
+	case "G92":
+		for _, f := range fields[1:] {
+			if i := strings.IndexByte("XYZE", f[0]); i >= 0 && len(f) > 1 {
+				if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
+					t.pos[i] = v
+				}
+			}
+		}
+	case "G4":
+		for _, f := range fields[1:] {
+			if len(f) < 2 {
+				continue
+			}
+			v, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil {
+				continue
+			}
+			switch f[0] {
+			case 'P':
+				t.elapsed += v / 1000
+			case 'S':
+				t.elapsed += v
+			}
+		}
+	case "G0", "G1", "G2", "G3":
+		t.move(fields[1:])
+	}
+	return t.elapsed
+}
+
+// move applies a linear move; arcs are approximated by their chord.
+func (t *moveTimer) move(params []string) {
+	var delta [4]float64
+	for _, f := range params {
+		if len(f) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(f[1:], 64)
+		if err != nil {
+			continue
+		}
+		if f[0] == 'F' {
+			if v > 0 {
+				t.feedrate = v
+			}
+			continue
+		}
+		i := strings.IndexByte("XYZE", f[0])
+		if i < 0 {
+			continue
+		}
+		rel := t.relative
+		if i == 3 {
+			rel = t.relativeE
+		}
+		if rel {
+			delta[i] = v
+		} else {
+			delta[i] = v - t.pos[i]
+		}
+		t.pos[i] += delta[i]
+	}
+
+	dist := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+	if dist == 0 {
+		dist = math.Abs(delta[3])
+	}
+	t.elapsed += dist / (t.feedrate / 60)
+}
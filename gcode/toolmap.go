@@ -0,0 +1,118 @@
+package gcode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ToolMap maps the tool numbers used in a gcode file to the printer's
+// physical heads (0 or 1). Tools without an entry fold onto the head with
+// the same parity (T2→T0, T3→T1), which is the default when the map is nil.
+type ToolMap map[int]int
+
+// Tool returns the physical head for source tool n.
+func (m ToolMap) Tool(n int) int {
+	if t, ok := m[n]; ok {
+		return t
+	}
+	return n % 2
+}
+
+// IsDefault reports whether the map changes nothing compared to the
+// default parity folding.
+func (m ToolMap) IsDefault() bool {
+	for src, dst := range m {
+		if dst != src%2 {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the map as "T0=T1,T1=T0", sorted by source tool.
+func (m ToolMap) String() string {
+	srcs := make([]int, 0, len(m))
+	for src := range m {
+		srcs = append(srcs, src)
+	}
+	sort.Ints(srcs)
+	parts := make([]string, len(srcs))
+	for i, src := range srcs {
+		parts[i] = fmt.Sprintf("T%d=T%d", src, m[src])
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseToolMap parses a tool mapping such as "T0=T1,T1=T0" or "0:1". Each
+// pair maps a source tool to a physical head (0 or 1). An empty string is
+// the default mapping.
+func ParseToolMap(s string) (ToolMap, error) {
+	m := ToolMap{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		sep := strings.IndexAny(pair, "=:")
+		if sep < 0 {
+			return nil, fmt.Errorf("tool map entry %q: want source=target", pair)
+		}
+		src, err := parseToolNumber(pair[:sep])
+		if err != nil {
+			return nil, fmt.Errorf("tool map entry %q: %w", pair, err)
+		}
+		dst, err := parseToolNumber(pair[sep+1:])
+		if err != nil {
+			return nil, fmt.Errorf("tool map entry %q: %w", pair, err)
+		}
+		if dst > 1 {
+			return nil, fmt.Errorf("tool map entry %q: target must be T0 or T1", pair)
+		}
+		if _, dup := m[src]; dup {
+			return nil, fmt.Errorf("tool map maps T%d twice", src)
+		}
+		m[src] = dst
+	}
+	return m, nil
+}
+
+// parseToolNumber parses "1" or "T1".
+func parseToolNumber(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "T"), "t")
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid tool %q", s)
+	}
+	return n, nil
+}
+
+// applyToolMap moves the slicer's per-extruder settings, which are indexed
+// by source tool, onto the physical heads they will print on. Values that
+// pass 1 gathers from commands (temperatures, filament, tool usage) are
+// already mapped as they are scanned.
+//
+// Only tools the map names are moved. A tool left to the default stays on
+// its own head unless the map sends another tool there, so with T0=T1 the
+// T1 head gets T0's settings rather than the slicer's unused T1 ones.
+func applyToolMap(meta *metadata, tools ToolMap) {
+	if tools.IsDefault() {
+		return
+	}
+	filamentType := meta.filamentType
+	nozzleDiameter := meta.nozzleDiameter
+	retraction := meta.retraction
+	switchRetraction := meta.switchRetraction
+	for src := 0; src < 2; src++ {
+		dst, ok := tools[src]
+		if !ok {
+			continue
+		}
+		meta.filamentType[dst] = filamentType[src]
+		meta.nozzleDiameter[dst] = nozzleDiameter[src]
+		meta.retraction[dst] = retraction[src]
+		meta.switchRetraction[dst] = switchRetraction[src]
+	}
+}
@@ -0,0 +1,355 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Issue severities reported by Validate.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// boundsTolerance is how far (mm) a move may stray outside the build volume
+// before it is reported. Slicer purge lines and rounding routinely land a
+// fraction of a millimetre past the nominal edge.
+const boundsTolerance = 1.0
+
+// diameterTolerance is the allowed difference (mm) between the slicer's
+// nozzle_diameter and the nozzle reported by the printer.
+const diameterTolerance = 0.01
+
+// Issue is a single finding from the pre-flight validator. Repeated findings
+// of the same kind are folded into one Issue with a Count, so a file with a
+// million out-of-range moves doesn't produce a million entries.
+type Issue struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Line     int    `json:"line"` // 1-based source line of the first occurrence, 0 if file-wide
+	Count    int    `json:"count"`
+	Message  string `json:"message"`
+}
+
+// Report is the result of validating a gcode file.
+type Report struct {
+	Errors   []Issue `json:"errors"`
+	Warnings []Issue `json:"warnings"`
+}
+
+// HasErrors returns true if the report contains at least one error.
+func (r *Report) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// Toolhead describes an extruder detected on the printer.
+type Toolhead struct {
+	Tool           int     `json:"tool"`
+	NozzleDiameter float64 `json:"nozzle_diameter"` // mm, 0 if unknown
+}
+
+// ValidateOptions controls what Validate checks a file against.
+type ValidateOptions struct {
+	Model string
+	// Toolheads lists the extruders currently loaded on the printer. When
+	// empty (e.g. the printer is offline), toolhead checks are skipped.
+	Toolheads []Toolhead
+	// ToolMap is the tool mapping the file will be printed with.
+	ToolMap ToolMap
+	// ConvertIDEX is the Duplication or Mirror mode the file will be
+	// converted to at print start (see Options.IDEXMode), if any. X bounds
+	// are then checked as a part width, since conversion shifts the part.
+	ConvertIDEX string
+}
+
+// issueSet accumulates issues keyed by code, keeping the first occurrence.
+type issueSet struct {
+	order  []string
+	issues map[string]*Issue
+}
+
+func (s *issueSet) add(severity, code string, line int, message string) {
+	if s.issues == nil {
+		s.issues = make(map[string]*Issue)
+	}
+	if is, ok := s.issues[code]; ok {
+		is.Count++
+		return
+	}
+	s.issues[code] = &Issue{Severity: severity, Code: code, Line: line, Count: 1, Message: message}
+	s.order = append(s.order, code)
+}
+
+func (s *issueSet) report() *Report {
+	r := &Report{Errors: []Issue{}, Warnings: []Issue{}}
+	for _, code := range s.order {
+		is := *s.issues[code]
+		if is.Severity == SeverityError {
+			r.Errors = append(r.Errors, is)
+		} else {
+			r.Warnings = append(r.Warnings, is)
+		}
+	}
+	return r
+}
+
+// Validate streams the gcode at srcPath and reports anything that would make
+// the print fail or damage the machine: moves outside the build volume
+// (honouring the halved width in Duplication/Mirror mode), temperatures above
+// the heater limits, T1 use on a single-head setup, a slicer nozzle_diameter
+// that differs from the detected nozzle, and moves before homing.
+func Validate(srcPath string, opts ValidateOptions) (*Report, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening gcode: %w", err)
+	}
+	defer src.Close()
+
+	profile := ProfileForModel(opts.Model)
+	var issues issueSet
+
+	// Slicer settings from comments, gathered with the same parser pass 1 uses.
+	meta := &metadata{}
+	idexMode := ""
+
+	// Position tracking: logical position plus the G92 offset gives the
+	// machine position that is compared against the build volume.
+	var pos, offset [3]float64
+	relative := false
+	homed := false
+	currentTool := 0
+	var toolsUsed [2]bool
+	minX, maxX := math.Inf(1), math.Inf(-1)
+
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), scanBufMax)
+
+	for i := 1; scanner.Scan(); i++ {
+		trimmed := strings.TrimSpace(scanner.Text())
+
+		codePart := trimmed
+		if idx := strings.IndexByte(codePart, ';'); idx >= 0 {
+			scanComment(codePart[idx:], meta)
+			codePart = strings.TrimSpace(codePart[:idx])
+		}
+		if codePart == "" {
+			continue
+		}
+		upper := strings.ToUpper(codePart)
+		fields := strings.Fields(upper)
+		cmd := fields[0]
+
+		// Tool change.
+		if len(cmd) >= 2 && cmd[0] == 'T' {
+			if n, err := strconv.Atoi(cmd[1:]); err == nil {
+				currentTool = n
+				if opts.ToolMap.Tool(n) == 1 && len(opts.Toolheads) == 1 {
+					issues.add(SeverityError, "single_head_t1", i,
+						fmt.Sprintf("file selects T%d, printed on T1, but only one toolhead is loaded", n))
+				}
+				continue
+			}
+		}
+
+		switch cmd {
+		case "G28":
+			homed = true
+			// Homing resets the G92 offsets on the homed axes; approximating
+			// with all axes is good enough for bounds checking.
+			offset = [3]float64{}
+		case "G90":
+			relative = false
+		case "G91":
+			relative = true
+		case "G92":
+			for _, f := range fields[1:] {
+				if axis := axisIndex(f[0]); axis >= 0 && len(f) > 1 {
+					if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
+						offset[axis] = pos[axis] + offset[axis] - v
+						pos[axis] = v
+					}
+				}
+			}
+		case "M605":
+			if v := paramFloat(fields, 'S'); !math.IsNaN(v) {
+				switch int(v) {
+				case 0:
+					idexMode = ""
+				case 2:
+					idexMode = IDEXModeDuplication
+				case 3:
+					idexMode = IDEXModeMirror
+				}
+			}
+		case "M104", "M109":
+			tool := currentTool
+			if v := paramFloat(fields, 'T'); !math.IsNaN(v) {
+				tool = int(v)
+			}
+			// Start and end gcode often turn off the other head with
+			// M104 T1 S0, which is harmless without it.
+			heats := false
+			for _, p := range []byte{'S', 'R'} {
+				if v := paramFloat(fields, p); !math.IsNaN(v) && v > 0 {
+					heats = true
+				}
+			}
+			if heats && opts.ToolMap.Tool(tool) == 1 && len(opts.Toolheads) == 1 {
+				issues.add(SeverityError, "single_head_t1", i,
+					fmt.Sprintf("file heats T%d, printed on T1, but only one toolhead is loaded", tool))
+			}
+			for _, p := range []byte{'S', 'R'} {
+				if v := paramFloat(fields, p); !math.IsNaN(v) && v > profile.MaxHotendTemp {
+					issues.add(SeverityError, "hotend_temp", i,
+						fmt.Sprintf("%s sets T%d to %.0f°C, above the %.0f°C hotend limit", cmd, tool, v, profile.MaxHotendTemp))
+				}
+			}
+		case "M140", "M190":
+			for _, p := range []byte{'S', 'R'} {
+				if v := paramFloat(fields, p); !math.IsNaN(v) && v > profile.MaxBedTemp {
+					issues.add(SeverityError, "bed_temp", i,
+						fmt.Sprintf("%s sets the bed to %.0f°C, above the %.0f°C bed limit", cmd, v, profile.MaxBedTemp))
+				}
+			}
+		case "G0", "G1", "G2", "G3":
+			moved := false
+			extruding := false
+			for _, f := range fields[1:] {
+				if len(f) < 2 {
+					continue
+				}
+				if f[0] == 'E' {
+					toolsUsed[opts.ToolMap.Tool(currentTool)] = true
+					if v, err := strconv.ParseFloat(f[1:], 64); err == nil && v > 0 {
+						extruding = true
+					}
+					continue
+				}
+				axis := axisIndex(f[0])
+				if axis < 0 {
+					continue
+				}
+				v, err := strconv.ParseFloat(f[1:], 64)
+				if err != nil {
+					continue
+				}
+				if relative {
+					pos[axis] += v
+				} else {
+					pos[axis] = v
+				}
+				moved = true
+			}
+			if !moved {
+				continue
+			}
+			if !homed {
+				issues.add(SeverityWarning, "not_homed", i, "move before any G28 homing command")
+			}
+			width := profile.PrintWidth(idexMode)
+			limits := [3]float64{width, profile.BedY, profile.BedZ}
+			names := [3]string{"X", "Y", "Z"}
+			for axis := 0; axis < 3; axis++ {
+				machine := pos[axis] + offset[axis]
+				if axis == 0 && opts.ConvertIDEX != "" {
+					// Checked as a part width below; conversion shifts and
+					// clamps X into the half bed.
+					if extruding {
+						minX = math.Min(minX, machine)
+						maxX = math.Max(maxX, machine)
+					}
+					continue
+				}
+				if machine > limits[axis]+boundsTolerance || (axis < 2 && machine < -boundsTolerance) {
+					code := "out_of_bounds_" + strings.ToLower(names[axis])
+					msg := fmt.Sprintf("%s=%.2f is outside the %.0f mm build volume", names[axis], machine, limits[axis])
+					if axis == 0 && width != profile.BedX {
+						msg = fmt.Sprintf("X=%.2f is outside the %.0f mm half-bed width of %s mode", machine, width, idexMode)
+					}
+					issues.add(SeverityError, code, i, msg)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning gcode: %w", err)
+	}
+
+	// Conversion to Duplication/Mirror needs a single-tool part that fits
+	// in half the bed; the same conditions ProcessFile enforces.
+	if opts.ConvertIDEX != "" {
+		half := profile.PrintWidth(opts.ConvertIDEX)
+		if meta.partBoundsSet {
+			minX, maxX = meta.partMinX, meta.partMaxX
+		}
+		switch {
+		case idexMode != "":
+			issues.add(SeverityError, "idex_convert", 0,
+				fmt.Sprintf("file already selects %s mode", idexMode))
+		case toolsUsed[1]:
+			issues.add(SeverityError, "idex_convert", 0,
+				"file uses more than one tool and can't be converted to "+opts.ConvertIDEX)
+		case maxX-minX > half:
+			issues.add(SeverityError, "idex_fit", 0,
+				fmt.Sprintf("part is %.1f mm wide but %s mode fits %.0f mm", maxX-minX, opts.ConvertIDEX, half))
+		}
+		idexMode = opts.ConvertIDEX
+	}
+
+	// Duplication/Mirror drive both heads from T0 commands.
+	if idexMode != "" && toolsUsed[0] {
+		toolsUsed[1] = true
+		if len(opts.Toolheads) == 1 {
+			issues.add(SeverityError, "single_head_idex", 0,
+				fmt.Sprintf("%s mode needs two toolheads but only one is loaded", idexMode))
+		}
+	}
+
+	// Nozzle diameter: compare the slicer's setting for each used tool with
+	// what the printer reports for the head it prints on.
+	applyToolMap(meta, opts.ToolMap)
+	for _, th := range opts.Toolheads {
+		t := th.Tool % 2
+		if !toolsUsed[t] || th.NozzleDiameter == 0 || meta.nozzleDiameter[t] == 0 {
+			continue
+		}
+		if math.Abs(th.NozzleDiameter-meta.nozzleDiameter[t]) > diameterTolerance {
+			issues.add(SeverityWarning, fmt.Sprintf("nozzle_diameter_t%d", t), 0,
+				fmt.Sprintf("file is sliced for a %.2f mm nozzle on T%d but the printer reports %.2f mm",
+					meta.nozzleDiameter[t], t, th.NozzleDiameter))
+		}
+	}
+
+	return issues.report(), nil
+}
+
+// axisIndex maps an uppercase axis letter to a position index (X=0, Y=1, Z=2),
+// or -1 for anything else.
+func axisIndex(c byte) int {
+	switch c {
+	case 'X':
+		return 0
+	case 'Y':
+		return 1
+	case 'Z':
+		return 2
+	}
+	return -1
+}
+
+// paramFloat returns the value of a single-letter parameter from uppercased
+// gcode fields, or NaN if the parameter is absent or malformed.
+func paramFloat(fields []string, param byte) float64 {
+	for _, f := range fields[1:] {
+		if len(f) >= 2 && f[0] == param {
+			if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
+				return v
+			}
+		}
+	}
+	return math.NaN()
+}
@@ -28,6 +28,7 @@ import (
 type printState struct {
 	Filename   string `json:"filename"`
 	TotalLines uint32 `json:"total_lines"`
+	CacheKey   string `json:"cache_key,omitempty"` // processed file in the gcode cache
 }
 
 func writePrintState(path string, ps printState) {
@@ -60,6 +61,65 @@ func clearPrintState(path string) {
 	os.Remove(path)
 }
 
+// lookupPrintState returns the cache entry ps recorded for filename, found
+// by its key so the source needn't be hashed again. The entry is held until
+// released.
+func lookupPrintState(cache *gcode.Cache, ps printState, filename string) (*gcode.CacheEntry, bool) {
+	if cache == nil || ps.Filename != filename || ps.CacheKey == "" {
+		return nil, false
+	}
+	return cache.Lookup(ps.CacheKey)
+}
+
+// cachedLines returns the processed line count of srcPath from the cache,
+// or 0 if it is not cached.
+func cachedLines(cache *gcode.Cache, srcPath string, opts gcode.Options) (uint32, error) {
+	if cache == nil {
+		return 0, nil
+	}
+	key, err := cache.Key(srcPath, opts)
+	if err != nil {
+		return 0, err
+	}
+	entry, ok := cache.Lookup(key)
+	if !ok {
+		return 0, nil
+	}
+	defer entry.Release()
+	return entry.Lines, nil
+}
+
+// restorePrintIndex reloads the print index saved when filename was last
+// processed, so layer progress survives a bridge restart mid-print. The
+// index saved beside the source is preferred, as objects excluded during
+// the print are recorded there; without it, the cache entry recorded in ps
+// has the index the print started with.
+func restorePrintIndex(pc *printer.Client, fm *files.Manager, cache *gcode.Cache, ps printState, filename string) {
+	absPath, ok := fm.FindByBasename("gcodes", filename)
+	if ok {
+		idx, err := gcode.LoadIndex(gcode.IndexPath(absPath))
+		if err == nil {
+			pc.SetPrintIndex(absPath, idx)
+			log.Printf("Restored print index for %s (%d layers)", filename, idx.TotalLayers)
+			return
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to load print index for %s: %v", filename, err)
+		}
+	}
+	entry, ok := lookupPrintState(cache, ps, filename)
+	if !ok {
+		return
+	}
+	defer entry.Release()
+	if entry.Index == nil {
+		return
+	}
+	idx := entry.Index
+	pc.SetPrintIndex(entry.Source, idx)
+	log.Printf("Restored print index for %s (%d layers)", filename, idx.TotalLayers)
+}
+
 func main() {
 	configPath := flag.String("config", "config.yaml", "path to configuration file")
 	discover := flag.Bool("discover", false, "discover printers on the network and exit")
@@ -115,6 +175,23 @@ func main() {
 
 	// Initialize printer client.
 	pc := printer.NewClient(cfg.Printer.IP, cfg.Printer.Token, cfg.Printer.Model)
+	if err := pc.SetUploadChunkSize(cfg.Printer.UploadChunkKB * 1024); err != nil {
+		log.Fatalf("Invalid upload chunk size: %v", err)
+	}
+	if err := pc.SetUploadRecord(filepath.Join(dataDir, "uploads.json")); err != nil {
+		log.Printf("WARNING: Upload record unreadable, reprints will upload again: %v", err)
+	}
+
+	// Processed-file cache, filled in the background after uploads.
+	var cache *gcode.Cache
+	if cfg.Files.CacheSize > 0 {
+		cache, err = gcode.NewCache(filepath.Join(dataDir, "gcode_cache"), int64(cfg.Files.CacheSize)<<20)
+		if err != nil {
+			log.Fatalf("Failed to initialize gcode cache: %v", err)
+		}
+		pc.SetCache(cache)
+		log.Printf("GCode cache: %s (%d MB)", filepath.Join(dataDir, "gcode_cache"), cfg.Files.CacheSize)
+	}
 
 	// Initialize printer state.
 	state := printer.NewState()
@@ -126,10 +203,36 @@ func main() {
 			Port: cfg.Server.Port,
 		},
 	}
+	moonCfg.Server.SSLPort = cfg.Server.SSLPort
+	moonCfg.Server.CertFile = cfg.Server.SSLCertificatePath
+	moonCfg.Server.KeyFile = cfg.Server.SSLKeyPath
+	moonCfg.Server.RedirectHTTP = cfg.Server.RedirectHTTP
+	if moonCfg.Server.CertFile == "" {
+		moonCfg.Server.CertFile = filepath.Join(dataDir, "certs", "moonraker.crt")
+		moonCfg.Server.KeyFile = filepath.Join(dataDir, "certs", "moonraker.key")
+	}
+	if cfg.Server.UnixSocket {
+		moonCfg.Server.UnixSocket = cfg.Server.UnixSocketPath
+		if moonCfg.Server.UnixSocket == "" {
+			moonCfg.Server.UnixSocket = filepath.Join(dataDir, "comms", "moonraker.sock")
+		}
+	}
+	moonCfg.Auth.Enabled = cfg.Auth.Enabled
+	moonCfg.Auth.TrustedClients = cfg.Auth.TrustedClients
+	moonCfg.Auth.CORSDomains = cfg.Auth.CORSDomains
+	moonCfg.Auth.ForceLogins = cfg.Auth.ForceLogins
+	moonCfg.Auth.TrustedRole = cfg.Auth.TrustedRole
+	moonCfg.Auth.APIKeyRole = cfg.Auth.APIKeyRole
+	moonCfg.Auth.Guest = cfg.Auth.Guest
 	moonCfg.Printer.IP = cfg.Printer.IP
 	moonCfg.Printer.Token = cfg.Printer.Token
 	moonCfg.Printer.Model = cfg.Printer.Model
+	moonCfg.Printer.PrintMode = cfg.Printer.PrintMode
+	moonCfg.Printer.StreamWindow = cfg.Printer.StreamWindow
 	moonCfg.Files.GCodeDir = cfg.Files.GCodeDir
+	moonCfg.GCode.Validation = cfg.GCode.Validation
+	moonCfg.GCode.Transforms = cfg.GCode.Transforms
+	moonCfg.GCode.Standby = cfg.GCode.Standby
 
 	// Initialize history manager with a placeholder callback (will be set after server creation).
 	historyMgr, err = history.NewManager(filepath.Join(dataDir, "history"), nil)
@@ -147,7 +250,13 @@ func main() {
 	}
 
 	// Create the Moonraker server.
-	server := moonraker.NewServer(moonCfg, pc, state, fm, db, historyMgr, spoolmanMgr)
+	server, err := moonraker.NewServer(moonCfg, pc, state, fm, db, historyMgr, spoolmanMgr)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	if cache != nil {
+		server.SetCache(cache)
+	}
 
 	// Start Spoolman health check and wire notification callbacks.
 	if spoolmanMgr != nil {
@@ -192,6 +301,7 @@ func main() {
 	var printStateWritten bool    // track whether we've written the state file for this print
 	var printStateRestored bool   // avoid retrying file reads every poll cycle
 	var spoolmanTrackAttempted bool // avoid retrying Spoolman tracking every poll cycle
+	var printIndexChecked bool      // layer index looked up for this print
 	poller := printer.NewStatePoller(pc, state, cfg.Printer.PollInterval, func(s *printer.State) {
 		snap := s.Snapshot()
 		server.Hub().BroadcastStatusUpdate(s)
@@ -220,6 +330,7 @@ func main() {
 			printStateWritten = false
 			printStateRestored = false
 			spoolmanTrackAttempted = false
+			printIndexChecked = false
 		}
 
 		// Print state persistence: restore totalLines from state file after
@@ -227,9 +338,23 @@ func main() {
 		// Includes "paused" so a restart that lands during a paused print
 		// (a common diagnostic scenario) still recovers progress data.
 		if (snap.PrinterState == "printing" || snap.PrinterState == "paused") && snap.PrintFileName != "" {
+			if !printIndexChecked {
+				printIndexChecked = true
+				if !pc.HasPrintIndex(snap.PrintFileName) {
+					ps, _ := readPrintState(printStatePath)
+					restorePrintIndex(pc, fm, cache, ps, snap.PrintFileName)
+				}
+			}
 			if pc.TotalLines() == 0 && !printStateRestored {
-				// totalLines unknown — try to restore from state file or compute from file on disk.
-				if ps, ok := readPrintState(printStatePath); ok && ps.Filename == snap.PrintFileName && ps.TotalLines > 0 {
+				// totalLines unknown — try to restore from the cache entry or
+				// state file the print recorded, or compute from file on disk.
+				ps, _ := readPrintState(printStatePath)
+				if entry, ok := lookupPrintState(cache, ps, snap.PrintFileName); ok {
+					pc.SetTotalLines(entry.Lines)
+					entry.Release()
+					printStateRestored = true
+					log.Printf("Restored totalLines=%d for %s from gcode cache entry %s", entry.Lines, ps.Filename, ps.CacheKey)
+				} else if ps.Filename == snap.PrintFileName && ps.TotalLines > 0 {
 					pc.SetTotalLines(ps.TotalLines)
 					printStateRestored = true
 					log.Printf("Restored totalLines=%d for %s from print state file", ps.TotalLines, ps.Filename)
@@ -241,7 +366,21 @@ func main() {
 					// (V0/V1 header + nozzle-shutoff insertions), not the raw
 					// source — otherwise progress would drift over the print.
 					if absPath, ok := fm.FindByBasename("gcodes", snap.PrintFileName); ok {
-						lineCount, err := gcode.CountProcessedLines(absPath, cfg.Printer.Model)
+						// Without a recorded print the bridge didn't process this
+						// one (it was started on the printer, or before the state
+						// was saved), so assume the default stages. A cached entry
+						// has the count already; otherwise count without writing
+						// the output.
+						stages, _ := gcode.SelectStages(cfg.GCode.Transforms, nil)
+						opts := gcode.Options{
+							Model:   cfg.Printer.Model,
+							Stages:  stages,
+							Standby: cfg.GCode.Standby,
+						}
+						lineCount, err := cachedLines(cache, absPath, opts)
+						if err == nil && lineCount == 0 {
+							lineCount, err = gcode.CountProcessedLines(absPath, opts)
+						}
 						if err != nil {
 							log.Printf("Line count failed for %s: %v", absPath, err)
 						} else if lineCount > 0 {
@@ -260,9 +399,12 @@ func main() {
 				}
 			} else if !printStateWritten {
 				// totalLines is set (from Upload) but we haven't persisted it yet.
+				// The cache key lets a restart reload the processed file
+				// the print was made from, options and all.
 				writePrintState(printStatePath, printState{
 					Filename:   snap.PrintFileName,
 					TotalLines: pc.TotalLines(),
+					CacheKey:   pc.PrintCacheKey(snap.PrintFileName),
 				})
 				printStateWritten = true
 				log.Printf("Saved print state: %s (%d lines)", snap.PrintFileName, pc.TotalLines())
@@ -283,7 +425,7 @@ func main() {
 			// a local file, so retrying every poll cycle just spams errors.
 			if snap.PrinterState == "printing" && snap.PrintFileName != "" && !spoolmanMgr.IsTracking() && !spoolmanTrackAttempted {
 				spoolmanTrackAttempted = true
-				server.StartSpoolmanTracking(snap.PrintFileName)
+				server.StartSpoolmanTracking(snap.PrintFileName, nil)
 			}
 		}
 
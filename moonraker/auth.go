@@ -0,0 +1,769 @@
+package moonraker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/john/snapmaker_moonraker/database"
+)
+
+// authNamespace is the database namespace holding user accounts and the
+// API key. The database API refuses it.
+const authNamespace = "authorized_users"
+
+// Pseudo-users for requests authorized without logging in.
+const (
+	apiKeyUser  = "_API_KEY_USER_"
+	trustedUser = "_TRUSTED_USER_"
+	guestUser   = "_GUEST_USER_"
+	socketUser  = "_UNIX_SOCKET_USER_" // local clients on the Unix socket
+)
+
+const (
+	accessTokenLife  = time.Hour
+	refreshTokenLife = 90 * 24 * time.Hour
+	oneshotLife      = 5 * time.Second
+	// hashIterations matches Moonraker's PBKDF2 setting, so its password
+	// hashes carry over.
+	hashIterations = 100000
+	jwtAudience    = "Moonraker"
+)
+
+// AuthConfig controls who may use the API.
+type AuthConfig struct {
+	// Enabled turns authorization on; without it every request is trusted.
+	Enabled bool
+	// TrustedClients are addresses or CIDR ranges allowed in without
+	// logging in. Pages served from them may also use the API.
+	TrustedClients []string
+	// CORSDomains are the origins of other pages that may use the API,
+	// with * wildcards.
+	CORSDomains []string
+	// ForceLogins requires trusted clients to log in too once a user exists.
+	ForceLogins bool
+	// TrustedRole and APIKeyRole are the roles of trusted clients and of
+	// requests made with the API key: viewer, operator or admin.
+	TrustedRole string
+	APIKeyRole  string
+	// Guest lets clients that haven't logged in watch with the viewer
+	// role.
+	Guest bool
+}
+
+// authUser is a user account as stored in the database.
+type authUser struct {
+	Username  string  `json:"username"`
+	Password  string  `json:"password"` // PBKDF2-SHA256 of the password, hex
+	Salt      string  `json:"salt"`
+	Secret    string  `json:"jwt_secret"` // signs the user's tokens; replaced on logout
+	Source    string  `json:"source"`
+	Role      string  `json:"role"` // see parseRole; empty for accounts from before roles
+	CreatedOn float64 `json:"created_on"`
+}
+
+func (u *authUser) info() map[string]interface{} {
+	return map[string]interface{}{
+		"username":   u.Username,
+		"source":     u.Source,
+		"role":       u.Role,
+		"created_on": u.CreatedOn,
+	}
+}
+
+type oneshotToken struct {
+	user    string
+	expires time.Time
+}
+
+// authManager keeps user accounts, the API key and oneshot tokens, and
+// authorizes requests. Accounts live in the database; the manager keeps
+// them in memory and writes each change through.
+type authManager struct {
+	db          *database.Database
+	enabled     bool
+	forceLogins bool
+	guest       bool
+	trusted     []*net.IPNet
+	trustedRole role
+	apiKeyRole  role
+
+	mu       sync.Mutex
+	users    map[string]*authUser
+	apiKey   string
+	oneshots map[string]oneshotToken
+}
+
+func newAuthManager(cfg AuthConfig, db *database.Database) (*authManager, error) {
+	a := &authManager{
+		db:          db,
+		enabled:     cfg.Enabled,
+		forceLogins: cfg.ForceLogins,
+		guest:       cfg.Guest,
+		trustedRole: roleAdmin,
+		apiKeyRole:  roleAdmin,
+		users:       make(map[string]*authUser),
+		oneshots:    make(map[string]oneshotToken),
+	}
+	for _, c := range cfg.TrustedClients {
+		n, err := parseTrusted(c)
+		if err != nil {
+			return nil, err
+		}
+		a.trusted = append(a.trusted, n)
+	}
+	var err error
+	if cfg.TrustedRole != "" {
+		if a.trustedRole, err = parseRole(cfg.TrustedRole); err != nil {
+			return nil, fmt.Errorf("trusted role: %w", err)
+		}
+	}
+	if cfg.APIKeyRole != "" {
+		if a.apiKeyRole, err = parseRole(cfg.APIKeyRole); err != nil {
+			return nil, fmt.Errorf("API key role: %w", err)
+		}
+	}
+
+	stored, _ := db.GetNamespace(authNamespace)
+	for name, v := range stored {
+		data, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if name == apiKeyUser {
+			var k struct {
+				APIKey string `json:"api_key"`
+			}
+			if json.Unmarshal(data, &k) == nil {
+				a.apiKey = k.APIKey
+			}
+			continue
+		}
+		var u authUser
+		if err := json.Unmarshal(data, &u); err != nil || u.Password == "" {
+			log.Printf("Ignoring malformed user record %q", name)
+			continue
+		}
+		a.users[name] = &u
+	}
+	if a.apiKey == "" {
+		if _, err := a.rotateAPIKey(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// parseTrusted parses a trusted client entry, an address or a CIDR range.
+func parseTrusted(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid trusted client %q", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// pbkdf2 derives a 32-byte key from password with PBKDF2-HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func hashPassword(password, salt string) string {
+	s, _ := hex.DecodeString(salt)
+	return hex.EncodeToString(pbkdf2([]byte(password), s, hashIterations))
+}
+
+// saveUser writes u to the database, or deletes the record if u is nil;
+// must hold mu.
+func (a *authManager) saveUser(name string, u *authUser) error {
+	if u == nil {
+		return a.db.DeleteItem(authNamespace, name)
+	}
+	var v map[string]interface{}
+	data, _ := json.Marshal(u)
+	json.Unmarshal(data, &v)
+	return a.db.SetItem(authNamespace, name, v)
+}
+
+// checkUsername rejects names the database can't key or that clash with
+// the pseudo-users.
+func checkUsername(name string) error {
+	switch {
+	case name == "":
+		return &apiError{http.StatusBadRequest, "username is required"}
+	case strings.HasPrefix(name, "_"), strings.ContainsAny(name, "./\\ "):
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("invalid username %q", name)}
+	}
+	return nil
+}
+
+// createUser adds an account with roleName, or if it's "", admin for the
+// first account and operator for later ones.
+func (a *authManager) createUser(name, password, roleName string) (*authUser, error) {
+	if err := checkUsername(name); err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, &apiError{http.StatusBadRequest, "password is required"}
+	}
+	if roleName != "" {
+		if _, err := parseRole(roleName); err != nil {
+			return nil, &apiError{http.StatusBadRequest, err.Error()}
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.users[name]; ok {
+		return nil, &apiError{http.StatusBadRequest, fmt.Sprintf("user %q already exists", name)}
+	}
+	if roleName == "" {
+		roleName = roleOperator.String()
+		if len(a.users) == 0 {
+			roleName = roleAdmin.String()
+		}
+	}
+	u := &authUser{
+		Username:  name,
+		Salt:      randomHex(32),
+		Secret:    randomHex(32),
+		Source:    "moonraker",
+		Role:      roleName,
+		CreatedOn: float64(time.Now().UnixNano()) / 1e9,
+	}
+	u.Password = hashPassword(password, u.Salt)
+	if err := a.saveUser(name, u); err != nil {
+		return nil, err
+	}
+	a.users[name] = u
+	log.Printf("Auth: created user %s (%s)", name, roleName)
+	return u, nil
+}
+
+func (a *authManager) deleteUser(name string) (*authUser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return nil, &apiError{http.StatusNotFound, fmt.Sprintf("no user %q", name)}
+	}
+	if err := a.saveUser(name, nil); err != nil {
+		return nil, err
+	}
+	delete(a.users, name)
+	log.Printf("Auth: deleted user %s", name)
+	return u, nil
+}
+
+// user returns a copy of the account name, if it exists.
+func (a *authManager) user(name string) (authUser, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return authUser{}, false
+	}
+	return *u, true
+}
+
+func (a *authManager) listUsers() []map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]map[string]interface{}, 0, len(a.users))
+	for _, u := range a.users {
+		list = append(list, u.info())
+	}
+	return list
+}
+
+func (a *authManager) hasUsers() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.users) > 0
+}
+
+// checkPassword returns the account name if password is right.
+func (a *authManager) checkPassword(name, password string) (authUser, error) {
+	u, ok := a.user(name)
+	if !ok || !hmac.Equal([]byte(hashPassword(password, u.Salt)), []byte(u.Password)) {
+		return authUser{}, &apiError{http.StatusUnauthorized, "invalid username or password"}
+	}
+	return u, nil
+}
+
+func (a *authManager) setPassword(name, password string) error {
+	if password == "" {
+		return &apiError{http.StatusBadRequest, "new_password is required"}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return &apiError{http.StatusNotFound, fmt.Sprintf("no user %q", name)}
+	}
+	updated := *u
+	updated.Salt = randomHex(32)
+	updated.Password = hashPassword(password, updated.Salt)
+	updated.Secret = randomHex(32) // sessions end with the old password
+	if err := a.saveUser(name, &updated); err != nil {
+		return err
+	}
+	a.users[name] = &updated
+	return nil
+}
+
+func (a *authManager) setRole(name, roleName string) error {
+	if _, err := parseRole(roleName); err != nil {
+		return &apiError{http.StatusBadRequest, err.Error()}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return &apiError{http.StatusNotFound, fmt.Sprintf("no user %q", name)}
+	}
+	updated := *u
+	updated.Role = roleName
+	if err := a.saveUser(name, &updated); err != nil {
+		return err
+	}
+	a.users[name] = &updated
+	log.Printf("Auth: %s is now %s", name, roleName)
+	return nil
+}
+
+// logout ends every session of name by replacing the key its tokens are
+// signed with.
+func (a *authManager) logout(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if !ok {
+		return &apiError{http.StatusBadRequest, "not logged in"}
+	}
+	updated := *u
+	updated.Secret = randomHex(32)
+	if err := a.saveUser(name, &updated); err != nil {
+		return err
+	}
+	a.users[name] = &updated
+	return nil
+}
+
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	Expires   int64  `json:"exp"`
+	Username  string `json:"username"`
+	TokenType string `json:"token_type"` // "access" or "refresh"
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// issueToken returns an HS256 JWT of tokenType for u.
+func issueToken(u authUser, tokenType string, life time.Duration) string {
+	now := time.Now()
+	claims, _ := json.Marshal(jwtClaims{
+		Issuer:    "snapmaker_moonraker",
+		Audience:  jwtAudience,
+		IssuedAt:  now.Unix(),
+		Expires:   now.Add(life).Unix(),
+		Username:  u.Username,
+		TokenType: tokenType,
+	})
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + jwtSignature(signed, u.Secret)
+}
+
+func jwtSignature(signed, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkToken returns the user a valid, unexpired token of tokenType was
+// issued to.
+func (a *authManager) checkToken(token, tokenType string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return "", errUnauthorized
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errUnauthorized
+	}
+	var c jwtClaims
+	if err := json.Unmarshal(data, &c); err != nil {
+		return "", errUnauthorized
+	}
+	u, ok := a.user(c.Username)
+	if !ok || !hmac.Equal([]byte(jwtSignature(parts[0]+"."+parts[1], u.Secret)), []byte(parts[2])) {
+		return "", errUnauthorized
+	}
+	if c.Audience != jwtAudience || c.TokenType != tokenType {
+		return "", errUnauthorized
+	}
+	if time.Now().Unix() >= c.Expires {
+		return "", &apiError{http.StatusUnauthorized, "token expired"}
+	}
+	return u.Username, nil
+}
+
+func (a *authManager) getAPIKey() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.apiKey
+}
+
+func (a *authManager) checkAPIKey(key string) bool {
+	return hmac.Equal([]byte(key), []byte(a.getAPIKey()))
+}
+
+// rotateAPIKey replaces the API key, returning the new one.
+func (a *authManager) rotateAPIKey() (string, error) {
+	key := randomHex(16)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.db.SetItem(authNamespace, apiKeyUser, map[string]interface{}{
+		"username":   apiKeyUser,
+		"api_key":    key,
+		"created_on": float64(time.Now().UnixNano()) / 1e9,
+	})
+	if err != nil {
+		return "", fmt.Errorf("storing API key: %w", err)
+	}
+	a.apiKey = key
+	return key, nil
+}
+
+// newOneshot returns a token that authorizes one request as user within
+// a few seconds, for URLs that can't carry headers (WebSocket, downloads).
+func (a *authManager) newOneshot(user string) string {
+	token := randomHex(16)
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t, o := range a.oneshots {
+		if now.After(o.expires) {
+			delete(a.oneshots, t)
+		}
+	}
+	a.oneshots[token] = oneshotToken{user: user, expires: now.Add(oneshotLife)}
+	return token
+}
+
+func (a *authManager) useOneshot(token string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, ok := a.oneshots[token]
+	delete(a.oneshots, token)
+	if !ok || time.Now().After(o.expires) {
+		return "", false
+	}
+	return o.user, true
+}
+
+// clientIP returns the address a request came from. Requests relayed by a
+// proxy on this host (nginx in front of Mainsail) carry the client
+// address in X-Forwarded-For, of which only the last entry, the one the
+// proxy appended, is taken: earlier ones, and X-Real-IP from a proxy that
+// only appends X-Forwarded-For, come from the client and may be forged.
+// X-Real-IP is used only by a proxy that sends no X-Forwarded-For.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return ip
+	}
+	fwd := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	if i := strings.LastIndexByte(fwd, ','); i >= 0 {
+		fwd = fwd[i+1:]
+	}
+	if strings.TrimSpace(fwd) == "" {
+		fwd = r.Header.Get("X-Real-IP")
+	}
+	if p := net.ParseIP(strings.TrimSpace(fwd)); p != nil {
+		return p
+	}
+	return ip
+}
+
+// isTrusted reports whether ip may skip logging in.
+func (a *authManager) isTrusted(ip net.IP) bool {
+	if a.forceLogins && a.hasUsers() {
+		return false
+	}
+	return a.inTrusted(ip)
+}
+
+// inTrusted reports whether ip is in trusted_clients.
+func (a *authManager) inTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginRequired reports whether clients must log in whatever their
+// address.
+func (a *authManager) loginRequired() bool {
+	return a.enabled && a.forceLogins && a.hasUsers()
+}
+
+// authenticate returns the user a request is made as: from an API key, an
+// access token in the Authorization header or access_token parameter, a
+// oneshot token parameter, or a trusted client address. Other clients
+// are guests if guest mode is on.
+func (a *authManager) authenticate(r *http.Request) (string, error) {
+	if !a.enabled {
+		return trustedUser, nil
+	}
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		if a.checkAPIKey(key) {
+			return apiKeyUser, nil
+		}
+		return "", errUnauthorized
+	}
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token != "" {
+		return a.checkToken(token, "access")
+	}
+	if t := r.URL.Query().Get("token"); t != "" {
+		if user, ok := a.useOneshot(t); ok {
+			return user, nil
+		}
+		return "", errUnauthorized
+	}
+	if a.isTrusted(clientIP(r)) {
+		return trustedUser, nil
+	}
+	if a.guest {
+		return guestUser, nil
+	}
+	return "", errUnauthorized
+}
+
+type userKey struct{}
+
+// requestUser returns the user a request was authorized as.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// registerAccessHandlers sets up /access/* routes.
+func (s *Server) registerAccessHandlers() {
+	routes := map[string]string{
+		"POST /access/login":         "access.login",
+		"POST /access/logout":        "access.logout",
+		"POST /access/refresh_jwt":   "access.refresh_jwt",
+		"GET /access/user":           "access.get_user",
+		"POST /access/user":          "access.post_user",
+		"DELETE /access/user":        "access.delete_user",
+		"GET /access/users/list":     "access.users.list",
+		"POST /access/user/role":     "access.user.role",
+		"POST /access/user/password": "access.user.password",
+		"GET /access/api_key":        "access.get_api_key",
+		"POST /access/api_key":       "access.post_api_key",
+		"GET /access/oneshot_token":  "access.oneshot_token",
+		"GET /access/info":           "access.info",
+	}
+	for route, method := range routes {
+		method := method
+		s.mux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+			result, err := s.accessRequest(method, requestUser(r), clientIP(r), requestParams(r))
+			writeResult(w, result, err)
+		})
+	}
+}
+
+// accessRequest runs an access.* method for user, shared by the HTTP
+// routes and the WebSocket.
+func (s *Server) accessRequest(method, user string, ip net.IP, params map[string]interface{}) (interface{}, error) {
+	a := s.auth
+	str := func(key string) string {
+		v, _ := params[key].(string)
+		return v
+	}
+	// Pseudo-users have no account to log out of or change.
+	account := func() (authUser, error) {
+		u, ok := a.user(user)
+		if !ok {
+			return authUser{}, &apiError{http.StatusBadRequest, "no user is logged in"}
+		}
+		return u, nil
+	}
+
+	switch method {
+	case "access.info":
+		return map[string]interface{}{
+			"default_source":    "moonraker",
+			"available_sources": []string{"moonraker"},
+			"login_required":    a.loginRequired(),
+			"trusted":           !a.enabled || a.isTrusted(ip),
+		}, nil
+
+	case "access.login":
+		u, err := a.checkPassword(str("username"), str("password"))
+		if err != nil {
+			log.Printf("Failed login for %q from %s", str("username"), ip)
+			return nil, err
+		}
+		return map[string]interface{}{
+			"username":      u.Username,
+			"token":         issueToken(u, "access", accessTokenLife),
+			"refresh_token": issueToken(u, "refresh", refreshTokenLife),
+			"action":        "user_logged_in",
+			"source":        u.Source,
+		}, nil
+
+	case "access.refresh_jwt":
+		name, err := a.checkToken(str("refresh_token"), "refresh")
+		if err != nil {
+			return nil, err
+		}
+		u, _ := a.user(name)
+		return map[string]interface{}{
+			"username": u.Username,
+			"token":    issueToken(u, "access", accessTokenLife),
+			"source":   u.Source,
+			"action":   "user_jwt_refresh",
+		}, nil
+
+	case "access.logout":
+		if err := a.logout(user); err != nil {
+			return nil, err
+		}
+		s.wsHub.BroadcastNotification("notify_user_logged_out", []interface{}{
+			map[string]interface{}{"username": user},
+		})
+		return map[string]interface{}{"username": user, "action": "user_logged_out"}, nil
+
+	case "access.get_user":
+		if u, ok := a.user(user); ok {
+			return u.info(), nil
+		}
+		return map[string]interface{}{"username": user, "source": "moonraker", "created_on": 0}, nil
+
+	case "access.users.list":
+		return map[string]interface{}{"users": a.listUsers()}, nil
+
+	case "access.post_user":
+		u, err := a.createUser(str("username"), str("password"), str("role"))
+		if err != nil {
+			return nil, err
+		}
+		s.wsHub.BroadcastNotification("notify_user_created", []interface{}{
+			map[string]interface{}{"username": u.Username},
+		})
+		return map[string]interface{}{
+			"username":      u.Username,
+			"token":         issueToken(*u, "access", accessTokenLife),
+			"refresh_token": issueToken(*u, "refresh", refreshTokenLife),
+			"action":        "user_created",
+			"source":        u.Source,
+		}, nil
+
+	case "access.delete_user":
+		name := str("username")
+		if name == user {
+			return nil, &apiError{http.StatusBadRequest, "cannot delete the logged in user"}
+		}
+		u, err := a.deleteUser(name)
+		if err != nil {
+			return nil, err
+		}
+		s.wsHub.BroadcastNotification("notify_user_deleted", []interface{}{
+			map[string]interface{}{"username": u.Username},
+		})
+		return map[string]interface{}{"username": u.Username, "action": "user_deleted"}, nil
+
+	case "access.user.role":
+		name := str("username")
+		if name == user {
+			return nil, &apiError{http.StatusBadRequest, "cannot change the role of the logged in user"}
+		}
+		if err := a.setRole(name, str("role")); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"username": name, "role": str("role"), "action": "user_role_changed"}, nil
+
+	case "access.user.password":
+		u, err := account()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := a.checkPassword(u.Username, str("password")); err != nil {
+			return nil, err
+		}
+		if err := a.setPassword(u.Username, str("new_password")); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"username": u.Username, "action": "user_password_reset"}, nil
+
+	case "access.get_api_key":
+		return a.getAPIKey(), nil
+
+	case "access.post_api_key":
+		key, err := a.rotateAPIKey()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Auth: API key rotated by %s", user)
+		return key, nil
+
+	case "access.oneshot_token":
+		return a.newOneshot(user), nil
+	}
+	return nil, &apiError{http.StatusNotFound, "unknown method " + method}
+}
@@ -0,0 +1,198 @@
+package moonraker
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/john/snapmaker_moonraker/gcode"
+)
+
+// calibrationDir is where generated calibration prints are saved, under
+// the gcodes root.
+const calibrationDir = "calibration"
+
+// calibrationNumbers maps request parameters to the numeric fields of
+// gcode.CalibrationParams.
+var calibrationNumbers = map[string]func(p *gcode.CalibrationParams) *float64{
+	"nozzle_temp":     func(p *gcode.CalibrationParams) *float64 { return &p.NozzleTemp },
+	"bed_temp":        func(p *gcode.CalibrationParams) *float64 { return &p.BedTemp },
+	"nozzle_diameter": func(p *gcode.CalibrationParams) *float64 { return &p.NozzleDiameter },
+	"layer_height":    func(p *gcode.CalibrationParams) *float64 { return &p.LayerHeight },
+	"temp_start":      func(p *gcode.CalibrationParams) *float64 { return &p.TempStart },
+	"temp_end":        func(p *gcode.CalibrationParams) *float64 { return &p.TempEnd },
+	"temp_step":       func(p *gcode.CalibrationParams) *float64 { return &p.TempStep },
+	"retract_start":   func(p *gcode.CalibrationParams) *float64 { return &p.RetractStart },
+	"retract_end":     func(p *gcode.CalibrationParams) *float64 { return &p.RetractEnd },
+	"retract_step":    func(p *gcode.CalibrationParams) *float64 { return &p.RetractStep },
+	"flow":            func(p *gcode.CalibrationParams) *float64 { return &p.Flow },
+}
+
+// calibrationParams builds calibration print parameters from a request:
+//
+//	kind:      idex_offset, temp_tower, flow_cube, retraction_tower or
+//	           first_layer (required).
+//	tool:      head to print with (default 0).
+//	material:  PLA, PETG, ABS, ASA, TPU or PA pick default temperatures;
+//	           other materials need nozzle_temp and bed_temp.
+//	nozzle_temp, bed_temp, nozzle_diameter, layer_height: print settings.
+//	temp_start, temp_end, temp_step: temperature tower range.
+//	retract_start, retract_end, retract_step: retraction tower range, mm.
+//	flow:      flow cube extrusion multiplier.
+//
+// Numbers may be given as strings, as the console command passes them.
+func calibrationParams(params map[string]interface{}) (gcode.CalibrationParams, error) {
+	var p gcode.CalibrationParams
+	p.Kind, _ = params["kind"].(string)
+	p.Kind = strings.ToLower(strings.TrimSpace(p.Kind))
+	if p.Kind == "" {
+		return p, fmt.Errorf("kind is required (%s)", strings.Join(gcode.CalibrationKinds, ", "))
+	}
+	p.Material, _ = params["material"].(string)
+
+	if _, ok := params["tool"]; ok {
+		tool, err := numberParam(params, "tool")
+		if err != nil {
+			return p, err
+		}
+		p.Tool = int(tool)
+	}
+	for key, field := range calibrationNumbers {
+		if _, ok := params[key]; !ok {
+			continue
+		}
+		v, err := numberParam(params, key)
+		if err != nil {
+			return p, err
+		}
+		*field(&p) = v
+	}
+	return p, nil
+}
+
+// numberParam reads a number given as a JSON number or a string.
+func numberParam(params map[string]interface{}, key string) (float64, error) {
+	switch v := params[key].(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %q is not a number", key, v)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("%s: expected a number", key)
+}
+
+// generateCalibration writes the calibration print params describe into
+// the gcodes root and, if params has print set, starts it.
+func (s *Server) generateCalibration(params map[string]interface{}) (map[string]interface{}, error) {
+	p, err := calibrationParams(params)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	p.Defaults()
+	if err := p.Check(gcode.ProfileForModel(s.config.Printer.Model)); err != nil {
+		return nil, badRequest(err)
+	}
+
+	filename := path.Join(calibrationDir, p.FileName())
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(gcode.GenerateCalibration(pw, s.config.Printer.Model, p))
+	}()
+	size, err := s.fileManager.SaveFromReader("gcodes", filename, pr)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("writing %s: %w", filename, err)
+	}
+	log.Printf("Generated calibration print %s (%d bytes)", filename, size)
+
+	modTime := float64(time.Now().UnixNano()) / 1e9
+	if info, err := s.fileManager.StatFile("gcodes", filename); err == nil {
+		modTime = float64(info.ModTime().UnixNano()) / 1e9
+	}
+	item := map[string]interface{}{
+		"root":     "gcodes",
+		"path":     filename,
+		"modified": modTime,
+		"size":     size,
+	}
+	s.wsHub.BroadcastNotification("notify_filelist_changed", []interface{}{
+		map[string]interface{}{"action": "create_file", "item": item},
+	})
+
+	srcPath := s.fileManager.FilePath("gcodes", filename)
+	printing := false
+	switch v := params["print"].(type) {
+	case bool:
+		printing = v
+	case string:
+		printing, _ = strconv.ParseBool(v)
+	}
+	if printing {
+		opts, err := s.printOptions(params)
+		if err == nil {
+			err = s.preflightCheck(filename, srcPath, opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := s.startPrint(filename, srcPath, opts); err != nil {
+				log.Printf("Error starting calibration print: %v", err)
+			}
+		}()
+	} else {
+		s.queuePreprocess(srcPath, nil)
+	}
+
+	return map[string]interface{}{
+		"item":          item,
+		"action":        "create_file",
+		"print_started": printing,
+	}, nil
+}
+
+// handleCalibration handles POST /server/files/calibration with the
+// parameters of calibrationParams and an optional print flag.
+func (s *Server) handleCalibration(w http.ResponseWriter, r *http.Request) {
+	result, err := s.generateCalibration(requestParams(r))
+	writeResult(w, result, err)
+}
+
+// handleCalibrate handles the CALIBRATE console command, e.g.
+// CALIBRATE KIND=temp_tower MATERIAL=PETG TOOL=1 PRINT=1. Parameters are
+// those of the API, upper-cased.
+func (s *Server) handleCalibrate(script string) (bool, error) {
+	params := make(map[string]interface{})
+	for _, field := range strings.Fields(script)[1:] {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			params[strings.ToLower(k)] = v
+		}
+	}
+	if _, ok := params["kind"]; !ok {
+		s.wsHub.BroadcastGCodeResponse("// CALIBRATE KIND=" + strings.Join(gcode.CalibrationKinds, "|") +
+			" [TOOL=n] [MATERIAL=PLA] [NOZZLE_TEMP=] [BED_TEMP=] [PRINT=1]")
+		return true, nil
+	}
+	result, err := s.generateCalibration(params)
+	if err != nil {
+		return true, fmt.Errorf("CALIBRATE: %w", err)
+	}
+	item := result["item"].(map[string]interface{})
+	msg := fmt.Sprintf("// Wrote %s", item["path"])
+	if result["print_started"].(bool) {
+		msg += ", starting print"
+	}
+	s.wsHub.BroadcastGCodeResponse(msg)
+	return true, nil
+}
@@ -0,0 +1,224 @@
+package moonraker
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// lastConnectionID numbers WebSocket connections, unique while the bridge
+// runs.
+var lastConnectionID atomic.Int64
+
+// wsClientTypes are the client types server.connection.identify accepts.
+var wsClientTypes = map[string]bool{
+	"web": true, "mobile": true, "desktop": true, "display": true,
+	"bot": true, "agent": true, "other": true,
+}
+
+// wsIdentity is what a client reports with server.connection.identify.
+type wsIdentity struct {
+	ClientName string `json:"client_name"`
+	Version    string `json:"version"`
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+}
+
+// identify records the identity a client reports and authorizes it from
+// an access_token or api_key, if given. A connection identifies once.
+func (h *WSHub) identify(c *WSClient, params interface{}) (interface{}, error) {
+	id := wsIdentity{
+		ClientName: extractStringParam(params, "client_name"),
+		Version:    extractStringParam(params, "version"),
+		Type:       strings.ToLower(extractStringParam(params, "type")),
+		URL:        extractStringParam(params, "url"),
+	}
+	if id.ClientName == "" {
+		return nil, &apiError{http.StatusBadRequest, "client_name is required"}
+	}
+	if id.Type == "" {
+		id.Type = "other"
+	}
+	if !wsClientTypes[id.Type] {
+		return nil, &apiError{http.StatusBadRequest, fmt.Sprintf("invalid client type %q", id.Type)}
+	}
+	user, err := h.identifyUser(params)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if c.identity != nil {
+		h.mu.Unlock()
+		return nil, &apiError{http.StatusBadRequest, "connection already identified"}
+	}
+	c.identity = &id
+	if user != "" {
+		c.user = user
+	}
+	h.mu.Unlock()
+	log.Printf("WebSocket %d identified as %s %s (%s)", c.id, id.ClientName, id.Version, id.Type)
+
+	if id.Type == "agent" {
+		h.BroadcastNotification("notify_agent_event", []interface{}{
+			map[string]interface{}{"agent": id.ClientName, "event": "connected", "data": id},
+		})
+	}
+	return map[string]interface{}{"connection_id": c.id}, nil
+}
+
+// connectionInfo describes a connection; must hold h.mu.
+func (h *WSHub) connectionInfo(c *WSClient) map[string]interface{} {
+	addr := "unix"
+	if c.sock == nil {
+		addr = c.ip.String()
+	}
+	info := map[string]interface{}{
+		"connection_id":  c.id,
+		"remote_address": addr,
+		"connected_at":   float64(c.connected.UnixNano()) / 1e9,
+		"identified":     c.identity != nil,
+	}
+	if c.identity != nil {
+		info["client_name"] = c.identity.ClientName
+		info["version"] = c.identity.Version
+		info["type"] = c.identity.Type
+		info["url"] = c.identity.URL
+	}
+	methods := []string{}
+	for name, owner := range h.remoteMethods {
+		if owner == c {
+			methods = append(methods, name)
+		}
+	}
+	sort.Strings(methods)
+	info["remote_methods"] = methods
+	info["queue"] = c.queueInfo()
+	return info
+}
+
+// connectionList describes every connection, oldest first.
+func (h *WSHub) connectionList() map[string]interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]map[string]interface{}, 0, len(h.clients))
+	for c := range h.clients {
+		list = append(list, h.connectionInfo(c))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["connection_id"].(int64) < list[j]["connection_id"].(int64)
+	})
+	return map[string]interface{}{"connections": list}
+}
+
+// registerRemoteMethod lets c serve method: calls to it, from other
+// clients or the CALL_REMOTE_METHOD command, are sent to c as a
+// notification of that name. A method has one owner until it
+// disconnects.
+func (h *WSHub) registerRemoteMethod(c *WSClient, method string) error {
+	if method == "" {
+		return &apiError{http.StatusBadRequest, "method_name is required"}
+	}
+	if _, builtin := methodRoles[method]; builtin {
+		return &apiError{http.StatusBadRequest, method + " is a server method"}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if owner, ok := h.remoteMethods[method]; ok && owner != c {
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("remote method %s is already registered by connection %d", method, owner.id)}
+	}
+	h.remoteMethods[method] = c
+	log.Printf("WebSocket %d registered remote method %s", c.id, method)
+	return nil
+}
+
+func (h *WSHub) remoteMethodOwner(method string) *WSClient {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.remoteMethods[method]
+}
+
+// callRemoteMethod invokes a registered remote method with params.
+func (h *WSHub) callRemoteMethod(method string, params interface{}) error {
+	owner := h.remoteMethodOwner(method)
+	if owner == nil {
+		return fmt.Errorf("no remote method %s", method)
+	}
+	return owner.send(jsonRPCNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// sendAgentEvent rebroadcasts an event from an agent connection as
+// notify_agent_event.
+func (h *WSHub) sendAgentEvent(c *WSClient, params interface{}) error {
+	h.mu.RLock()
+	id := c.identity
+	h.mu.RUnlock()
+	if id == nil || id.Type != "agent" {
+		return &apiError{http.StatusBadRequest, "only agent connections may send events"}
+	}
+	event := extractStringParam(params, "event")
+	if event == "" {
+		return &apiError{http.StatusBadRequest, "event is required"}
+	}
+	var data interface{}
+	if p, ok := params.(map[string]interface{}); ok {
+		data = p["data"]
+	}
+	h.BroadcastNotification("notify_agent_event", []interface{}{
+		map[string]interface{}{"agent": id.ClientName, "event": event, "data": data},
+	})
+	return nil
+}
+
+// dropConnection forgets a closed connection's remote methods and tells
+// clients when an agent leaves.
+func (h *WSHub) dropConnection(c *WSClient) {
+	h.mu.Lock()
+	for name, owner := range h.remoteMethods {
+		if owner == c {
+			delete(h.remoteMethods, name)
+		}
+	}
+	id := c.identity
+	h.mu.Unlock()
+	if id != nil && id.Type == "agent" {
+		h.BroadcastNotification("notify_agent_event", []interface{}{
+			map[string]interface{}{"agent": id.ClientName, "event": "disconnected", "data": id},
+		})
+	}
+	log.Printf("WebSocket %d closed after %s", c.id, time.Since(c.connected).Round(time.Second))
+}
+
+// handleCallRemoteMethod handles the CALL_REMOTE_METHOD console command,
+// e.g. CALL_REMOTE_METHOD METHOD=spoolman_set_active_spool SPOOL_ID=3.
+// Other parameters are passed to the method with lower-case names.
+func (s *Server) handleCallRemoteMethod(script string) (bool, error) {
+	method := ""
+	params := make(map[string]interface{})
+	for _, field := range strings.Fields(script)[1:] {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(k, "METHOD") {
+			method = v
+		} else {
+			params[strings.ToLower(k)] = v
+		}
+	}
+	if method == "" {
+		return true, fmt.Errorf("CALL_REMOTE_METHOD: METHOD is required")
+	}
+	if err := s.wsHub.callRemoteMethod(method, params); err != nil {
+		return true, fmt.Errorf("CALL_REMOTE_METHOD: %w", err)
+	}
+	return true, nil
+}
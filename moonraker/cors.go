@@ -0,0 +1,75 @@
+package moonraker
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// compileCORSDomain turns a cors_domains entry such as "*.local" or
+// "http://*.lan:*" into a pattern matched against the whole Origin
+// header; "*" matches any run of characters.
+func compileCORSDomain(domain string) *regexp.Regexp {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), "/")
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(domain), `\*`, ".*")
+	return regexp.MustCompile("(?i)^" + pattern + "$")
+}
+
+// allowedOrigin reports whether a page served from origin may use the
+// API: the bridge's own origin, an origin matching cors_domains, or one
+// whose host is a trusted client address.
+func (s *Server) allowedOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // includes "null", sent by sandboxed and file pages
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, d := range s.corsDomains {
+		if d.MatchString(origin) {
+			return true
+		}
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && s.auth.inTrusted(ip)
+}
+
+// checkOrigin is the WebSocket upgrader's origin check.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.allowedOrigin(r, origin) {
+		return true
+	}
+	log.Printf("Rejected WebSocket from origin %s (%s)", origin, clientIP(r))
+	return false
+}
+
+// corsMiddleware answers cross-origin requests from allowed origins,
+// echoing the origin back, and refuses the rest outright: a browser would
+// still send a simple POST from any page it was told to.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !s.allowedOrigin(r, origin) {
+				log.Printf("Rejected %s %s from origin %s (%s)", r.Method, r.URL.Path, origin, clientIP(r))
+				writeJSONError(w, http.StatusForbidden, "Origin not allowed: "+origin)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Api-Key, Authorization")
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package moonraker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/john/snapmaker_moonraker/files"
+)
+
+// apiError is a request failure with the status Moonraker reports for it:
+// the HTTP status of a failed request, and the error code of a JSON-RPC
+// response, as Moonraker uses the same codes for both. Other errors are
+// reported as 500.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+var errUnauthorized = &apiError{http.StatusUnauthorized, "Unauthorized"}
+
+// JSON-RPC protocol error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+)
+
+// badRequest reports err as a problem with the request.
+func badRequest(err error) error {
+	return &apiError{http.StatusBadRequest, err.Error()}
+}
+
+// notFound reports err as a missing file, job or other resource.
+func notFound(err error) error {
+	return &apiError{http.StatusNotFound, err.Error()}
+}
+
+// fileError classifies a file manager error for the requested path: 404
+// for a missing file, 400 for a path outside the roots, 500 for anything
+// else.
+func fileError(path string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &apiError{http.StatusNotFound, "file not found: " + path}
+	case errors.Is(err, files.ErrInvalidPath):
+		return &apiError{http.StatusBadRequest, "invalid path: " + path}
+	}
+	return err
+}
+
+// errStatus returns the status for err.
+func errStatus(err error) int {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return ae.status
+	}
+	return http.StatusInternalServerError
+}
+
+// newRPCError converts err for a JSON-RPC response.
+func newRPCError(err error) *rpcError {
+	return &rpcError{Code: errStatus(err), Message: err.Error()}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+		},
+	})
+}
+
+// writeError writes err as Moonraker's error body, with its status.
+func writeError(w http.ResponseWriter, err error) {
+	writeJSONError(w, errStatus(err), err.Error())
+}
+
+// writeResult writes result as a response, or err if it isn't nil.
+func writeResult(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"result": result,
+	})
+}
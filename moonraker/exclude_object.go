@@ -0,0 +1,168 @@
+package moonraker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/john/snapmaker_moonraker/gcode"
+)
+
+// printJob is a print the bridge started, kept so it can be restarted with
+// more objects excluded.
+type printJob struct {
+	filename string
+	srcPath  string
+	opts     gcode.Options
+}
+
+// The Snapmaker firmware can't skip part of a file it is already printing,
+// so excluding an object mid-print pauses the print, stops it at the line it
+// reached, and starts the rest of the file again with the object left out
+// (see gcode.Options.ResumeOffset). These bound the waits for the printer to
+// get through each step.
+const (
+	excludePauseTimeout = 3 * time.Minute
+	excludeStopTimeout  = 1 * time.Minute
+)
+
+// handleExcludeObject handles EXCLUDE_OBJECT NAME=<name> and CURRENT=1;
+// without either it lists the excluded objects, as Klipper does.
+func (s *Server) handleExcludeObject(script string) (bool, error) {
+	state := s.state.Snapshot()
+	if extractKlipperParam(script, "RESET") != "" {
+		return true, fmt.Errorf("EXCLUDE_OBJECT: RESET is not supported, excluded objects are already left out of the file on the printer")
+	}
+
+	name := strings.ToUpper(extractKlipperParam(script, "NAME"))
+	if extractKlipperParam(script, "CURRENT") == "1" {
+		name = state.CurrentObject
+		if name == "" {
+			return true, fmt.Errorf("EXCLUDE_OBJECT: no object is being printed")
+		}
+	}
+	if name == "" {
+		s.wsHub.BroadcastGCodeResponse("// Excluded objects: " + strings.Join(state.ExcludedObjects, " "))
+		return true, nil
+	}
+
+	if state.PrinterState != "printing" && state.PrinterState != "paused" {
+		return true, fmt.Errorf("EXCLUDE_OBJECT: no print in progress")
+	}
+	if err := gcode.CheckExcludeObjects(state.Objects, []string{name}); err != nil {
+		return true, fmt.Errorf("EXCLUDE_OBJECT: %w", err)
+	}
+	for _, n := range state.ExcludedObjects {
+		if n == name {
+			return true, nil
+		}
+	}
+
+	if s.printerClient.Streaming() {
+		// A streamed print leaves the object out as it sends the file.
+		if err := s.printerClient.StreamExcludeObject(name); err != nil {
+			return true, fmt.Errorf("EXCLUDE_OBJECT: %w", err)
+		}
+		s.wsHub.BroadcastGCodeResponse("// Excluded " + name)
+		return true, nil
+	}
+
+	idx, srcPath := s.printerClient.PrintIndex()
+	s.jobMu.Lock()
+	job := s.job
+	if idx == nil || job == nil || job.srcPath != srcPath {
+		s.jobMu.Unlock()
+		return true, fmt.Errorf("EXCLUDE_OBJECT: only prints started from the bridge can exclude objects")
+	}
+	if s.excluding {
+		s.jobMu.Unlock()
+		return true, fmt.Errorf("EXCLUDE_OBJECT: another object is being excluded")
+	}
+	s.excluding = true
+	s.jobMu.Unlock()
+
+	go s.excludeMidPrint(*job, idx, name)
+	return true, nil
+}
+
+// handleExcludeObjectDefine lists the objects of the current print, like
+// EXCLUDE_OBJECT_DEFINE without parameters in Klipper.
+func (s *Server) handleExcludeObjectDefine() (bool, error) {
+	state := s.state.Snapshot()
+	names := make([]string, len(state.Objects))
+	for i, o := range state.Objects {
+		names[i] = o.Name
+	}
+	s.wsHub.BroadcastGCodeResponse("// Known objects: " + strings.Join(names, " "))
+	return true, nil
+}
+
+// excludeMidPrint restarts the running job from where it is with one more
+// object excluded.
+func (s *Server) excludeMidPrint(job printJob, idx *gcode.PrintIndex, name string) {
+	defer func() {
+		s.jobMu.Lock()
+		s.excluding = false
+		s.jobMu.Unlock()
+	}()
+	respond := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("Exclude object: %s", msg)
+		s.wsHub.BroadcastGCodeResponse("// " + msg)
+	}
+	fail := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("Exclude object: %s", msg)
+		s.wsHub.BroadcastGCodeResponse("!! " + msg)
+	}
+
+	respond("Excluding %s: pausing print", name)
+	if s.state.Snapshot().PrinterState != "paused" {
+		if err := s.printerClient.PausePrint(); err != nil {
+			fail("Pause failed: %v", err)
+			return
+		}
+		if !s.waitForPrinterState("paused", excludePauseTimeout) {
+			fail("Printer did not pause, %s is still printed", name)
+			return
+		}
+	}
+
+	offset := idx.FilePosition(s.printerClient.CurrentLine())
+	respond("Excluding %s: restarting from byte %d of %s", name, offset, job.filename)
+	if err := s.printerClient.StopPrint(); err != nil {
+		fail("Stop failed: %v", err)
+		return
+	}
+	if !s.waitForPrinterState("idle", excludeStopTimeout) {
+		fail("Printer did not stop, the print is paused")
+		return
+	}
+
+	opts := job.opts
+	opts.ExcludeObjects = append(append([]string{}, opts.ExcludeObjects...), name)
+	opts.ResumeOffset = offset
+	if err := s.sendPrint(job.filename, job.srcPath, opts); err != nil {
+		fail("Restarting %s failed: %v", job.filename, err)
+		return
+	}
+	// Filament tracking is by line and doesn't carry over to the restarted
+	// part, so it is not restarted.
+	s.jobMu.Lock()
+	s.job = &printJob{filename: job.filename, srcPath: job.srcPath, opts: opts}
+	s.jobMu.Unlock()
+	respond("Excluded %s", name)
+}
+
+// waitForPrinterState polls the printer state until it reads want.
+func (s *Server) waitForPrinterState(want string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s.state.Snapshot().PrinterState == want {
+			return true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return false
+}
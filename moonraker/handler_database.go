@@ -16,7 +16,7 @@ func (s *Server) registerDatabaseHandlers() {
 }
 
 func (s *Server) handleDatabaseList(w http.ResponseWriter, r *http.Request) {
-	namespaces := s.database.ListNamespaces()
+	namespaces := s.databaseNamespaces()
 	writeJSON(w, map[string]interface{}{
 		"result": map[string]interface{}{
 			"namespaces": namespaces,
@@ -28,8 +28,8 @@ func (s *Server) handleDatabaseGetItem(w http.ResponseWriter, r *http.Request) {
 	namespace := r.URL.Query().Get("namespace")
 	key := r.URL.Query().Get("key")
 
-	if namespace == "" {
-		writeJSONError(w, http.StatusBadRequest, "namespace is required")
+	if err := checkNamespace(namespace); err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -123,8 +123,8 @@ func (s *Server) handleDatabasePostItem(w http.ResponseWriter, r *http.Request)
 		key = v
 	}
 
-	if namespace == "" {
-		writeJSONError(w, http.StatusBadRequest, "namespace is required")
+	if err := checkNamespace(namespace); err != nil {
+		writeError(w, err)
 		return
 	}
 	if key == "" {
@@ -150,8 +150,8 @@ func (s *Server) handleDatabaseDeleteItem(w http.ResponseWriter, r *http.Request
 	namespace := r.URL.Query().Get("namespace")
 	key := r.URL.Query().Get("key")
 
-	if namespace == "" {
-		writeJSONError(w, http.StatusBadRequest, "namespace is required")
+	if err := checkNamespace(namespace); err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -177,21 +177,50 @@ func (s *Server) handleDatabaseDeleteItem(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// checkNamespace returns an error unless the database API may use
+// namespace.
+func checkNamespace(namespace string) error {
+	if namespace == "" {
+		return &apiError{http.StatusBadRequest, "namespace is required"}
+	}
+	if protectedNamespace(namespace) {
+		return &apiError{http.StatusForbidden, "namespace " + namespace + " is reserved"}
+	}
+	return nil
+}
+
+// protectedNamespace reports whether namespace is kept from the database
+// API: it holds user accounts and the API key.
+func protectedNamespace(namespace string) bool {
+	return namespace == authNamespace
+}
+
+// databaseNamespaces lists the namespaces the database API may use.
+func (s *Server) databaseNamespaces() []string {
+	namespaces := []string{}
+	for _, ns := range s.database.ListNamespaces() {
+		if !protectedNamespace(ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
 // Database JSON-RPC handlers for WebSocket
 
 func (h *WSHub) handleDatabaseList() interface{} {
-	namespaces := h.server.database.ListNamespaces()
+	namespaces := h.server.databaseNamespaces()
 	return map[string]interface{}{
 		"namespaces": namespaces,
 	}
 }
 
-func (h *WSHub) handleDatabaseGetItem(params interface{}) interface{} {
+func (h *WSHub) handleDatabaseGetItem(params interface{}) (interface{}, error) {
 	namespace := extractStringParam(params, "namespace")
 	key := extractStringParam(params, "key")
 
-	if namespace == "" {
-		return map[string]interface{}{"error": "namespace is required"}
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
 	}
 
 	if key == "" {
@@ -202,7 +231,7 @@ func (h *WSHub) handleDatabaseGetItem(params interface{}) interface{} {
 		return map[string]interface{}{
 			"namespace": namespace,
 			"value":     ns,
-		}
+		}, nil
 	}
 
 	value, _ := h.server.database.GetItem(namespace, key)
@@ -210,15 +239,18 @@ func (h *WSHub) handleDatabaseGetItem(params interface{}) interface{} {
 		"namespace": namespace,
 		"key":       key,
 		"value":     value,
-	}
+	}, nil
 }
 
-func (h *WSHub) handleDatabasePostItem(params interface{}) interface{} {
+func (h *WSHub) handleDatabasePostItem(params interface{}) (interface{}, error) {
 	namespace := extractStringParam(params, "namespace")
 	key := extractStringParam(params, "key")
 
-	if namespace == "" || key == "" {
-		return map[string]interface{}{"error": "namespace and key are required"}
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, &apiError{http.StatusBadRequest, "key is required"}
 	}
 
 	var value interface{}
@@ -227,43 +259,37 @@ func (h *WSHub) handleDatabasePostItem(params interface{}) interface{} {
 	}
 
 	if err := h.server.database.SetItem(namespace, key, value); err != nil {
-		return map[string]interface{}{"error": err.Error()}
+		return nil, err
 	}
 
 	return map[string]interface{}{
 		"namespace": namespace,
 		"key":       key,
 		"value":     value,
-	}
+	}, nil
 }
 
-func (h *WSHub) handleDatabaseDeleteItem(params interface{}) interface{} {
+func (h *WSHub) handleDatabaseDeleteItem(params interface{}) (interface{}, error) {
 	namespace := extractStringParam(params, "namespace")
 	key := extractStringParam(params, "key")
 
-	if namespace == "" || key == "" {
-		return map[string]interface{}{"error": "namespace and key are required"}
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, &apiError{http.StatusBadRequest, "key is required"}
 	}
 
 	value, _ := h.server.database.GetItem(namespace, key)
-	h.server.database.DeleteItem(namespace, key)
+	if err := h.server.database.DeleteItem(namespace, key); err != nil {
+		return nil, err
+	}
 
 	return map[string]interface{}{
 		"namespace": namespace,
 		"key":       key,
 		"value":     value,
-	}
-}
-
-func writeJSONError(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]interface{}{
-			"code":    status,
-			"message": message,
-		},
-	})
+	}, nil
 }
 
 // extractStringParam now handles nested keys via dot notation
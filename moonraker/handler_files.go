@@ -9,6 +9,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/john/snapmaker_moonraker/gcode"
 )
 
 // registerFileHandlers sets up /server/files/* routes.
@@ -23,6 +25,10 @@ func (s *Server) registerFileHandlers() {
 	s.mux.HandleFunc("DELETE /server/files/{root}/{path...}", s.handleFileDelete)
 	s.mux.HandleFunc("GET /server/files/{root}/{path...}", s.handleFileDownload)
 	s.mux.HandleFunc("GET /server/files/roots", s.handleFileRoots)
+	s.mux.HandleFunc("GET /server/files/validate", s.handleFileValidate)
+	s.mux.HandleFunc("POST /server/files/validate", s.handleFileValidate)
+	s.mux.HandleFunc("GET /server/files/objects", s.handleFileObjects)
+	s.mux.HandleFunc("POST /server/files/calibration", s.handleCalibration)
 }
 
 func (s *Server) handleFileList(w http.ResponseWriter, r *http.Request) {
@@ -30,6 +36,10 @@ func (s *Server) handleFileList(w http.ResponseWriter, r *http.Request) {
 	if root == "" {
 		root = "gcodes"
 	}
+	if err := s.permitPath(requestUser(r), s.fileManager.GetRootPath(root)); err != nil {
+		writeError(w, err)
+		return
+	}
 
 	files := s.fileManager.ListFiles(root)
 
@@ -54,6 +64,10 @@ func (s *Server) handleFileDirectory(w http.ResponseWriter, r *http.Request) {
 		path = strings.TrimPrefix(path, "gcodes")
 		path = strings.TrimPrefix(path, "/")
 	}
+	if err := s.permitPath(requestUser(r), s.fileManager.FilePath(root, path)); err != nil {
+		writeError(w, err)
+		return
+	}
 
 	writeJSON(w, map[string]interface{}{
 		"result": s.fileManager.GetDirectory(root, path),
@@ -61,37 +75,28 @@ func (s *Server) handleFileDirectory(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleFileMetadata(w http.ResponseWriter, r *http.Request) {
-	filename := r.URL.Query().Get("filename")
+	result, err := s.fileMetadata(r.URL.Query().Get("filename"))
+	writeResult(w, result, err)
+}
+
+func (s *Server) fileMetadata(filename string) (map[string]interface{}, error) {
 	if filename == "" {
-		writeJSON(w, map[string]interface{}{
-			"result": map[string]interface{}{
-				"filename": "",
-				"size":     0,
-				"modified": float64(0),
-			},
-		})
-		return
+		return nil, &apiError{http.StatusBadRequest, "filename is required"}
 	}
 
 	meta, err := s.fileManager.GetMetadata("gcodes", filename)
 	if err != nil {
 		// Return minimal metadata stub for files not in local storage
 		// (e.g. prints started from the printer's touchscreen).
-		writeJSON(w, map[string]interface{}{
-			"result": map[string]interface{}{
-				"filename": filename,
-				"size":     0,
-				"modified": float64(0),
-			},
-		})
-		return
+		return map[string]interface{}{
+			"filename": filename,
+			"size":     0,
+			"modified": float64(0),
+		}, nil
 	}
 
 	s.enrichMetadataFromHistory(filename, meta)
-
-	writeJSON(w, map[string]interface{}{
-		"result": meta,
-	})
+	return meta, nil
 }
 
 func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
@@ -100,13 +105,14 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	// loaded a 512 MB upload into RAM and OOM-killed the bridge on the Pi.
 	mr, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "failed to parse multipart form", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "failed to parse multipart form")
 		return
 	}
 
 	root := "gcodes"
 	subdir := ""
 	startPrint := false
+	printParams := make(map[string]interface{})
 	var filename string
 	var size int64
 	saved := false
@@ -117,7 +123,7 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		if err != nil {
-			http.Error(w, "failed reading part", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "failed reading part")
 			return
 		}
 
@@ -133,19 +139,28 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 		case "print":
 			b, _ := io.ReadAll(io.LimitReader(part, 16))
 			startPrint = strings.TrimSpace(string(b)) == "true"
+		case "transforms", "idex_mode", "tool_map", "exclude_objects", "pause_at":
+			// Print options, same as printer.print.start.
+			b, _ := io.ReadAll(io.LimitReader(part, 4096))
+			printParams[part.FormName()] = strings.TrimSpace(string(b))
 		case "file":
 			if part.FileName() == "" {
-				http.Error(w, "missing file name", http.StatusBadRequest)
+				writeJSONError(w, http.StatusBadRequest, "missing file name")
 				return
 			}
 			filename = part.FileName()
 			if subdir != "" {
 				filename = subdir + "/" + filename
 			}
+			// The root comes in the form, so only now can it be checked.
+			if err := s.permitPath(requestUser(r), s.fileManager.FilePath(root, filename)); err != nil {
+				writeError(w, err)
+				return
+			}
 			n, err := s.fileManager.SaveFromReader(root, filename, part)
 			if err != nil {
 				log.Printf("Failed to save file %s/%s: %v", root, filename, err)
-				http.Error(w, "failed to save file", http.StatusInternalServerError)
+				writeJSONError(w, http.StatusInternalServerError, "failed to save file")
 				return
 			}
 			size = n
@@ -155,7 +170,7 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !saved {
-		http.Error(w, "missing file field", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "missing file field")
 		return
 	}
 
@@ -171,13 +186,25 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	if startPrint && root == "gcodes" {
 		log.Printf("Upload and print requested for %s", filename)
 		srcPath := s.fileManager.FilePath("gcodes", filename)
-		go func() {
-			if err := s.printerClient.Upload(filename, srcPath); err != nil {
-				log.Printf("Error uploading to printer: %v", err)
-				return
-			}
-			s.StartSpoolmanTracking(filename)
-		}()
+		opts, err := s.printOptions(printParams)
+		if err == nil {
+			err = s.preflightCheck(filename, srcPath, opts)
+		}
+		if err != nil {
+			// The file is kept; only the print is refused.
+			log.Printf("Not starting print of %s: %v", filename, err)
+			startPrint = false
+		} else {
+			go func() {
+				if err := s.startPrint(filename, srcPath, opts); err != nil {
+					log.Printf("Error uploading to printer: %v", err)
+				}
+			}()
+		}
+	}
+	// Have the file ready to print later, with the options it came with.
+	if !startPrint && root == "gcodes" {
+		s.queuePreprocess(s.fileManager.FilePath(root, filename), printParams)
 	}
 
 	// Notify WebSocket clients.
@@ -201,11 +228,84 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 				"modified": modTime,
 				"size":     size,
 			},
-			"action": "create_file",
+			"action":        "create_file",
+			"print_started": startPrint && root == "gcodes",
 		},
 	})
 }
 
+// handleFileValidate runs the pre-flight checks on a gcode file without
+// printing it. Takes the filename and the same print options as
+// printer.print.start, from the query string or a JSON body.
+func (s *Server) handleFileValidate(w http.ResponseWriter, r *http.Request) {
+	params := requestParams(r)
+	filename, _ := params["filename"].(string)
+	if filename == "" {
+		writeJSONError(w, http.StatusBadRequest, "filename is required")
+		return
+	}
+	opts, err := s.printOptions(params)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := s.validateFile(filename, opts)
+	writeResult(w, result, err)
+}
+
+// validateFile validates a file in the gcodes root against the configured
+// printer model, the toolheads the printer currently reports, and the
+// print options it would be started with.
+func (s *Server) validateFile(filename string, opts gcode.Options) (map[string]interface{}, error) {
+	if _, err := s.fileManager.StatFile("gcodes", filename); err != nil {
+		return nil, notFound(fmt.Errorf("file not found: %s", filename))
+	}
+	srcPath := s.fileManager.FilePath("gcodes", filename)
+
+	report, err := gcode.Validate(srcPath, s.validateOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"filename": filename,
+		"valid":    !report.HasErrors(),
+		"errors":   report.Errors,
+		"warnings": report.Warnings,
+	}, nil
+}
+
+// handleFileObjects lists the labelled objects of a file, which can be
+// passed as exclude_objects when starting it.
+func (s *Server) handleFileObjects(w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		writeJSONError(w, http.StatusBadRequest, "filename is required")
+		return
+	}
+	result, err := s.fileObjects(filename)
+	writeResult(w, result, err)
+}
+
+// fileObjects scans a file in the gcodes root for labelled objects.
+func (s *Server) fileObjects(filename string) (map[string]interface{}, error) {
+	if _, err := s.fileManager.StatFile("gcodes", filename); err != nil {
+		return nil, notFound(fmt.Errorf("file not found: %s", filename))
+	}
+	objects, err := gcode.ScanObjects(s.fileManager.FilePath("gcodes", filename))
+	if err != nil {
+		return nil, err
+	}
+	if objects == nil {
+		objects = []gcode.Object{}
+	}
+	return map[string]interface{}{
+		"filename": filename,
+		"objects":  objects,
+	}, nil
+}
+
 func (s *Server) handleCreateDirectory(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 	if path == "" {
@@ -213,9 +313,15 @@ func (s *Server) handleCreateDirectory(w http.ResponseWriter, r *http.Request) {
 			path = r.FormValue("path")
 		}
 	}
+	result, err := s.createDirectory(requestUser(r), path)
+	writeResult(w, result, err)
+}
+
+// createDirectory creates a directory in the gcodes root for user, given
+// as "gcodes/subdir" or "subdir".
+func (s *Server) createDirectory(user, path string) (map[string]interface{}, error) {
 	if path == "" {
-		http.Error(w, "missing path parameter", http.StatusBadRequest)
-		return
+		return nil, &apiError{http.StatusBadRequest, "path is required"}
 	}
 
 	// Extract root from path (e.g., "gcodes/subdir" -> root="gcodes", dir="subdir")
@@ -226,43 +332,28 @@ func (s *Server) handleCreateDirectory(w http.ResponseWriter, r *http.Request) {
 	} else if path == "gcodes" {
 		dirPath = ""
 	}
+	if err := s.permitPath(user, s.fileManager.FilePath(root, dirPath)); err != nil {
+		return nil, err
+	}
 
 	if err := s.fileManager.CreateDirectory(root, dirPath); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    500,
-				"message": err.Error(),
-			},
-		})
-		return
+		return nil, fileError(path, err)
 	}
-
-	s.wsHub.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "create_dir",
-			"item": map[string]interface{}{
-				"root": root,
-				"path": dirPath,
-			},
-		},
-	})
-
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{
-			"item": map[string]interface{}{
-				"path": dirPath,
-				"root": root,
-			},
-			"action": "create_dir",
-		},
-	})
+	return s.fileChanged("create_dir", map[string]interface{}{
+		"path": dirPath,
+		"root": root,
+	}), nil
 }
 
 func (s *Server) handleDeleteDirectory(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
+	result, err := s.deleteDirectory(r.URL.Query().Get("path"))
+	writeResult(w, result, err)
+}
+
+// deleteDirectory removes an empty directory from the gcodes root.
+func (s *Server) deleteDirectory(path string) (map[string]interface{}, error) {
 	if path == "" {
-		http.Error(w, "missing path parameter", http.StatusBadRequest)
-		return
+		return nil, &apiError{http.StatusBadRequest, "path is required"}
 	}
 
 	root := "gcodes"
@@ -272,128 +363,98 @@ func (s *Server) handleDeleteDirectory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.fileManager.DeleteDirectory(root, dirPath); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    404,
-				"message": err.Error(),
-			},
-		})
-		return
+		return nil, fileError(path, err)
 	}
-
-	s.wsHub.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "delete_dir",
-			"item": map[string]interface{}{
-				"root": root,
-				"path": dirPath,
-			},
-		},
-	})
-
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{
-			"item": map[string]interface{}{
-				"path": dirPath,
-				"root": root,
-			},
-			"action": "delete_dir",
-		},
-	})
+	return s.fileChanged("delete_dir", map[string]interface{}{
+		"path": dirPath,
+		"root": root,
+	}), nil
 }
 
 func (s *Server) handleFileMove(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "failed to parse form", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "failed to parse form")
 		return
 	}
+	result, err := s.moveFile(requestUser(r), r.FormValue("source"), r.FormValue("dest"))
+	writeResult(w, result, err)
+}
 
-	source := r.FormValue("source")
-	dest := r.FormValue("dest")
+// moveFile moves or renames a file or directory within the roots for
+// user.
+func (s *Server) moveFile(user, source, dest string) (map[string]interface{}, error) {
 	if source == "" || dest == "" {
-		http.Error(w, "missing source or dest parameter", http.StatusBadRequest)
-		return
+		return nil, &apiError{http.StatusBadRequest, "source and dest are required"}
 	}
 
 	srcPath := s.fileManager.ResolvePath(source)
 	dstPath := s.fileManager.ResolvePath(dest)
+	for _, p := range []string{srcPath, dstPath} {
+		if err := s.permitPath(user, p); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := s.fileManager.MoveFile(srcPath, dstPath); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    500,
-				"message": err.Error(),
-			},
-		})
-		return
+		return nil, fileError(source, err)
 	}
-
-	s.wsHub.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "move_file",
-			"item": map[string]interface{}{
-				"path":        dest,
-				"root":        "gcodes",
-				"source_path": source,
-			},
-		},
-	})
-
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{
-			"item": map[string]interface{}{
-				"path":        dest,
-				"root":        "gcodes",
-				"source_path": source,
-			},
-			"action": "move_file",
-		},
-	})
+	return s.fileChanged("move_file", map[string]interface{}{
+		"path":        dest,
+		"root":        "gcodes",
+		"source_path": source,
+	}), nil
 }
 
 func (s *Server) handleFileDelete(w http.ResponseWriter, r *http.Request) {
-	root := r.PathValue("root")
-	path := r.PathValue("path")
+	result, err := s.deleteFile(requestUser(r), r.PathValue("root"), r.PathValue("path"))
+	writeResult(w, result, err)
+}
+
+// deleteFile removes a file and any preprocessed copy of it for user.
+func (s *Server) deleteFile(user, root, path string) (map[string]interface{}, error) {
+	if path == "" {
+		return nil, &apiError{http.StatusBadRequest, "path is required"}
+	}
+	if err := s.permitPath(user, s.fileManager.FilePath(root, path)); err != nil {
+		return nil, err
+	}
 
+	s.forgetCached(s.fileManager.FilePath(root, path))
 	if err := s.fileManager.DeleteFile(root, path); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    404,
-				"message": err.Error(),
-			},
-		})
-		return
+		return nil, fileError(path, err)
 	}
+	return s.fileChanged("delete_file", map[string]interface{}{
+		"path": path,
+		"root": root,
+	}), nil
+}
 
-	// Notify WebSocket clients.
+// fileChanged tells clients about a change to the file list and returns
+// the result for the request that made it.
+func (s *Server) fileChanged(action string, item map[string]interface{}) map[string]interface{} {
 	s.wsHub.BroadcastNotification("notify_filelist_changed", []interface{}{
 		map[string]interface{}{
-			"action": "delete_file",
-			"item": map[string]interface{}{
-				"root": root,
-				"path": path,
-			},
-		},
-	})
-
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{
-			"item": map[string]interface{}{
-				"path": path,
-				"root": root,
-			},
-			"action": "delete_file",
+			"action": action,
+			"item":   item,
 		},
 	})
+	return map[string]interface{}{
+		"item":   item,
+		"action": action,
+	}
 }
 
 func (s *Server) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 	root := r.PathValue("root")
 	path := r.PathValue("path")
+	if err := s.permitPath(requestUser(r), s.fileManager.FilePath(root, path)); err != nil {
+		writeError(w, err)
+		return
+	}
 
 	data, err := s.fileManager.ReadFile(root, path)
 	if err != nil {
-		http.Error(w, "file not found", http.StatusNotFound)
+		writeError(w, fileError(path, err))
 		return
 	}
 
@@ -64,17 +64,16 @@ func (s *Server) handleHistoryDeleteJob(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	deleted := s.history.DeleteJob(uid)
+	if !s.history.DeleteJob(uid) {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
 
 	writeJSON(w, map[string]interface{}{
 		"result": map[string]interface{}{
-			"deleted_jobs": []string{},
+			"deleted_jobs": []string{uid},
 		},
 	})
-
-	if deleted {
-		// Could broadcast notify_history_changed here if needed
-	}
 }
 
 func (s *Server) handleHistoryTotals(w http.ResponseWriter, r *http.Request) {
@@ -118,33 +117,35 @@ func (h *WSHub) handleHistoryList(params interface{}) interface{} {
 	}
 }
 
-func (h *WSHub) handleHistoryGetJob(params interface{}) interface{} {
+func (h *WSHub) handleHistoryGetJob(params interface{}) (interface{}, error) {
 	uid := extractStringParam(params, "uid")
 	if uid == "" {
-		return map[string]interface{}{"error": "uid is required"}
+		return nil, &apiError{http.StatusBadRequest, "uid is required"}
 	}
 
 	job := h.server.history.GetJob(uid)
 	if job == nil {
-		return map[string]interface{}{"error": "job not found"}
+		return nil, &apiError{http.StatusNotFound, "job not found"}
 	}
 
 	return map[string]interface{}{
 		"job": job,
-	}
+	}, nil
 }
 
-func (h *WSHub) handleHistoryDeleteJob(params interface{}) interface{} {
+func (h *WSHub) handleHistoryDeleteJob(params interface{}) (interface{}, error) {
 	uid := extractStringParam(params, "uid")
 	if uid == "" {
-		return map[string]interface{}{"error": "uid is required"}
+		return nil, &apiError{http.StatusBadRequest, "uid is required"}
 	}
 
-	h.server.history.DeleteJob(uid)
+	if !h.server.history.DeleteJob(uid) {
+		return nil, &apiError{http.StatusNotFound, "job not found"}
+	}
 
 	return map[string]interface{}{
 		"deleted_jobs": []string{uid},
-	}
+	}, nil
 }
 
 func (h *WSHub) handleHistoryTotals() interface{} {
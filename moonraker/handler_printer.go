@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/john/snapmaker_moonraker/files"
+	"github.com/john/snapmaker_moonraker/gcode"
+	"github.com/john/snapmaker_moonraker/sacp"
 )
 
 // registerPrinterHandlers sets up /printer/* routes.
@@ -61,27 +64,11 @@ func (s *Server) handleObjectsList(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleObjectsQuery(w http.ResponseWriter, r *http.Request) {
-	objects := &PrinterObjects{server: s}
-	snap := s.state.Snapshot()
-
 	// Parse requested objects from query params or body.
 	requested := make(map[string]interface{})
 
 	if r.Method == "GET" {
-		// Query string format: ?toolhead&extruder=temperature,target
-		for key, values := range r.URL.Query() {
-			if len(values) > 0 && values[0] != "" {
-				// Split comma-separated field list.
-				fields := splitFields(values[0])
-				ifaces := make([]interface{}, len(fields))
-				for i, f := range fields {
-					ifaces[i] = f
-				}
-				requested[key] = ifaces
-			} else {
-				requested[key] = nil
-			}
-		}
+		requested = objectsFromQuery(r.URL.Query())
 	} else {
 		var body struct {
 			Objects map[string]interface{} `json:"objects"`
@@ -91,16 +78,40 @@ func (s *Server) handleObjectsQuery(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	status := objects.Query(snap, requested)
+	status, _, eventtime := s.queryObjects(requested)
 
 	writeJSON(w, map[string]interface{}{
 		"result": map[string]interface{}{
-			"eventtime": 0.0,
+			"eventtime": eventtime,
 			"status":    status,
 		},
 	})
 }
 
+// objectsFromQuery parses objects requested in a query string, in the
+// format ?toolhead&extruder=temperature,target. Authorization parameters
+// are skipped.
+func objectsFromQuery(query url.Values) map[string]interface{} {
+	requested := make(map[string]interface{})
+	for key, values := range query {
+		if key == "access_token" || key == "token" {
+			continue
+		}
+		if len(values) > 0 && values[0] != "" {
+			// Split comma-separated field list.
+			fields := splitFields(values[0])
+			ifaces := make([]interface{}, len(fields))
+			for i, f := range fields {
+				ifaces[i] = f
+			}
+			requested[key] = ifaces
+		} else {
+			requested[key] = nil
+		}
+	}
+	return requested
+}
+
 func (s *Server) handleGCodeScript(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Script string `json:"script"`
@@ -112,67 +123,66 @@ func (s *Server) handleGCodeScript(w http.ResponseWriter, r *http.Request) {
 		body.Script = r.URL.Query().Get("script")
 	}
 
-	if body.Script == "" {
-		writeJSON(w, map[string]interface{}{
-			"result": map[string]interface{}{},
-		})
-		return
+	writeResult(w, map[string]interface{}{}, s.runGCodeScript(body.Script))
+}
+
+// runGCodeScript runs a console script for printer.gcode.script. Errors
+// are echoed to the console as well as returned.
+func (s *Server) runGCodeScript(script string) error {
+	if script == "" {
+		return &apiError{http.StatusBadRequest, "script is required"}
 	}
 
 	// Intercept FIRMWARE_RESTART and RESTART to trigger printer reconnection.
-	upperScript := strings.ToUpper(strings.TrimSpace(body.Script))
+	upperScript := strings.ToUpper(strings.TrimSpace(script))
 	if upperScript == "FIRMWARE_RESTART" || upperScript == "RESTART" {
 		go func() {
 			if err := s.printerClient.Reconnect(); err != nil {
 				log.Printf("Reconnect failed: %v", err)
+				s.wsHub.BroadcastNotification("notify_gcode_response", []interface{}{
+					"Error: reconnect failed - " + err.Error(),
+				})
+			} else {
+				s.wsHub.BroadcastNotification("notify_gcode_response", []interface{}{
+					"Reconnected to printer successfully",
+				})
 			}
 		}()
-		writeJSON(w, map[string]interface{}{
-			"result": map[string]interface{}{},
-		})
-		return
+		return nil
 	}
 
 	// Intercept ? and HELP — these are Klipper console commands, not real GCode.
 	if upperScript == "?" || upperScript == "HELP" {
 		s.wsHub.BroadcastNotification("notify_gcode_response", []interface{}{gcodeHelpText()})
-		writeJSON(w, map[string]interface{}{
-			"result": map[string]interface{}{},
-		})
-		return
+		return nil
 	}
 
 	// Intercept Klipper-specific commands (ACTIVATE_EXTRUDER, SET_HEATER_TEMPERATURE, etc.)
 	// and temperature GCodes (M104/M109/M140/M190) to route through SACP directly.
-	if handled, err := s.interceptGCode(body.Script); handled {
+	if handled, err := s.interceptGCode(script); handled {
 		if err != nil {
 			log.Printf("GCode intercept error: %v", err)
 			s.wsHub.BroadcastNotification("notify_gcode_response", []interface{}{
 				"Error: " + err.Error(),
 			})
 		}
-		writeJSON(w, map[string]interface{}{
-			"result": map[string]interface{}{},
-		})
-		return
+		return err
 	}
 
-	result, err := s.printerClient.ExecuteGCode(body.Script)
+	result, err := s.printerClient.ExecuteGCode(script)
 	if err != nil {
 		log.Printf("GCode error: %v", err)
 		s.wsHub.BroadcastNotification("notify_gcode_response", []interface{}{
 			"Error: " + err.Error(),
 		})
+		return err
 	}
 
 	// Broadcast gcode response to WS clients.
 	if result != "" {
 		s.wsHub.BroadcastNotification("notify_gcode_response", []interface{}{result})
 	}
-
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{},
-	})
+	return nil
 }
 
 // interceptGCode handles Klipper-specific commands that the Snapmaker doesn't
@@ -221,7 +231,10 @@ func isKlipperCommand(line string) bool {
 	case "ACTIVATE_EXTRUDER", "SET_HEATER_TEMPERATURE", "SET_GCODE_OFFSET",
 		"SAVE_VARIABLE", "SET_GCODE_VARIABLE", "RESPOND",
 		"NFC_ASSIGN_TOOL", "NFC_CANCEL",
-		"TURN_OFF_HEATERS", "SET_FAN_SPEED",
+		"TURN_OFF_HEATERS", "SET_FAN_SPEED", "SET_PRINT_STATS_INFO",
+		"EXCLUDE_OBJECT", "EXCLUDE_OBJECT_DEFINE", "EXCLUDE_OBJECT_START", "EXCLUDE_OBJECT_END",
+		"PAUSE", "RESUME", "CANCEL_PRINT", "PAUSE_AT", "SET_PAUSE_AT_LAYER", "SET_PAUSE_NEXT_LAYER",
+		"FILAMENT_UNLOAD", "FILAMENT_LOAD", "FILAMENT_PURGE", "CALIBRATE", "CALL_REMOTE_METHOD",
 		"M104", "M109", "M140", "M190", "M106", "M107":
 		return true
 	}
@@ -244,7 +257,11 @@ func (s *Server) interceptSingleGCode(script string) (bool, error) {
 	case "SET_GCODE_OFFSET":
 		// M290 baby-stepping is accepted by the J1S firmware (result code 0)
 		// but has no effect — BABYSTEPPING is likely disabled in Snapmaker's
-		// Marlin configuration. Ignore silently so Mainsail doesn't error.
+		// Marlin configuration. A streamed print applies the offset to the
+		// moves it sends; otherwise ignore silently so Mainsail doesn't error.
+		if s.printerClient.Streaming() {
+			return s.handleStreamGCodeOffset(script)
+		}
 		return true, nil
 	case "SAVE_VARIABLE":
 		// Klipper-only command (requires [save_variables] section). Silently
@@ -278,11 +295,58 @@ func (s *Server) interceptSingleGCode(script string) (bool, error) {
 		return s.handleM107(script)
 	case "SET_FAN_SPEED":
 		return s.handleSetFanSpeed(script)
+	case "SET_PRINT_STATS_INFO":
+		return s.handleSetPrintStatsInfo(script)
+	case "EXCLUDE_OBJECT":
+		return s.handleExcludeObject(script)
+	case "EXCLUDE_OBJECT_DEFINE":
+		return s.handleExcludeObjectDefine()
+	case "EXCLUDE_OBJECT_START", "EXCLUDE_OBJECT_END":
+		// Object markers only mean something inside a file, where the
+		// bridge reads them before printing.
+		return true, nil
+	case "PAUSE":
+		return true, s.printerClient.PausePrint()
+	case "RESUME":
+		return s.handleResume()
+	case "CANCEL_PRINT":
+		return true, s.cancelPrint()
+	case "PAUSE_AT":
+		return s.handlePauseAt(script)
+	case "SET_PAUSE_AT_LAYER":
+		return s.handleSetPauseAtLayer(script)
+	case "SET_PAUSE_NEXT_LAYER":
+		return s.handleSetPauseNextLayer(script)
+	case "FILAMENT_UNLOAD", "FILAMENT_LOAD", "FILAMENT_PURGE":
+		return s.handleFilament(cmd, script)
+	case "CALIBRATE":
+		return s.handleCalibrate(script)
+	case "CALL_REMOTE_METHOD":
+		return s.handleCallRemoteMethod(script)
 	}
 
 	return false, nil
 }
 
+// handleSetPrintStatsInfo handles SET_PRINT_STATS_INFO TOTAL_LAYER=n
+// CURRENT_LAYER=n, sent by slicer macros to drive the layer display.
+func (s *Server) handleSetPrintStatsInfo(script string) (bool, error) {
+	values := [2]int{-1, -1}
+	for i, param := range []string{"CURRENT_LAYER", "TOTAL_LAYER"} {
+		str := extractKlipperParam(script, param)
+		if str == "" {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("SET_PRINT_STATS_INFO: invalid %s value %q", param, str)
+		}
+		values[i] = n
+	}
+	s.state.SetPrintStatsInfo(values[0], values[1])
+	return true, nil
+}
+
 // handleActivateExtruder handles ACTIVATE_EXTRUDER EXTRUDER=extruder1.
 // Sends a T0/T1 GCode command and updates the active extruder state.
 func (s *Server) handleActivateExtruder(script string) (bool, error) {
@@ -354,6 +418,33 @@ func (s *Server) handleSetGCodeOffset(script string) (bool, error) {
 	return false, nil
 }
 
+// handleStreamGCodeOffset handles SET_GCODE_OFFSET Z=x or Z_ADJUST=x for a
+// streamed print, which adds the offset to the Z of the moves it sends.
+func (s *Server) handleStreamGCodeOffset(script string) (bool, error) {
+	offset := s.state.Snapshot().ZOffset
+	if zStr := extractKlipperParam(script, "Z_ADJUST"); zStr != "" {
+		delta, err := strconv.ParseFloat(zStr, 64)
+		if err != nil {
+			return true, fmt.Errorf("SET_GCODE_OFFSET: invalid Z_ADJUST value %q", zStr)
+		}
+		offset += delta
+	} else if zStr := extractKlipperParam(script, "Z"); zStr != "" {
+		z, err := strconv.ParseFloat(zStr, 64)
+		if err != nil {
+			return true, fmt.Errorf("SET_GCODE_OFFSET: invalid Z value %q", zStr)
+		}
+		offset = z
+	} else {
+		return true, nil
+	}
+	if err := s.printerClient.SetStreamZOffset(offset); err != nil {
+		return true, fmt.Errorf("SET_GCODE_OFFSET: %w", err)
+	}
+	s.state.SetZOffset(offset)
+	log.Printf("Z offset of streamed print set to %.3f", offset)
+	return true, nil
+}
+
 // handleSetHeaterTemperature handles SET_HEATER_TEMPERATURE HEATER=extruder1 TARGET=200.
 func (s *Server) handleSetHeaterTemperature(script string) (bool, error) {
 	heater := extractKlipperParam(script, "HEATER")
@@ -531,40 +622,275 @@ func parseGCodeIntParam(script string, param byte) int {
 }
 
 func (s *Server) handlePrintStart(w http.ResponseWriter, r *http.Request) {
-	filename := r.URL.Query().Get("filename")
+	writeResult(w, map[string]interface{}{}, s.printStart(requestParams(r)))
+}
+
+// printStart checks a print start request and starts the print. The
+// upload runs in the background so the response returns immediately:
+// Mainsail expects a fast response, and status updates arrive via
+// websocket notifications as the printer state changes (idle → printing).
+// An upload that fails is reported on the console.
+func (s *Server) printStart(params map[string]interface{}) error {
+	filename, _ := params["filename"].(string)
 	if filename == "" {
-		var body struct {
-			Filename string `json:"filename"`
-		}
-		json.NewDecoder(r.Body).Decode(&body)
-		filename = body.Filename
+		return &apiError{http.StatusBadRequest, "filename is required"}
+	}
+	if _, err := s.fileManager.StatFile("gcodes", filename); err != nil {
+		return notFound(fmt.Errorf("file not found: %s", filename))
+	}
+	opts, err := s.printOptions(params)
+	if err != nil {
+		return err
+	}
+	srcPath := s.fileManager.FilePath("gcodes", filename)
+	if err := s.preflightCheck(filename, srcPath, opts); err != nil {
+		return err
 	}
 
-	if filename != "" {
-		srcPath := s.fileManager.FilePath("gcodes", filename)
-		if _, err := s.fileManager.StatFile("gcodes", filename); err != nil {
-			log.Printf("Error reading file for print: %v", err)
-		} else {
-			// Run upload in background so the RPC response returns immediately.
-			// Mainsail expects a fast response; status updates arrive via websocket
-			// notifications as the printer state changes (idle → printing).
-			go func() {
-				if err := s.printerClient.Upload(filename, srcPath); err != nil {
-					log.Printf("Error uploading to printer: %v", err)
-				} else {
-					s.StartSpoolmanTracking(filename)
-				}
-			}()
+	go func() {
+		if err := s.startPrint(filename, srcPath, opts); err != nil {
+			log.Printf("Error uploading to printer: %v", err)
+			s.wsHub.BroadcastGCodeResponse("!! Print start failed: " + err.Error())
 		}
+	}()
+	return nil
+}
+
+// startPrint uploads a file to the printer and starts it, then starts
+// filament tracking. The job is remembered so objects can be excluded from
+// it later.
+func (s *Server) startPrint(filename, srcPath string, opts gcode.Options) error {
+	if err := s.sendPrint(filename, srcPath, opts); err != nil {
+		return err
+	}
+	s.jobMu.Lock()
+	s.job = &printJob{filename: filename, srcPath: srcPath, opts: opts}
+	s.jobMu.Unlock()
+	s.StartSpoolmanTracking(filename, opts.ToolMap)
+	return nil
+}
+
+// sendPrint uploads and starts a print on the printer, or streams it in
+// the stream print mode.
+func (s *Server) sendPrint(filename, srcPath string, opts gcode.Options) error {
+	if s.config.Printer.PrintMode == "stream" {
+		return s.printerClient.StreamPrint(filename, srcPath, opts, s.config.Printer.StreamWindow)
 	}
+	return s.printerClient.Upload(filename, srcPath, opts)
+}
 
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{},
+// broadcastUploadProgress tells clients how an upload to the printer is
+// going, with its throughput and estimated time left.
+func (s *Server) broadcastUploadProgress(p sacp.UploadProgress) {
+	s.wsHub.BroadcastNotification("notify_upload_progress", []interface{}{
+		map[string]interface{}{
+			"filename":      p.Filename,
+			"bytes_sent":    p.Sent,
+			"total_bytes":   p.Total,
+			"progress":      float64(p.Sent) / float64(p.Total),
+			"bytes_per_sec": p.BytesPerSec,
+			"eta":           p.ETA.Seconds(),
+		},
 	})
 }
 
+// requestParams merges the query string and a JSON object body into one
+// parameter map, the same shape WebSocket requests carry in params. Body
+// values win over query values.
+func requestParams(r *http.Request) map[string]interface{} {
+	params := make(map[string]interface{})
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			params[key] = values[0]
+		}
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+		for k, v := range body {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+// printOptions builds the gcode processing options for a print from the
+// parameters accepted by printer.print.start and the upload API:
+//
+//	transforms: transform stage names, as a list or comma-separated string.
+//	            Omitted runs the stages marked default; empty runs none.
+//	idex_mode:  "duplication" (or "copy") or "mirror" converts a single-tool
+//	            file so both heads print a copy.
+//	tool_map:   assigns the file's tools to heads, as "T0=T1,T1=T0" or an
+//	            object such as {"T0": "T1", "T1": "T0"}.
+//	exclude_objects: names of labelled objects to leave out, as a list or
+//	            comma-separated string.
+//	pause_at:   pauses to insert, as a list or comma-separated string of
+//	            "layer:<n>", "z:<mm>" or "line:<n>".
+//
+// Invalid parameters are reported as bad requests.
+func (s *Server) printOptions(params map[string]interface{}) (gcode.Options, error) {
+	opts := gcode.Options{Model: s.config.Printer.Model, Standby: s.config.GCode.Standby}
+
+	if v, ok := params["idex_mode"].(string); ok {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "", "default":
+		case "duplication", "copy", strings.ToLower(gcode.IDEXModeDuplication):
+			opts.IDEXMode = gcode.IDEXModeDuplication
+		case "mirror", strings.ToLower(gcode.IDEXModeMirror):
+			opts.IDEXMode = gcode.IDEXModeMirror
+		default:
+			return opts, badRequest(fmt.Errorf("idex_mode: unknown mode %q (want duplication or mirror)", v))
+		}
+	}
+
+	if v, ok := params["tool_map"]; ok {
+		var spec string
+		switch t := v.(type) {
+		case string:
+			spec = t
+		case map[string]interface{}:
+			pairs := make([]string, 0, len(t))
+			for src, dst := range t {
+				pairs = append(pairs, fmt.Sprintf("%s=%v", src, dst))
+			}
+			spec = strings.Join(pairs, ",")
+		default:
+			return opts, badRequest(fmt.Errorf("tool_map: expected a string or object"))
+		}
+		tools, err := gcode.ParseToolMap(spec)
+		if err != nil {
+			return opts, badRequest(err)
+		}
+		opts.ToolMap = tools
+	}
+
+	if v, ok := params["exclude_objects"]; ok {
+		names, err := nameList(v)
+		if err != nil {
+			return opts, badRequest(fmt.Errorf("exclude_objects: %w", err))
+		}
+		for _, n := range names {
+			opts.ExcludeObjects = append(opts.ExcludeObjects, strings.ToUpper(n))
+		}
+	}
+
+	if v, ok := params["pause_at"]; ok {
+		specs, err := nameList(v)
+		if err != nil {
+			return opts, badRequest(fmt.Errorf("pause_at: %w", err))
+		}
+		for _, spec := range specs {
+			at, err := gcode.ParsePauseAt(spec)
+			if err != nil {
+				return opts, badRequest(err)
+			}
+			opts.Pauses = append(opts.Pauses, at)
+		}
+	}
+
+	var names []string
+	if v, ok := params["transforms"]; ok {
+		var err error
+		if names, err = nameList(v); err != nil {
+			return opts, badRequest(fmt.Errorf("transforms: %w", err))
+		}
+	}
+
+	stages, err := gcode.SelectStages(s.config.GCode.Transforms, names)
+	if err != nil {
+		return opts, badRequest(err)
+	}
+	opts.Stages = stages
+	return opts, nil
+}
+
+// nameList reads a parameter given as a list of names or a comma-separated
+// string. The result is never nil, so an empty value can be told apart from
+// an absent one.
+func nameList(v interface{}) ([]string, error) {
+	names := []string{}
+	switch t := v.(type) {
+	case string:
+		for _, n := range strings.Split(t, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+	case []interface{}:
+		for _, n := range t {
+			str, ok := n.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of names")
+			}
+			names = append(names, str)
+		}
+	default:
+		return nil, fmt.Errorf("expected a list of names")
+	}
+	return names, nil
+}
+
+// preflightCheck validates a file before it is sent to the printer, as
+// configured by gcode.validation. Findings are echoed to the console as
+// gcode responses. In "block" mode a file with errors returns an error and
+// must not be printed; in "warn" mode the print goes ahead regardless.
+func (s *Server) preflightCheck(filename, srcPath string, opts gcode.Options) error {
+	mode := s.config.GCode.Validation
+	if mode == "off" {
+		return nil
+	}
+
+	report, err := gcode.Validate(srcPath, s.validateOptions(opts))
+	if err != nil {
+		// A file we can't read will fail the upload anyway; don't mask that.
+		log.Printf("Pre-flight validation of %s failed: %v", filename, err)
+		return nil
+	}
+
+	for _, is := range report.Errors {
+		s.wsHub.BroadcastGCodeResponse("!! " + formatIssue(is))
+	}
+	for _, is := range report.Warnings {
+		s.wsHub.BroadcastGCodeResponse("// " + formatIssue(is))
+	}
+	if !report.HasErrors() {
+		return nil
+	}
+
+	log.Printf("Pre-flight validation of %s: %d error(s), %d warning(s)",
+		filename, len(report.Errors), len(report.Warnings))
+	if mode == "block" {
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("pre-flight validation failed for %s: %s", filename, formatIssue(report.Errors[0]))}
+	}
+	return nil
+}
+
+// validateOptions describes the printer and the planned conversion for the
+// validator.
+func (s *Server) validateOptions(opts gcode.Options) gcode.ValidateOptions {
+	return gcode.ValidateOptions{
+		Model:       s.config.Printer.Model,
+		Toolheads:   s.printerClient.Toolheads(),
+		ToolMap:     opts.ToolMap,
+		ConvertIDEX: opts.IDEXMode,
+	}
+}
+
+// formatIssue renders a validation issue as a single console line.
+func formatIssue(is gcode.Issue) string {
+	msg := is.Message
+	if is.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", is.Line, msg)
+	}
+	if is.Count > 1 {
+		msg = fmt.Sprintf("%s (%d occurrences)", msg, is.Count)
+	}
+	return msg
+}
+
 // StartSpoolmanTracking initiates filament usage tracking if Spoolman is configured.
-func (s *Server) StartSpoolmanTracking(filename string) {
+// Filament is attributed to the heads the file's tools are mapped to.
+func (s *Server) StartSpoolmanTracking(filename string, tools gcode.ToolMap) {
 	if s.spoolman == nil || !s.spoolman.HasAnySpool() {
 		return
 	}
@@ -572,7 +898,7 @@ func (s *Server) StartSpoolmanTracking(filename string) {
 	gcodeDir := s.fileManager.GetRootPath("gcodes")
 	fullPath := filepath.Join(gcodeDir, filepath.FromSlash(filename))
 
-	filamentByTool, err := files.ParseFilamentByLinePerTool(fullPath)
+	filamentByTool, err := files.ParseFilamentByLinePerTool(fullPath, tools.Tool)
 	if err != nil {
 		log.Printf("Spoolman: failed to parse filament data from %s: %v", filename, err)
 		return
@@ -591,39 +917,44 @@ func (s *Server) StartSpoolmanTracking(filename string) {
 }
 
 func (s *Server) handlePrintPause(w http.ResponseWriter, r *http.Request) {
-	if err := s.printerClient.PausePrint(); err != nil {
-		log.Printf("Pause error: %v", err)
-	}
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{},
-	})
+	writeResult(w, map[string]interface{}{}, s.printControl("pause"))
 }
 
 func (s *Server) handlePrintResume(w http.ResponseWriter, r *http.Request) {
-	if err := s.printerClient.ResumePrint(); err != nil {
-		log.Printf("Resume error: %v", err)
-	}
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{},
-	})
+	writeResult(w, map[string]interface{}{}, s.printControl("resume"))
 }
 
 func (s *Server) handlePrintCancel(w http.ResponseWriter, r *http.Request) {
-	if err := s.printerClient.StopPrint(); err != nil {
-		log.Printf("Cancel error: %v", err)
+	writeResult(w, map[string]interface{}{}, s.printControl("cancel"))
+}
+
+// printControl pauses, resumes or cancels the print.
+func (s *Server) printControl(action string) error {
+	var err error
+	switch action {
+	case "pause":
+		err = s.printerClient.PausePrint()
+	case "resume":
+		err = s.resumePrint()
+	case "cancel":
+		err = s.cancelPrint()
 	}
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{},
-	})
+	if err != nil {
+		log.Printf("Print %s error: %v", action, err)
+	}
+	return err
 }
 
 func (s *Server) handleEmergencyStop(w http.ResponseWriter, r *http.Request) {
-	if _, err := s.printerClient.ExecuteGCode("M112"); err != nil {
+	writeResult(w, map[string]interface{}{}, s.emergencyStop())
+}
+
+func (s *Server) emergencyStop() error {
+	_, err := s.printerClient.ExecuteGCode("M112")
+	if err != nil {
 		log.Printf("Emergency stop error: %v", err)
 	}
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{},
-	})
+	return err
 }
 
 // gcodeHelpText returns a help message for the Mainsail console.
@@ -67,6 +67,9 @@ func (s *Server) loadedComponents() []string {
 	if s.spoolman != nil {
 		components = append(components, "spoolman")
 	}
+	if s.auth.enabled {
+		components = append(components, "authorization")
+	}
 	return components
 }
 
@@ -81,6 +84,7 @@ func (s *Server) serverConfig() map[string]interface{} {
 		"server": map[string]interface{}{
 			"host":               s.config.Server.Host,
 			"port":               s.config.Server.Port,
+			"ssl_port":           s.config.Server.SSLPort,
 			"klippy_uds_address": "/tmp/klippy_uds",
 		},
 		"file_manager": map[string]interface{}{
@@ -254,6 +258,7 @@ func (s *Server) machineProcStats() map[string]interface{} {
 			"used":      memStats.Alloc / 1024,
 		},
 		"websocket_connections": len(s.wsHub.clients),
+		"websocket_queues":      s.wsHub.queueStats(),
 	}
 }
 
@@ -309,45 +314,15 @@ func (s *Server) machineServicesList() map[string]interface{} {
 }
 
 func (s *Server) handleMachineServiceRestart(w http.ResponseWriter, r *http.Request) {
-	service := r.URL.Query().Get("service")
-	if err := s.serviceAction("restart", service); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    400,
-				"message": err.Error(),
-			},
-		})
-		return
-	}
-	writeJSON(w, map[string]interface{}{"result": "ok"})
+	writeResult(w, "ok", s.serviceAction("restart", r.URL.Query().Get("service")))
 }
 
 func (s *Server) handleMachineServiceStop(w http.ResponseWriter, r *http.Request) {
-	service := r.URL.Query().Get("service")
-	if err := s.serviceAction("stop", service); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    400,
-				"message": err.Error(),
-			},
-		})
-		return
-	}
-	writeJSON(w, map[string]interface{}{"result": "ok"})
+	writeResult(w, "ok", s.serviceAction("stop", r.URL.Query().Get("service")))
 }
 
 func (s *Server) handleMachineServiceStart(w http.ResponseWriter, r *http.Request) {
-	service := r.URL.Query().Get("service")
-	if err := s.serviceAction("start", service); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    400,
-				"message": err.Error(),
-			},
-		})
-		return
-	}
-	writeJSON(w, map[string]interface{}{"result": "ok"})
+	writeResult(w, "ok", s.serviceAction("start", r.URL.Query().Get("service")))
 }
 
 // serviceAction routes service control actions. The virtual "printer" service
@@ -375,7 +350,7 @@ func (s *Server) printerServiceAction(action string) error {
 		}
 		return s.printerClient.ManualConnect()
 	default:
-		return fmt.Errorf("unsupported action %q for printer service", action)
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("unsupported action %q for printer service", action)}
 	}
 }
 
@@ -385,11 +360,11 @@ func machineServiceAction(action, service string) error {
 	case "start", "stop", "restart":
 		// allowed
 	default:
-		return fmt.Errorf("action %q is not allowed", action)
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("action %q is not allowed", action)}
 	}
 
 	if service == "" {
-		return fmt.Errorf("missing service parameter")
+		return &apiError{http.StatusBadRequest, "service is required"}
 	}
 
 	allowed := false
@@ -400,7 +375,7 @@ func machineServiceAction(action, service string) error {
 		}
 	}
 	if !allowed {
-		return fmt.Errorf("service %q is not allowed", service)
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("service %q is not allowed", service)}
 	}
 
 	log.Printf("Service %s: %s", action, service)
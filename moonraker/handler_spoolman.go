@@ -2,6 +2,7 @@ package moonraker
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -43,12 +44,7 @@ func (s *Server) handleSpoolmanSetSpoolID(w http.ResponseWriter, r *http.Request
 		Tool    *int `json:"tool,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    400,
-				"message": "invalid request body",
-			},
-		})
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
@@ -57,22 +53,19 @@ func (s *Server) handleSpoolmanSetSpoolID(w http.ResponseWriter, r *http.Request
 		tool = *body.Tool
 	}
 
-	if err := s.spoolman.SetSpoolID(body.SpoolID, tool); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    500,
-				"message": err.Error(),
-			},
-		})
-		return
-	}
+	result, err := s.setSpoolID(body.SpoolID, tool)
+	writeResult(w, result, err)
+}
 
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{
-			"spool_id": spoolIDOrNull(s.spoolman.GetSpoolID(tool)),
-			"tool":     tool,
-		},
-	})
+func (s *Server) setSpoolID(spoolID, tool int) (interface{}, error) {
+	if err := s.spoolman.SetSpoolID(spoolID, tool); err != nil {
+		log.Printf("Spoolman set spool ID error: %v", err)
+		return nil, err
+	}
+	return map[string]interface{}{
+		"spool_id": spoolIDOrNull(s.spoolman.GetSpoolID(tool)),
+		"tool":     tool,
+	}, nil
 }
 
 // spoolIDOrNull converts a spool ID to nil if it's 0 (no spool),
@@ -92,54 +85,50 @@ func (s *Server) handleSpoolmanProxy(w http.ResponseWriter, r *http.Request) {
 		Body   interface{} `json:"body"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    400,
-				"message": "invalid request body",
-			},
-		})
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
-	if body.Method == "" {
-		body.Method = "GET"
+	result, err := s.spoolmanProxy(body.Method, body.Path, body.Query, body.Body)
+	writeResult(w, result, err)
+}
+
+// spoolmanProxy forwards a request to Spoolman and returns its response.
+// Spoolman failing to answer is a 502; an error it answers with is
+// reported with its status.
+func (s *Server) spoolmanProxy(method, path, query string, body interface{}) (interface{}, error) {
+	if method == "" {
+		method = "GET"
 	}
 
 	// Marshal the body back to JSON if present.
-	var bodyReader *strings.Reader
-	if body.Body != nil {
-		bodyJSON, _ := json.Marshal(body.Body)
+	bodyReader := strings.NewReader("")
+	if body != nil {
+		bodyJSON, _ := json.Marshal(body)
 		bodyReader = strings.NewReader(string(bodyJSON))
-	} else {
-		bodyReader = strings.NewReader("")
 	}
 
-	statusCode, result, err := s.spoolman.Proxy(body.Method, body.Path, body.Query, bodyReader)
+	statusCode, result, err := s.spoolman.Proxy(method, path, query, bodyReader)
 	if err != nil {
 		log.Printf("Spoolman proxy error: %v", err)
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    502,
-				"message": err.Error(),
-			},
-		})
-		return
+		return nil, &apiError{http.StatusBadGateway, err.Error()}
 	}
+	if statusCode < 200 || statusCode >= 300 {
+		return nil, &apiError{statusCode, fmt.Sprintf("spoolman returned %d: %s", statusCode, spoolmanMessage(result))}
+	}
+	return result, nil
+}
 
-	// Return the proxied response as the result.
-	if statusCode >= 200 && statusCode < 300 {
-		writeJSON(w, map[string]interface{}{
-			"result": result,
-		})
-	} else {
-		writeJSON(w, map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    statusCode,
-				"message": "spoolman returned error",
-				"data":    result,
-			},
-		})
+// spoolmanMessage pulls the message out of a Spoolman error response,
+// which FastAPI puts in "detail".
+func spoolmanMessage(result interface{}) string {
+	if m, ok := result.(map[string]interface{}); ok {
+		if detail, ok := m["detail"].(string); ok {
+			return detail
+		}
 	}
+	data, _ := json.Marshal(result)
+	return string(data)
 }
 
 // --- WebSocket RPC handlers ---
@@ -156,55 +145,19 @@ func (h *WSHub) handleSpoolmanGetSpoolID(params interface{}) interface{} {
 	}
 }
 
-func (h *WSHub) handleSpoolmanSetSpoolID(params interface{}) interface{} {
-	spoolID := extractIntParam(params, "spool_id")
-	tool := extractIntParam(params, "tool")
-
-	if err := h.server.spoolman.SetSpoolID(spoolID, tool); err != nil {
-		log.Printf("Spoolman set spool ID error: %v", err)
-		return map[string]interface{}{"error": err.Error()}
-	}
-
-	return map[string]interface{}{
-		"spool_id": spoolIDOrNull(h.server.spoolman.GetSpoolID(tool)),
-		"tool":     tool,
-	}
+func (h *WSHub) handleSpoolmanSetSpoolID(params interface{}) (interface{}, error) {
+	return h.server.setSpoolID(extractIntParam(params, "spool_id"), extractIntParam(params, "tool"))
 }
 
-func (h *WSHub) handleSpoolmanProxy(params interface{}) interface{} {
-	method := extractStringParam(params, "request_method")
-	path := extractStringParam(params, "path")
-	query := extractStringParam(params, "query")
-
-	if method == "" {
-		method = "GET"
-	}
-
-	// Extract body from params.
-	var bodyReader *strings.Reader
+func (h *WSHub) handleSpoolmanProxy(params interface{}) (interface{}, error) {
+	var body interface{}
 	if p, ok := params.(map[string]interface{}); ok {
-		if bodyVal, exists := p["body"]; exists && bodyVal != nil {
-			bodyJSON, _ := json.Marshal(bodyVal)
-			bodyReader = strings.NewReader(string(bodyJSON))
-		}
-	}
-	if bodyReader == nil {
-		bodyReader = strings.NewReader("")
-	}
-
-	statusCode, result, err := h.server.spoolman.Proxy(method, path, query, bodyReader)
-	if err != nil {
-		log.Printf("Spoolman proxy error: %v", err)
-		return map[string]interface{}{"error": err.Error()}
-	}
-
-	if statusCode >= 200 && statusCode < 300 {
-		return result
-	}
-
-	return map[string]interface{}{
-		"error":       "spoolman returned error",
-		"status_code": statusCode,
-		"data":        result,
-	}
+		body = p["body"]
+	}
+	return h.server.spoolmanProxy(
+		extractStringParam(params, "request_method"),
+		extractStringParam(params, "path"),
+		extractStringParam(params, "query"),
+		body,
+	)
 }
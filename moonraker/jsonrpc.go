@@ -0,0 +1,153 @@
+package moonraker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// socketETX ends each message on the Unix socket.
+const socketETX = 0x03
+
+// maxRPCMessage bounds a request or batch on every transport.
+const maxRPCMessage = 1 << 20
+
+// wsConnectionMethods act on the connection they are called on, so are
+// refused over POST /server/jsonrpc, which has none.
+var wsConnectionMethods = map[string]bool{
+	"server.connection.identify":        true,
+	"server.websocket.id":               true,
+	"printer.objects.subscribe":         true,
+	"connection.register_remote_method": true,
+	"connection.send_event":             true,
+}
+
+// reply answers a request or batch from a connected client.
+func (h *WSHub) reply(client *WSClient, message []byte) {
+	if err := client.send(h.handleMessage(client, message)); err != nil {
+		log.Printf("WebSocket response send error: %v", err)
+	}
+	client.releaseStatus()
+}
+
+// handleMessage runs a JSON-RPC request, or a batch of them in order, and
+// returns the response or array of responses.
+func (h *WSHub) handleMessage(client *WSClient, message []byte) interface{} {
+	if trimmed := bytes.TrimLeft(message, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '[' {
+		return h.handleRaw(client, message)
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(message, &batch); err != nil {
+		return &jsonRPCResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: "Parse error"}}
+	}
+	if len(batch) == 0 {
+		return &jsonRPCResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request"}}
+	}
+	resps := make([]*jsonRPCResponse, 0, len(batch))
+	for _, raw := range batch {
+		resps = append(resps, h.handleRaw(client, raw))
+	}
+	return resps
+}
+
+func (h *WSHub) handleRaw(client *WSClient, raw []byte) *jsonRPCResponse {
+	var req jsonRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return &jsonRPCResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: "Parse error"}}
+	}
+	return h.handleRPC(client, &req)
+}
+
+// handleJSONRPC handles POST /server/jsonrpc: a request or batch run as
+// over the WebSocket, answered with the bare JSON-RPC response.
+func (s *Server) handleJSONRPC(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRPCMessage))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	client := &WSClient{
+		subscribed: make(map[string]interface{}),
+		user:       requestUser(r),
+		ip:         clientIP(r),
+	}
+	writeJSON(w, s.wsHub.handleMessage(client, body))
+}
+
+// listenUnix opens the Unix socket, replacing one left by an earlier run.
+// Its clients get admin access, so the socket is limited to the bridge's
+// user and group rather than left to the umask.
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("restricting %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// serveUnix accepts clients on the Unix socket until it is closed. They
+// get the full WebSocket API, without authorization: access is controlled
+// by the socket file's permissions (see listenUnix).
+func (s *Server) serveUnix(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.wsHub.handleUnixConn(conn)
+	}
+}
+
+// handleUnixConn serves a Unix socket client, reading messages ending in
+// socketETX.
+func (h *WSHub) handleUnixConn(conn net.Conn) {
+	client := newWSClient(nil)
+	client.sock = conn
+	client.user = socketUser
+	h.register(client)
+	go client.writeLoop()
+	defer func() {
+		client.disconnect("")
+		h.unregister(client)
+		conn.Close()
+	}()
+	log.Printf("Unix socket client %d connected", client.id)
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 64*1024), maxRPCMessage)
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, socketETX); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		h.reply(client, sc.Bytes())
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("Unix socket client %d closed: %v", client.id, err)
+	}
+}
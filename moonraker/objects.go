@@ -1,6 +1,7 @@
 package moonraker
 
 import (
+	"github.com/john/snapmaker_moonraker/gcode"
 	"github.com/john/snapmaker_moonraker/printer"
 )
 
@@ -32,12 +33,17 @@ func (po *PrinterObjects) BuildAll(state printer.StateData) map[string]interface
 		"display_status":                 po.DisplayStatus(state),
 		"gcode":                          po.GCode(state),
 		"save_variables":                 po.SaveVariables(),
+		"exclude_object":                 po.ExcludeObject(state),
 	}
 }
 
 // Query returns only the requested objects/fields.
 func (po *PrinterObjects) Query(state printer.StateData, objects map[string]interface{}) map[string]interface{} {
-	all := po.BuildAll(state)
+	return queryTree(po.BuildAll(state), objects)
+}
+
+// queryTree picks the requested objects/fields out of a tree from BuildAll.
+func queryTree(all map[string]interface{}, objects map[string]interface{}) map[string]interface{} {
 	result := make(map[string]interface{})
 
 	for name, requestedFields := range objects {
@@ -94,6 +100,7 @@ func (po *PrinterObjects) AvailableObjects() []string {
 		"display_status",
 		"gcode",
 		"save_variables",
+		"exclude_object",
 	}
 }
 
@@ -191,28 +198,69 @@ func (po *PrinterObjects) PrintStats(state printer.StateData) map[string]interfa
 		s = "standby"
 	}
 
+	remaining, eta := printETA(state)
+	message := ""
+	if po.server != nil {
+		message = po.server.pauseReason(state)
+	}
 	return map[string]interface{}{
 		"state":          s,
 		"print_duration": state.PrintDuration,
 		"total_duration": state.PrintDuration,
 		"filament_used":  0.0,
 		"filename":       state.PrintFileName,
-		"message":        "",
-		"info": map[string]interface{}{
-			"total_layer":   nil,
-			"current_layer": nil,
-		},
+		"message":        message,
+		"info":           po.printStatsInfo(state),
+		"progress":       state.PrintProgress,
+		"estimated_time": state.EstimatedTime,
+		"remaining_time": remaining,
+		"eta":            eta,
 	}
 }
 
+// printETA returns the estimated remaining seconds and the Unix time the
+// print should finish, as of the last change in the estimate, both nil
+// when no time estimate is available.
+func printETA(state printer.StateData) (remaining, eta interface{}) {
+	active := state.PrinterState == "printing" || state.PrinterState == "paused"
+	if !active || state.EstimatedTime <= 0 {
+		return nil, nil
+	}
+	if state.ETA <= 0 {
+		return state.RemainingTime, nil
+	}
+	return state.RemainingTime, state.ETA
+}
+
+// printStatsInfo reports layer progress; unknown values are null, as in
+// Klipper when the file provides no layer information.
+func (po *PrinterObjects) printStatsInfo(state printer.StateData) map[string]interface{} {
+	info := map[string]interface{}{
+		"total_layer":   nil,
+		"current_layer": nil,
+	}
+	if state.TotalLayer > 0 {
+		info["total_layer"] = state.TotalLayer
+		info["current_layer"] = state.CurrentLayer
+	}
+	return info
+}
+
 func (po *PrinterObjects) VirtualSDCard(state printer.StateData) map[string]interface{} {
 	isActive := state.PrinterState == "printing" || state.PrinterState == "paused"
+	remaining, eta := printETA(state)
+	filePath := state.FilePath
+	if filePath == "" {
+		filePath = state.PrintFileName
+	}
 	return map[string]interface{}{
-		"file_path":     state.PrintFileName,
-		"progress":      state.PrintProgress,
-		"is_active":     isActive,
-		"file_position": 0,
-		"file_size":     0,
+		"file_path":      filePath,
+		"progress":       state.PrintProgress,
+		"is_active":      isActive,
+		"file_position":  state.FilePosition,
+		"file_size":      state.FileSize,
+		"remaining_time": remaining,
+		"eta":            eta,
 	}
 }
 
@@ -298,6 +346,15 @@ func (po *PrinterObjects) GCode(state printer.StateData) map[string]interface{}
 		"CANCEL_PRINT":           map[string]interface{}{"help": "Cancel current print"},
 		"PAUSE":                  map[string]interface{}{"help": "Pause current print"},
 		"RESUME":                 map[string]interface{}{"help": "Resume current print"},
+		"EXCLUDE_OBJECT":         map[string]interface{}{"help": "Exclude an object from the running print"},
+		"PAUSE_AT":               map[string]interface{}{"help": "Pause the running print at LAYER, Z or LINE"},
+		"SET_PAUSE_AT_LAYER":     map[string]interface{}{"help": "Pause the running print at a layer"},
+		"SET_PAUSE_NEXT_LAYER":   map[string]interface{}{"help": "Pause the running print at the next layer"},
+		"FILAMENT_UNLOAD":        map[string]interface{}{"help": "Unload filament while paused"},
+		"FILAMENT_LOAD":          map[string]interface{}{"help": "Load filament while paused"},
+		"FILAMENT_PURGE":         map[string]interface{}{"help": "Purge filament while paused"},
+		"CALIBRATE":              map[string]interface{}{"help": "Generate a calibration print"},
+		"CALL_REMOTE_METHOD":     map[string]interface{}{"help": "Call a method registered by a connected agent"},
 	}
 	return map[string]interface{}{
 		"commands": commands,
@@ -310,8 +367,33 @@ func (po *PrinterObjects) DisplayStatus(state printer.StateData) map[string]inte
 	if state.PrinterState == "printing" && state.PrintFileName != "" {
 		message = "Printing: " + state.PrintFileName
 	}
+	remaining, eta := printETA(state)
+	return map[string]interface{}{
+		"progress":       progress,
+		"message":        message,
+		"remaining_time": remaining,
+		"eta":            eta,
+	}
+}
+
+// ExcludeObject reports the labelled objects of the current print, from its
+// print index; current_object is null between objects.
+func (po *PrinterObjects) ExcludeObject(state printer.StateData) map[string]interface{} {
+	objects := state.Objects
+	if objects == nil {
+		objects = []gcode.Object{}
+	}
+	excluded := state.ExcludedObjects
+	if excluded == nil {
+		excluded = []string{}
+	}
+	var current interface{}
+	if state.CurrentObject != "" {
+		current = state.CurrentObject
+	}
 	return map[string]interface{}{
-		"progress": progress,
-		"message":  message,
+		"objects":          objects,
+		"excluded_objects": excluded,
+		"current_object":   current,
 	}
 }
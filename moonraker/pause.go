@@ -0,0 +1,386 @@
+package moonraker
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/john/snapmaker_moonraker/gcode"
+	"github.com/john/snapmaker_moonraker/printer"
+)
+
+// pauseSchedule tracks the pauses of the print in progress: those processed
+// into the file (PrintIndex.Pauses) and those scheduled while it runs. The
+// printer can't act on a pause in a file, so the bridge pauses it over SACP
+// when the reported line reaches a pause point.
+type pauseSchedule struct {
+	mu       sync.Mutex
+	srcPath  string          // print the schedule belongs to
+	lastLine int             // last line reported for it
+	user     []gcode.PauseAt // scheduled during the print
+	fired    map[int]bool    // output lines already paused at
+	paused   *gcode.Pause    // pause point the print is held at, until RESUME
+	exactE   bool            // paused.E is the file's E position there
+}
+
+// Filament handling defaults for the M600 prompt (mm and mm/min).
+const (
+	minExtrudeTemp   = 170
+	unloadLength     = 60
+	loadLength       = 60
+	purgeLength      = 30
+	filamentFeedrate = 300
+	unloadFeedrate   = 1800
+)
+
+// sync resets the schedule when a new print starts; must hold mu. A line
+// going backwards on the same file is a new print of it. Pause points
+// already behind the printer don't fire, so a bridge restart mid-print
+// doesn't pause again at points the print has passed.
+func (p *pauseSchedule) sync(idx *gcode.PrintIndex, srcPath string, line int) {
+	if srcPath == p.srcPath && line >= p.lastLine {
+		p.lastLine = line
+		return
+	}
+	p.srcPath, p.lastLine = srcPath, line
+	p.user, p.paused, p.exactE = nil, nil, false
+	p.fired = make(map[int]bool)
+	for _, pause := range idx.Pauses {
+		if pause.Line < line {
+			p.fired[pause.Line] = true
+		}
+	}
+}
+
+// checkPauses is called with each line the printer reports, and pauses the
+// print at the first pause point it has reached.
+func (s *Server) checkPauses(line int) {
+	idx, srcPath := s.printerClient.PrintIndex()
+	if idx == nil {
+		return
+	}
+
+	p := &s.pauses
+	p.mu.Lock()
+	p.sync(idx, srcPath, line)
+	var due *gcode.Pause
+	exactE := false
+	for i := range idx.Pauses {
+		pause := idx.Pauses[i]
+		if !p.fired[pause.Line] && line >= pause.Line {
+			p.fired[pause.Line] = true
+			if due == nil {
+				due, exactE = &pause, true
+			}
+		}
+	}
+	for _, at := range p.user {
+		if l := idx.PauseLine(at); l > 0 && !p.fired[l] && line >= l {
+			p.fired[l] = true
+			if due == nil {
+				// The file's E position here is unknown; only the
+				// extrusion mode can be restored.
+				due = &gcode.Pause{Line: l, Reason: at.String(), RelativeE: idx.RelativeE(l)}
+			}
+		}
+	}
+	if due != nil {
+		p.paused, p.exactE = due, exactE
+	}
+	p.mu.Unlock()
+
+	if due == nil {
+		return
+	}
+	log.Printf("Pausing print at line %d (%s)", line, due.Reason)
+	if err := s.printerClient.PausePrint(); err != nil {
+		log.Printf("Scheduled pause failed: %v", err)
+		s.wsHub.BroadcastGCodeResponse("!! Pause at " + due.Reason + " failed: " + err.Error())
+		return
+	}
+	if due.FilamentChange {
+		s.showFilamentChangePrompt(due.Tool)
+		return
+	}
+	s.wsHub.BroadcastGCodeResponse("// Print paused at " + due.Reason)
+}
+
+// showFilamentChangePrompt opens a Mainsail prompt dialog for an M600.
+// The buttons run FILAMENT_UNLOAD/LOAD/PURGE and RESUME, which the bridge
+// handles.
+func (s *Server) showFilamentChangePrompt(tool int) {
+	for _, msg := range []string{
+		"action:prompt_begin Filament change",
+		fmt.Sprintf("action:prompt_text Change the filament on T%d. Unload, load the new filament and purge until the colour is clean, then resume.", tool),
+		fmt.Sprintf("action:prompt_button Unload|FILAMENT_UNLOAD T=%d|warning", tool),
+		fmt.Sprintf("action:prompt_button Load|FILAMENT_LOAD T=%d|info", tool),
+		fmt.Sprintf("action:prompt_button Purge|FILAMENT_PURGE T=%d|info", tool),
+		"action:prompt_footer_button Resume|RESUME|primary",
+		"action:prompt_show",
+	} {
+		s.wsHub.BroadcastGCodeResponse("// " + msg)
+	}
+}
+
+// handlePauseAt handles PAUSE_AT LAYER=n, Z=mm or LINE=n (a line of the
+// source file), scheduling a pause in the running print. CLEAR=1 drops the
+// pauses scheduled this way; without parameters the schedule is listed.
+func (s *Server) handlePauseAt(script string) (bool, error) {
+	if extractKlipperParam(script, "CLEAR") == "1" {
+		s.clearScheduledPauses()
+		return true, nil
+	}
+	for _, key := range []string{"LAYER", "Z", "LINE"} {
+		if v := extractKlipperParam(script, key); v != "" {
+			at, err := gcode.ParsePauseAt(key + ":" + v)
+			if err != nil {
+				return true, fmt.Errorf("PAUSE_AT: %w", err)
+			}
+			return true, s.schedulePause(at)
+		}
+	}
+	s.wsHub.BroadcastGCodeResponse("// Scheduled pauses: " + s.describePauses())
+	return true, nil
+}
+
+// handleSetPauseAtLayer handles SET_PAUSE_AT_LAYER [ENABLE=0|1] [LAYER=n],
+// as sent by Mainsail's layer pause menu.
+func (s *Server) handleSetPauseAtLayer(script string) (bool, error) {
+	if extractKlipperParam(script, "ENABLE") == "0" {
+		s.clearScheduledPauses()
+		return true, nil
+	}
+	layer, err := strconv.Atoi(extractKlipperParam(script, "LAYER"))
+	if err != nil || layer < 1 {
+		return true, fmt.Errorf("SET_PAUSE_AT_LAYER: LAYER must be a positive number")
+	}
+	return true, s.schedulePause(gcode.PauseAt{Layer: layer})
+}
+
+// handleSetPauseNextLayer handles SET_PAUSE_NEXT_LAYER [ENABLE=0|1].
+func (s *Server) handleSetPauseNextLayer(script string) (bool, error) {
+	if extractKlipperParam(script, "ENABLE") == "0" {
+		s.clearScheduledPauses()
+		return true, nil
+	}
+	layer := s.state.Snapshot().CurrentLayer
+	if layer == 0 {
+		return true, fmt.Errorf("SET_PAUSE_NEXT_LAYER: the current layer is unknown")
+	}
+	return true, s.schedulePause(gcode.PauseAt{Layer: layer + 1})
+}
+
+// schedulePause adds a pause to the running print.
+func (s *Server) schedulePause(at gcode.PauseAt) error {
+	idx, srcPath := s.printerClient.PrintIndex()
+	if idx == nil {
+		return fmt.Errorf("no print with a print index is running; pass pause_at when starting the print instead")
+	}
+	line := s.printerClient.CurrentLine()
+	target := idx.PauseLine(at)
+	if target == 0 {
+		return fmt.Errorf("%s is not in %s", at, srcPath)
+	}
+	if target <= line {
+		return fmt.Errorf("the print is already past %s", at)
+	}
+
+	p := &s.pauses
+	p.mu.Lock()
+	p.sync(idx, srcPath, line)
+	p.user = append(p.user, at)
+	p.mu.Unlock()
+	s.wsHub.BroadcastGCodeResponse("// Pause scheduled at " + at.String())
+	return nil
+}
+
+func (s *Server) clearScheduledPauses() {
+	s.pauses.mu.Lock()
+	s.pauses.user = nil
+	s.pauses.mu.Unlock()
+	s.wsHub.BroadcastGCodeResponse("// Scheduled pauses cleared")
+}
+
+// describePauses lists the pauses of the running print still ahead.
+func (s *Server) describePauses() string {
+	idx, srcPath := s.printerClient.PrintIndex()
+	if idx == nil {
+		return "none"
+	}
+	line := s.printerClient.CurrentLine()
+	var names []string
+	for _, pause := range idx.Pauses {
+		if pause.Line > line {
+			names = append(names, pause.Reason)
+		}
+	}
+	s.pauses.mu.Lock()
+	if s.pauses.srcPath == srcPath {
+		for _, at := range s.pauses.user {
+			if idx.PauseLine(at) > line {
+				names = append(names, at.String())
+			}
+		}
+	}
+	s.pauses.mu.Unlock()
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// handleFilament handles FILAMENT_UNLOAD, FILAMENT_LOAD and FILAMENT_PURGE
+// [T=n] [LENGTH=mm] while a print is paused. Filament is moved in relative
+// mode, then the extrusion mode and E position the file expects are put
+// back so the print resumes unchanged.
+func (s *Server) handleFilament(cmd, script string) (bool, error) {
+	state := s.state.Snapshot()
+	if state.PrinterState != "paused" {
+		return true, fmt.Errorf("%s: the print must be paused", cmd)
+	}
+
+	tool := 0
+	if state.ActiveExtruder == "extruder1" {
+		tool = 1
+	}
+	if v := extractKlipperParam(script, "T"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n != tool {
+			return true, fmt.Errorf("%s: T%s is not the active extruder", cmd, v)
+		}
+	}
+	restore, err := s.extrusionRestore()
+	if err != nil {
+		return true, fmt.Errorf("%s: %w", cmd, err)
+	}
+	temp := state.Extruder0Temp
+	if tool == 1 {
+		temp = state.Extruder1Temp
+	}
+	if temp < minExtrudeTemp {
+		return true, fmt.Errorf("%s: T%d is at %.0f°C, heat it to at least %d°C first", cmd, tool, temp, minExtrudeTemp)
+	}
+
+	var length float64
+	var moves []string
+	switch cmd {
+	case "FILAMENT_UNLOAD":
+		length = unloadLength
+	case "FILAMENT_LOAD":
+		length = loadLength
+	case "FILAMENT_PURGE":
+		length = purgeLength
+	}
+	if v := extractKlipperParam(script, "LENGTH"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			return true, fmt.Errorf("%s: invalid LENGTH %q", cmd, v)
+		}
+		length = n
+	}
+	switch cmd {
+	case "FILAMENT_UNLOAD":
+		// A short push first softens the tip so it doesn't jam on the way out.
+		moves = []string{"G1 E5 F" + strconv.Itoa(filamentFeedrate), fmt.Sprintf("G1 E-%.1f F%d", length, unloadFeedrate)}
+	default:
+		moves = []string{fmt.Sprintf("G1 E%.1f F%d", length, filamentFeedrate)}
+	}
+
+	lines := append([]string{"M83"}, moves...)
+	if restore != "" {
+		lines = append(lines, strings.Split(restore, "\n")...)
+	}
+	for _, line := range lines {
+		if _, err := s.printerClient.ExecuteGCode(line); err != nil {
+			return true, fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	s.wsHub.BroadcastGCodeResponse(fmt.Sprintf("// %s T%d: %.0f mm", strings.ToLower(strings.TrimPrefix(cmd, "FILAMENT_")), tool, length))
+	return true, nil
+}
+
+// extrusionRestore returns the lines that put back the extrusion mode and
+// E position the file expects where the print is paused. Moving filament in
+// absolute mode is refused where the E position isn't known, since
+// resuming would then extrude the difference in one go.
+func (s *Server) extrusionRestore() (string, error) {
+	if s.printerClient.Streaming() {
+		// A streamed print restores them itself when it resumes.
+		return "", nil
+	}
+	s.pauses.mu.Lock()
+	paused, exactE := s.pauses.paused, s.pauses.exactE
+	s.pauses.mu.Unlock()
+
+	relative := false
+	switch {
+	case paused != nil:
+		relative = paused.RelativeE
+	default:
+		idx, _ := s.printerClient.PrintIndex()
+		if idx == nil {
+			return "", fmt.Errorf("the extrusion mode of the print is unknown")
+		}
+		relative = idx.RelativeE(s.printerClient.CurrentLine())
+	}
+	switch {
+	case relative:
+		return "M83", nil
+	case paused != nil && exactE:
+		return fmt.Sprintf("M82\nG92 E%.5f", paused.E), nil
+	}
+	return "", fmt.Errorf("the print extrudes in absolute mode and its E position here is unknown; move filament at an M600 or a pause_at pause instead")
+}
+
+// handleResume handles RESUME, also sent by the filament change prompt.
+func (s *Server) handleResume() (bool, error) {
+	if err := s.resumePrint(); err != nil {
+		return true, fmt.Errorf("RESUME: %w", err)
+	}
+	return true, nil
+}
+
+// resumePrint resumes a paused print, closing the filament change prompt
+// if one is open.
+func (s *Server) resumePrint() error {
+	s.releasePause()
+	return s.printerClient.ResumePrint()
+}
+
+// cancelPrint stops the print, closing the filament change prompt if one
+// is open.
+func (s *Server) cancelPrint() error {
+	s.releasePause()
+	return s.printerClient.StopPrint()
+}
+
+// releasePause forgets the pause point the print is held at.
+func (s *Server) releasePause() {
+	s.pauses.mu.Lock()
+	paused := s.pauses.paused
+	s.pauses.paused, s.pauses.exactE = nil, false
+	s.pauses.mu.Unlock()
+	if paused != nil && paused.FilamentChange {
+		s.wsHub.BroadcastGCodeResponse("// action:prompt_end")
+	}
+}
+
+// pauseReason describes why the print is paused, for print_stats.message.
+func (s *Server) pauseReason(state printer.StateData) string {
+	if state.PrinterState != "paused" {
+		return ""
+	}
+	if msg := s.printerClient.StreamMessage(); msg != "" {
+		return msg
+	}
+	s.pauses.mu.Lock()
+	defer s.pauses.mu.Unlock()
+	switch {
+	case s.pauses.paused == nil:
+		return ""
+	case s.pauses.paused.FilamentChange:
+		return fmt.Sprintf("Filament change on T%d", s.pauses.paused.Tool)
+	}
+	return "Paused at " + s.pauses.paused.Reason
+}
@@ -0,0 +1,61 @@
+package moonraker
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/john/snapmaker_moonraker/gcode"
+)
+
+// preprocessQueue bounds the uploads waiting to be processed. Uploads
+// beyond it are processed when printed instead.
+const preprocessQueue = 32
+
+type preprocessJob struct {
+	srcPath string
+	opts    gcode.Options
+}
+
+// SetCache enables processing uploads in the background into cache, so
+// printing them later can start without processing them first.
+func (s *Server) SetCache(cache *gcode.Cache) {
+	s.cache = cache
+	s.preprocess = make(chan preprocessJob, preprocessQueue)
+	go s.preprocessLoop()
+}
+
+// queuePreprocess processes the file at srcPath in the background with
+// the print options from params.
+func (s *Server) queuePreprocess(srcPath string, params map[string]interface{}) {
+	if s.cache == nil {
+		return
+	}
+	opts, err := s.printOptions(params)
+	if err != nil {
+		log.Printf("Not preprocessing %s: %v", filepath.Base(srcPath), err)
+		return
+	}
+	select {
+	case s.preprocess <- preprocessJob{srcPath: srcPath, opts: opts}:
+	default:
+		log.Printf("Preprocess queue full, %s will be processed when printed", filepath.Base(srcPath))
+	}
+}
+
+// forgetCached drops cached output of the file at srcPath.
+func (s *Server) forgetCached(srcPath string) {
+	if s.cache != nil {
+		s.cache.Forget(srcPath)
+	}
+}
+
+func (s *Server) preprocessLoop() {
+	for job := range s.preprocess {
+		entry, err := s.cache.Process(job.srcPath, job.opts)
+		if err != nil {
+			log.Printf("Preprocessing %s failed: %v", filepath.Base(job.srcPath), err)
+			continue
+		}
+		entry.Release()
+	}
+}
@@ -0,0 +1,300 @@
+package moonraker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// role is a privilege level. Each level may do everything the ones below
+// it may.
+type role int
+
+const (
+	rolePublic   role = iota // no authorization needed
+	roleViewer               // watch the printer, read files and history
+	roleOperator             // run prints, G-code and file changes
+	roleAdmin                // users, API key, services and the database
+)
+
+var roleNames = map[role]string{
+	rolePublic:   "public",
+	roleViewer:   "viewer",
+	roleOperator: "operator",
+	roleAdmin:    "admin",
+}
+
+func (r role) String() string { return roleNames[r] }
+
+// parseRole parses a role a user, the API key or trusted clients can have.
+func parseRole(s string) (role, error) {
+	switch s {
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return rolePublic, fmt.Errorf("invalid role %q (want viewer, operator or admin)", s)
+}
+
+// routeRoles is the role each HTTP route needs, by mux pattern. Routes
+// missing here need admin.
+var routeRoles = map[string]role{
+	"GET /{$}":       rolePublic,
+	"GET /websocket": rolePublic, // connections authorize themselves
+
+	"POST /server/jsonrpc": rolePublic, // each method is authorized
+
+	"POST /access/login":         rolePublic,
+	"POST /access/refresh_jwt":   rolePublic,
+	"GET /access/info":           rolePublic,
+	"POST /access/logout":        roleViewer,
+	"GET /access/user":           roleViewer,
+	"POST /access/user/password": roleViewer,
+	"GET /access/oneshot_token":  roleViewer,
+	"POST /access/user":          roleAdmin,
+	"DELETE /access/user":        roleAdmin,
+	"POST /access/user/role":     roleAdmin,
+	"GET /access/users/list":     roleAdmin,
+	"GET /access/api_key":        roleAdmin,
+	"POST /access/api_key":       roleAdmin,
+
+	"GET /server/info":               roleViewer,
+	"GET /server/config":             roleViewer,
+	"GET /server/temperature_store":  roleViewer,
+	"GET /server/gcode_store":        roleViewer,
+	"GET /server/announcements/list": roleViewer,
+	"GET /server/webcams/list":       roleViewer,
+	"GET /server/events":             roleViewer,
+	"POST /server/restart":           roleAdmin,
+
+	"GET /server/files/list":                roleViewer,
+	"GET /server/files/directory":           roleViewer,
+	"GET /server/files/metadata":            roleViewer,
+	"GET /server/files/roots":               roleViewer,
+	"GET /server/files/validate":            roleViewer,
+	"POST /server/files/validate":           roleViewer,
+	"GET /server/files/objects":             roleViewer,
+	"GET /server/files/{root}/{path...}":    roleViewer,
+	"POST /server/files/upload":             roleOperator,
+	"POST /server/files/directory":          roleOperator,
+	"DELETE /server/files/directory":        roleOperator,
+	"POST /server/files/move":               roleOperator,
+	"DELETE /server/files/{root}/{path...}": roleOperator,
+	"POST /server/files/calibration":        roleOperator,
+
+	"GET /server/history/list":          roleViewer,
+	"GET /server/history/job":           roleViewer,
+	"GET /server/history/totals":        roleViewer,
+	"DELETE /server/history/job":        roleOperator,
+	"POST /server/history/reset_totals": roleAdmin,
+
+	"GET /printer/info":            roleViewer,
+	"GET /printer/objects/list":    roleViewer,
+	"GET /printer/objects/query":   roleViewer,
+	"POST /printer/objects/query":  roleViewer,
+	"POST /printer/gcode/script":   roleOperator,
+	"POST /printer/print/start":    roleOperator,
+	"POST /printer/print/pause":    roleOperator,
+	"POST /printer/print/resume":   roleOperator,
+	"POST /printer/print/cancel":   roleOperator,
+	"POST /printer/emergency_stop": roleOperator,
+
+	"GET /machine/system_info":       roleViewer,
+	"GET /machine/proc_stats":        roleViewer,
+	"GET /machine/services/list":     roleViewer,
+	"GET /machine/update/status":     roleViewer,
+	"POST /machine/services/restart": roleAdmin,
+	"POST /machine/services/stop":    roleAdmin,
+	"POST /machine/services/start":   roleAdmin,
+
+	"GET /server/database/list":    roleViewer,
+	"GET /server/database/item":    roleViewer,
+	"POST /server/database/item":   roleAdmin,
+	"DELETE /server/database/item": roleAdmin,
+
+	"GET /server/spoolman/status":    roleViewer,
+	"GET /server/spoolman/spool_id":  roleViewer,
+	"POST /server/spoolman/spool_id": roleOperator,
+	"POST /server/spoolman/proxy":    roleOperator,
+}
+
+// methodRoles is the role each WebSocket method needs. Methods missing
+// here need admin.
+var methodRoles = map[string]role{
+	"server.connection.identify": rolePublic,
+	"server.info":                rolePublic,
+	"access.login":               rolePublic,
+	"access.refresh_jwt":         rolePublic,
+	"access.info":                rolePublic,
+	"access.logout":              roleViewer,
+	"access.get_user":            roleViewer,
+	"access.user.password":       roleViewer,
+	"access.oneshot_token":       roleViewer,
+	"access.post_user":           roleAdmin,
+	"access.delete_user":         roleAdmin,
+	"access.user.role":           roleAdmin,
+	"access.users.list":          roleAdmin,
+	"access.get_api_key":         roleAdmin,
+	"access.post_api_key":        roleAdmin,
+
+	"server.websocket.id":               roleViewer,
+	"server.connection.list":            roleAdmin,
+	"connection.register_remote_method": roleOperator,
+	"connection.send_event":             roleOperator,
+
+	"server.config":               roleViewer,
+	"server.temperature_store":    roleViewer,
+	"server.gcode_store":          roleViewer,
+	"server.announcements.list":   roleViewer,
+	"server.announcements.update": roleOperator,
+	"server.webcams.list":         roleViewer,
+
+	"printer.info":              roleViewer,
+	"printer.objects.list":      roleViewer,
+	"printer.objects.query":     roleViewer,
+	"printer.objects.subscribe": roleViewer,
+	"printer.gcode.script":      roleOperator,
+	"printer.print.start":       roleOperator,
+	"printer.print.pause":       roleOperator,
+	"printer.print.resume":      roleOperator,
+	"printer.print.cancel":      roleOperator,
+	"printer.emergency_stop":    roleOperator,
+
+	"server.files.list":             roleViewer,
+	"server.files.metadata":         roleViewer,
+	"server.files.get_directory":    roleViewer,
+	"server.files.roots":            roleViewer,
+	"server.files.objects":          roleViewer,
+	"server.files.validate":         roleViewer,
+	"server.files.post_directory":   roleOperator,
+	"server.files.delete_directory": roleOperator,
+	"server.files.delete_file":      roleOperator,
+	"server.files.move":             roleOperator,
+	"server.files.calibration":      roleOperator,
+
+	"machine.system_info":      roleViewer,
+	"machine.proc_stats":       roleViewer,
+	"machine.services.list":    roleViewer,
+	"machine.services.restart": roleAdmin,
+	"machine.services.stop":    roleAdmin,
+	"machine.services.start":   roleAdmin,
+
+	"server.database.list":        roleViewer,
+	"server.database.get_item":    roleViewer,
+	"server.database.post_item":   roleAdmin,
+	"server.database.delete_item": roleAdmin,
+
+	"server.history.list":         roleViewer,
+	"server.history.get_job":      roleViewer,
+	"server.history.totals":       roleViewer,
+	"server.history.delete_job":   roleOperator,
+	"server.history.reset_totals": roleAdmin,
+
+	"server.spoolman.status":        roleViewer,
+	"server.spoolman.get_spool_id":  roleViewer,
+	"server.spoolman.post_spool_id": roleOperator,
+	"server.spoolman.proxy":         roleOperator,
+}
+
+// permitPath checks that user may use the file or directory at path, for
+// routes and methods whose root comes in a parameter routeRoles can't see.
+// Their role covers the gcodes root; the config root holds the bridge's
+// own config, with the printer token and the auth settings, so it and
+// anything outside the roots need admin.
+func (s *Server) permitPath(user, path string) error {
+	if s.fileManager.RootOf(path) == "gcodes" {
+		return nil
+	}
+	return s.auth.permit(user, roleAdmin)
+}
+
+// routeRole returns the role needed for the route matching pattern. A
+// request matching no route gets a 404 from the mux, so needs only to be
+// authorized.
+func routeRole(pattern string) role {
+	if pattern == "" {
+		return roleViewer
+	}
+	if r, ok := routeRoles[pattern]; ok {
+		return r
+	}
+	return roleAdmin
+}
+
+func methodRole(method string) role {
+	if r, ok := methodRoles[method]; ok {
+		return r
+	}
+	return roleAdmin
+}
+
+// roleOf returns the role of user, as returned by authenticate.
+func (a *authManager) roleOf(user string) role {
+	if !a.enabled {
+		return roleAdmin
+	}
+	switch user {
+	case "":
+		return rolePublic
+	case guestUser:
+		return roleViewer
+	case trustedUser:
+		return a.trustedRole
+	case apiKeyUser:
+		return a.apiKeyRole
+	case socketUser:
+		return roleAdmin
+	}
+	u, ok := a.user(user)
+	if !ok {
+		return rolePublic
+	}
+	// Accounts from before roles existed had full access.
+	if u.Role == "" {
+		return roleAdmin
+	}
+	r, err := parseRole(u.Role)
+	if err != nil {
+		return rolePublic
+	}
+	return r
+}
+
+// permit checks that user may do what needs role need: anonymous clients
+// and guests get 401, so they are asked to log in, and users without the
+// role get 403.
+func (a *authManager) permit(user string, need role) error {
+	have := a.roleOf(user)
+	if have >= need {
+		return nil
+	}
+	if user == "" || user == guestUser {
+		return errUnauthorized
+	}
+	return &apiError{http.StatusForbidden, fmt.Sprintf("Forbidden: needs %s role, %s has %s", need, user, have)}
+}
+
+// authMiddleware rejects requests the client may not make and records the
+// user of those it may.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := s.mux.Handler(r)
+		need := routeRole(pattern)
+		user, err := s.auth.authenticate(r)
+		if err == nil {
+			err = s.auth.permit(user, need)
+		} else if need == rolePublic {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Denied %s %s from %s: %v", r.Method, r.URL.Path, clientIP(r), err)
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
@@ -2,12 +2,18 @@ package moonraker
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"regexp"
+	"sync"
 
+	"github.com/gorilla/websocket"
 	"github.com/john/snapmaker_moonraker/database"
 	"github.com/john/snapmaker_moonraker/files"
+	"github.com/john/snapmaker_moonraker/gcode"
 	"github.com/john/snapmaker_moonraker/history"
 	"github.com/john/snapmaker_moonraker/printer"
 	"github.com/john/snapmaker_moonraker/spoolman"
@@ -17,15 +23,26 @@ import (
 type ServerConfig struct {
 	Host string
 	Port int
+	// SSLPort serves HTTPS as well when non-zero, with the certificate in
+	// CertFile and KeyFile; a self-signed one is made if neither exists.
+	SSLPort      int
+	CertFile     string
+	KeyFile      string
+	RedirectHTTP bool // redirect plain HTTP to HTTPS
+	// UnixSocket is the path of the Unix socket API; empty disables it.
+	UnixSocket string
 }
 
 // Config is the full application config passed to the server.
 type Config struct {
 	Server  ServerConfig
+	Auth    AuthConfig
 	Printer struct {
-		IP    string
-		Token string
-		Model string
+		IP           string
+		Token        string
+		Model        string
+		PrintMode    string // "upload" or "stream"
+		StreamWindow int
 	}
 	Files struct {
 		GCodeDir string
@@ -33,6 +50,11 @@ type Config struct {
 	Spoolman struct {
 		Server string
 	}
+	GCode struct {
+		Validation string // "warn", "block" or "off"
+		Transforms []gcode.StageConfig
+		Standby    gcode.StandbyConfig
+	}
 }
 
 // Server is the Moonraker-compatible HTTP/WebSocket server.
@@ -40,6 +62,8 @@ type Server struct {
 	config        Config
 	mux           *http.ServeMux
 	httpServer    *http.Server
+	httpsServer   *http.Server // nil unless SSLPort is set
+	unixListener  net.Listener // nil unless UnixSocket is set
 	printerClient *printer.Client
 	state         *printer.State
 	fileManager   *files.Manager
@@ -47,12 +71,29 @@ type Server struct {
 	history       *history.Manager
 	spoolman      *spoolman.Manager
 	wsHub         *WSHub
+	model         *objectModel
 	tempStore     *TempStore
 	nfcState      *NFCState
+	auth          *authManager
+	corsDomains   []*regexp.Regexp
+	upgrader      websocket.Upgrader
+
+	jobMu     sync.Mutex
+	job       *printJob // print last started by the bridge
+	excluding bool      // a mid-print exclusion is in progress
+
+	pauses pauseSchedule
+
+	cache      *gcode.Cache       // processed files, see SetCache
+	preprocess chan preprocessJob // uploads to process into cache
 }
 
 // NewServer creates a new Moonraker server.
-func NewServer(cfg Config, pc *printer.Client, st *printer.State, fm *files.Manager, db *database.Database, hist *history.Manager, sm *spoolman.Manager) *Server {
+func NewServer(cfg Config, pc *printer.Client, st *printer.State, fm *files.Manager, db *database.Database, hist *history.Manager, sm *spoolman.Manager) (*Server, error) {
+	auth, err := newAuthManager(cfg.Auth, db)
+	if err != nil {
+		return nil, fmt.Errorf("initializing authorization: %w", err)
+	}
 	s := &Server{
 		config:        cfg,
 		mux:           http.NewServeMux(),
@@ -64,16 +105,41 @@ func NewServer(cfg Config, pc *printer.Client, st *printer.State, fm *files.Mana
 		spoolman:      sm,
 		tempStore:     NewTempStore(1200),
 		nfcState:      NewNFCState(),
+		auth:          auth,
+	}
+	for _, d := range cfg.Auth.CORSDomains {
+		s.corsDomains = append(s.corsDomains, compileCORSDomain(d))
 	}
+	s.upgrader.CheckOrigin = s.checkOrigin
 
 	s.wsHub = NewWSHub(s)
+	s.model = newObjectModel(s)
+	if pc != nil {
+		pc.SetLineCallback(s.checkPauses)
+		pc.SetUploadCallback(s.broadcastUploadProgress)
+	}
 	s.registerRoutes()
+	handler := s.corsMiddleware(s.authMiddleware(s.mux))
 	s.httpServer = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
-		Handler: corsMiddleware(s.mux),
+		Handler: handler,
+	}
+	if cfg.Server.SSLPort != 0 {
+		certs, err := newCertStore(cfg.Server.CertFile, cfg.Server.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.httpsServer = &http.Server{
+			Addr:      fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.SSLPort),
+			Handler:   handler,
+			TLSConfig: &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12},
+		}
+		if cfg.Server.RedirectHTTP {
+			s.httpServer.Handler = s.redirectHTTPS(handler)
+		}
 	}
 
-	return s
+	return s, nil
 }
 
 // SetSpoolman replaces the spoolman manager (used to rewire callbacks after server creation).
@@ -97,17 +163,18 @@ func (s *Server) registerRoutes() {
 	s.registerFileHandlers()
 	s.registerDatabaseHandlers()
 	s.registerHistoryHandlers()
+	s.registerAccessHandlers()
 	if s.spoolman != nil {
 		s.registerSpoolmanHandlers()
 	}
 
-	// WebSocket endpoint.
+	// WebSocket endpoint, and the same API over HTTP.
 	s.mux.HandleFunc("GET /websocket", s.wsHub.HandleWebSocket)
+	s.mux.HandleFunc("POST /server/jsonrpc", s.handleJSONRPC)
+	s.mux.HandleFunc("GET /server/events", s.handleEvents)
 
 	// Root access endpoint (some frontends check this).
 	s.mux.HandleFunc("GET /{$}", s.handleRoot)
-	s.mux.HandleFunc("GET /access/info", s.handleAccessInfo)
-	s.mux.HandleFunc("GET /access/api_key", s.handleAccessAPIKey)
 }
 
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -116,44 +183,35 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) handleAccessAPIKey(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, map[string]interface{}{
-		"result": "snapmaker-moonraker-api-key",
-	})
-}
-
-func (s *Server) handleAccessInfo(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, map[string]interface{}{
-		"result": map[string]interface{}{
-			"default_source":  "moonraker",
-			"available_sources": []string{"moonraker"},
-		},
-	})
-}
-
-// Start begins serving HTTP requests.
+// Start begins serving HTTP, and HTTPS and the Unix socket if configured,
+// until Shutdown or either server fails.
 func (s *Server) Start() error {
+	if path := s.config.Server.UnixSocket; path != "" {
+		ln, err := s.listenUnix(path)
+		if err != nil {
+			return fmt.Errorf("unix socket: %w", err)
+		}
+		s.unixListener = ln
+		log.Printf("Moonraker API on Unix socket %s", path)
+		go s.serveUnix(ln)
+	}
+	errc := make(chan error, 2)
+	if s.httpsServer != nil {
+		log.Printf("Moonraker server starting on %s (HTTPS)", s.httpsServer.Addr)
+		go func() { errc <- s.httpsServer.ListenAndServeTLS("", "") }()
+	}
 	log.Printf("Moonraker server starting on %s", s.httpServer.Addr)
-	return s.httpServer.ListenAndServe()
+	go func() { errc <- s.httpServer.ListenAndServe() }()
+	return <-errc
 }
 
 // Shutdown gracefully shuts down the server.
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.unixListener != nil {
+		s.unixListener.Close() // also removes the socket file
+	}
+	if s.httpsServer != nil {
+		s.httpsServer.Shutdown(ctx)
+	}
 	return s.httpServer.Shutdown(ctx)
 }
-
-// corsMiddleware adds CORS headers for frontend compatibility.
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Api-Key, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
@@ -0,0 +1,96 @@
+package moonraker
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so
+// proxies keep it open.
+const sseKeepAlive = 30 * time.Second
+
+// sseEvents are the notifications an event stream carries besides status
+// updates.
+var sseEvents = map[string]bool{
+	"notify_history_changed":  true,
+	"notify_filelist_changed": true,
+	"notify_gcode_response":   true,
+}
+
+// sseWriter writes a client's messages as Server-Sent Events, typed by
+// method, each with the JSON-RPC notification as data.
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s *sseWriter) write(msg wsMessage) error {
+	s.rc.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	var err error
+	if len(msg.data) == 0 {
+		_, err = fmt.Fprint(s.w, ": keepalive\n\n")
+	} else {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", msg.event, msg.data)
+	}
+	if err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// handleEvents handles GET /server/events: a Server-Sent Events stream of
+// status updates for the objects in the query string, as for
+// /printer/objects/query, and of history, file list and G-code response
+// notifications. It is a hub client like a WebSocket subscriber, so it
+// starts with the full status and then gets only changes. EventSource
+// can't set headers, so browsers authorize with access_token or a
+// oneshot token in the URL.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	h := s.wsHub
+	requested := objectsFromQuery(r.URL.Query())
+
+	client := newWSClient(nil)
+	client.sse = &sseWriter{w: w, rc: http.NewResponseController(w)}
+	client.events = sseEvents
+	client.user = requestUser(r)
+	client.ip = clientIP(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer it
+	w.WriteHeader(http.StatusOK)
+
+	h.register(client)
+	defer h.unregister(client)
+	if len(requested) > 0 {
+		h.mu.Lock()
+		status, version, eventtime := s.queryObjects(requested)
+		client.subscribed = requested
+		client.isSubscribed = true
+		client.statusVersion = version
+		client.queueStatus(status, eventtime)
+		h.mu.Unlock()
+	}
+	log.Printf("Event stream %d opened from %s", client.id, r.RemoteAddr)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(sseKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				client.enqueue(wsMessage{data: []byte{}}, true)
+			case <-r.Context().Done():
+				client.disconnect("")
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	client.writeLoop()
+}
@@ -0,0 +1,126 @@
+package moonraker
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/john/snapmaker_moonraker/printer"
+)
+
+// startTime anchors eventtime, which like Klipper's is a monotonic clock
+// in seconds.
+var startTime = time.Now()
+
+func eventTime() float64 {
+	return time.Since(startTime).Seconds()
+}
+
+// objectModel is the printer object tree, rebuilt once per state change
+// rather than once per client. Each change bumps the version, and every
+// field remembers the version it last changed in, so a subscriber can be
+// sent just the fields that changed since its last update.
+type objectModel struct {
+	objects *PrinterObjects
+
+	mu        sync.Mutex
+	version   uint64
+	eventtime float64
+	tree      map[string]interface{}
+	changed   map[string]map[string]uint64 // object -> field -> version
+}
+
+func newObjectModel(s *Server) *objectModel {
+	return &objectModel{
+		objects: &PrinterObjects{server: s},
+		changed: make(map[string]map[string]uint64),
+	}
+}
+
+// update rebuilds the tree from state and returns the version it is at.
+func (m *objectModel) update(state printer.StateData) uint64 {
+	tree := m.objects.BuildAll(state)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := m.version + 1
+	bumped := false
+	for name, obj := range tree {
+		fields, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var old map[string]interface{}
+		if m.tree != nil {
+			old, _ = m.tree[name].(map[string]interface{})
+		}
+		versions := m.changed[name]
+		if versions == nil {
+			versions = make(map[string]uint64, len(fields))
+			m.changed[name] = versions
+		}
+		for field, v := range fields {
+			if prev, ok := old[field]; ok && reflect.DeepEqual(prev, v) {
+				continue
+			}
+			versions[field] = next
+			bumped = true
+		}
+	}
+	m.tree = tree
+	if bumped {
+		m.version = next
+		m.eventtime = eventTime()
+	}
+	return m.version
+}
+
+// query returns the requested objects and fields of the current tree, as
+// printer.objects.query does, with the version and eventtime it is at.
+func (m *objectModel) query(requested map[string]interface{}) (map[string]interface{}, uint64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return queryTree(m.tree, requested), m.version, eventTime()
+}
+
+// queryObjects brings the model up to date and queries it, for
+// printer.objects.query and subscriptions.
+func (s *Server) queryObjects(requested map[string]interface{}) (map[string]interface{}, uint64, float64) {
+	s.model.update(s.state.Snapshot())
+	return s.model.query(requested)
+}
+
+// delta returns the requested fields that changed after version since,
+// or nil if none did, with the current version and the eventtime of the
+// latest change.
+func (m *objectModel) delta(requested map[string]interface{}, since uint64) (map[string]interface{}, uint64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if since >= m.version {
+		return nil, m.version, m.eventtime
+	}
+	var status map[string]interface{}
+	for name, obj := range queryTree(m.tree, requested) {
+		fields, ok := obj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		versions := m.changed[name]
+		var diff map[string]interface{}
+		for field, v := range fields {
+			if versions[field] > since {
+				if diff == nil {
+					diff = make(map[string]interface{})
+				}
+				diff[field] = v
+			}
+		}
+		if diff != nil {
+			if status == nil {
+				status = make(map[string]interface{})
+			}
+			status[name] = diff
+		}
+	}
+	return status, m.version, m.eventtime
+}
@@ -0,0 +1,174 @@
+package moonraker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// certStore serves the certificate in certFile and keyFile, loading it
+// again when either file changes, so a renewed certificate is picked up
+// without a restart.
+type certStore struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest of the two files' modification times
+	checked time.Time
+}
+
+// newCertStore loads the certificate, generating a self-signed one first
+// if neither file exists.
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := generateSelfSigned(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("generating certificate: %w", err)
+		}
+		log.Printf("Generated self-signed certificate %s", certFile)
+	}
+	c := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certStore) filesModTime() (time.Time, error) {
+	ci, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ki, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ki.ModTime().After(ci.ModTime()) {
+		return ki.ModTime(), nil
+	}
+	return ci.ModTime(), nil
+}
+
+// load reads the certificate; must hold mu or be unshared.
+func (c *certStore) load() error {
+	mod, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, mod
+	return nil
+}
+
+// getCertificate is the TLS config's GetCertificate. A certificate that
+// fails to load, say while it is being replaced, leaves the previous one
+// in use.
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if mod, err := c.filesModTime(); err == nil && !mod.Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				log.Printf("Keeping current certificate: %v", err)
+			} else {
+				log.Printf("Reloaded certificate %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// generateSelfSigned writes a self-signed certificate for this host's
+// names and addresses, valid for ten years.
+func generateSelfSigned(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"snapmaker_moonraker"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname, hostname+".local")
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, n.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// redirectHTTPS sends plain HTTP requests to the HTTPS port. Requests from
+// this host, such as a local nginx proxy, are still served over HTTP.
+func (s *Server) redirectHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			target = h
+		}
+		target = net.JoinHostPort(target, strconv.Itoa(s.config.Server.SSLPort))
+		http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -3,6 +3,7 @@ package moonraker
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -17,10 +18,6 @@ const (
 	wsPongTimeout  = 60 * time.Second
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
 // jsonRPCRequest represents an incoming JSON-RPC 2.0 request.
 type jsonRPCRequest struct {
 	JSONRPC string      `json:"jsonrpc"`
@@ -51,29 +48,49 @@ type rpcError struct {
 
 // WSClient represents a connected WebSocket client.
 type WSClient struct {
+	id           int64
+	connected    time.Time
 	conn         *websocket.Conn
-	mu           sync.Mutex
+	sock         net.Conn               // instead of conn, for Unix socket clients
+	sse          *sseWriter             // instead of conn, for SSE streams
+	events       map[string]bool        // notifications the client takes; nil for all
 	subscribed   map[string]interface{} // object name -> requested fields
 	isSubscribed bool
-}
+	user         string // authorized user, "" until the connection logs in; set under WSHub.mu once registered
+	ip           net.IP
+	identity     *wsIdentity // set by server.connection.identify, under WSHub.mu
+
+	statusVersion uint64 // object model version last sent, under WSHub.mu
 
-func (c *WSClient) send(v interface{}) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.conn.WriteJSON(v)
+	// Outbound queue, written by writeLoop; see wsqueue.go.
+	out       chan wsMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu         sync.Mutex             // guards the fields below
+	status     map[string]interface{} // coalesced status update not yet written
+	statusGen  uint64                 // bumped when status is cleared
+	statusHeld bool                   // status waits for a subscription reply
+	eventtime  float64
+	behind     time.Time // when the queue passed wsLagDepth; zero if it hasn't
+	peak       int
+	dropped    uint64
+	coalesced  uint64
 }
 
 // WSHub manages all WebSocket clients.
 type WSHub struct {
-	mu      sync.RWMutex
-	clients map[*WSClient]bool
-	server  *Server
+	mu            sync.RWMutex
+	clients       map[*WSClient]bool
+	remoteMethods map[string]*WSClient // registered remote methods by name
+	server        *Server
 }
 
 func NewWSHub(s *Server) *WSHub {
 	return &WSHub{
-		clients: make(map[*WSClient]bool),
-		server:  s,
+		clients:       make(map[*WSClient]bool),
+		remoteMethods: make(map[string]*WSClient),
+		server:        s,
 	}
 }
 
@@ -85,15 +102,14 @@ func (h *WSHub) register(c *WSClient) {
 
 func (h *WSHub) unregister(c *WSClient) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
 	delete(h.clients, c)
+	h.mu.Unlock()
+	h.dropConnection(c)
 }
 
-// BroadcastStatusUpdate sends notify_status_update to all subscribed clients.
+// BroadcastStatusUpdate sends notify_status_update to all subscribed
+// clients, with only the fields that changed since each one's last update.
 func (h *WSHub) BroadcastStatusUpdate(state *printer.State) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
 	snap := state.Snapshot()
 
 	// Record temperature data for the temperature_store API.
@@ -101,21 +117,24 @@ func (h *WSHub) BroadcastStatusUpdate(state *printer.State) {
 		h.server.tempStore.Record(snap)
 	}
 
-	objects := &PrinterObjects{server: h.server}
+	h.server.model.update(snap)
+
+	// Updates are queued, never written here, so a slow client doesn't
+	// hold up the others or the state poller.
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
 	for client := range h.clients {
-		if !client.isSubscribed || len(client.subscribed) == 0 {
+		if !client.isSubscribed || len(client.subscribed) == 0 || !h.mayWatch(client) {
 			continue
 		}
 
-		status := objects.Query(snap, client.subscribed)
-		notification := jsonRPCNotification{
-			JSONRPC: "2.0",
-			Method:  "notify_status_update",
-			Params:  []interface{}{status, 0.0},
+		status, version, eventtime := h.server.model.delta(client.subscribed, client.statusVersion)
+		client.statusVersion = version
+		if status == nil {
+			continue
 		}
-
-		if err := client.send(notification); err != nil {
+		if err := client.queueStatus(status, eventtime); err != nil && err != errClientClosed {
 			log.Printf("WebSocket send error: %v", err)
 		}
 	}
@@ -126,19 +145,30 @@ func (h *WSHub) BroadcastNotification(method string, params interface{}) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	notification := jsonRPCNotification{
+	data, err := json.Marshal(jsonRPCNotification{
 		JSONRPC: "2.0",
 		Method:  method,
 		Params:  params,
+	})
+	if err != nil {
+		log.Printf("WebSocket broadcast error: %v", err)
+		return
 	}
 
 	for client := range h.clients {
-		if err := client.send(notification); err != nil {
-			log.Printf("WebSocket broadcast error: %v", err)
+		if h.mayWatch(client) {
+			client.notify(method, data)
 		}
 	}
 }
 
+// mayWatch reports whether c is authorized to receive status updates and
+// notifications, which are only for those who may watch the printer; must
+// hold h.mu.
+func (h *WSHub) mayWatch(c *WSClient) bool {
+	return h.server.auth.permit(c.user, roleViewer) == nil
+}
+
 // BroadcastHistoryChanged sends notify_history_changed to all clients.
 func (h *WSHub) BroadcastHistoryChanged(action string, job interface{}) {
 	h.BroadcastNotification("notify_history_changed", []interface{}{
@@ -156,7 +186,7 @@ func (h *WSHub) BroadcastGCodeResponse(response string) {
 
 // HandleWebSocket upgrades the HTTP connection to WebSocket and processes JSON-RPC.
 func (h *WSHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.server.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
@@ -171,19 +201,22 @@ func (h *WSHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
-	client := &WSClient{
-		conn:       conn,
-		subscribed: make(map[string]interface{}),
-	}
+	// Connections that aren't authorized yet may still log in over the
+	// socket, with access.login or server.connection.identify.
+	user, _ := h.server.auth.authenticate(r)
+	client := newWSClient(conn)
+	client.user = user
+	client.ip = clientIP(r)
 	h.register(client)
+	go client.writeLoop()
 
 	// Ping goroutine: sends pings at regular intervals to keep the connection alive.
-	// Uses WriteControl which is safe for concurrent use with other writers in
-	// gorilla/websocket, so we don't need client.mu here — acquiring it would
-	// let a slow BroadcastStatusUpdate starve pings and trigger a pong timeout.
+	// Uses WriteControl which is safe for concurrent use with writeLoop in
+	// gorilla/websocket, so pings aren't held up behind queued messages.
 	done := make(chan struct{})
 	defer func() {
 		close(done)
+		client.disconnect("")
 		// Send a proper WebSocket close frame before closing the TCP socket.
 		// Without this, the client sees close code 1005/1006 (abnormal) and
 		// triggers its reconnect loop.
@@ -210,7 +243,7 @@ func (h *WSHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	log.Printf("WebSocket client connected from %s", r.RemoteAddr)
+	log.Printf("WebSocket client %d connected from %s", client.id, r.RemoteAddr)
 
 	for {
 		_, message, err := conn.ReadMessage()
@@ -219,371 +252,319 @@ func (h *WSHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		var req jsonRPCRequest
-		if err := json.Unmarshal(message, &req); err != nil {
-			client.send(jsonRPCResponse{
-				JSONRPC: "2.0",
-				Error:   &rpcError{Code: -32700, Message: "Parse error"},
-				ID:      nil,
-			})
-			continue
-		}
-
-		h.handleRPC(client, &req)
+		h.reply(client, message)
 	}
 }
 
-func (h *WSHub) handleRPC(client *WSClient, req *jsonRPCRequest) {
+// handleRPC runs one request from client and returns its response.
+func (h *WSHub) handleRPC(client *WSClient, req *jsonRPCRequest) *jsonRPCResponse {
 	log.Printf("WebSocket RPC: method=%s id=%v", req.Method, req.ID)
 
-	var resp jsonRPCResponse
-	resp.JSONRPC = "2.0"
-	resp.ID = req.ID
+	resp := &jsonRPCResponse{JSONRPC: "2.0", ID: req.ID}
+
+	need := methodRole(req.Method)
+	remote := h.remoteMethodOwner(req.Method) != nil
+	if remote {
+		need = roleOperator
+	}
+	if err := h.server.auth.permit(client.user, need); err != nil {
+		resp.Error = newRPCError(err)
+		log.Printf("WebSocket RPC denied: method=%s: %v", req.Method, err)
+		return resp
+	}
+	if wsConnectionMethods[req.Method] && client.out == nil {
+		resp.Error = newRPCError(&apiError{http.StatusBadRequest, req.Method + " needs a persistent connection"})
+		return resp
+	}
+	if strings.HasPrefix(req.Method, "server.spoolman.") && h.server.spoolman == nil {
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "Spoolman not configured"}
+		return resp
+	}
+
+	params, _ := req.Params.(map[string]interface{})
+	var result interface{}
+	var err error
 
 	switch req.Method {
 	case "server.info":
-		resp.Result = h.server.serverInfo()
+		result = h.server.serverInfo()
 
 	case "server.connection.identify":
-		resp.Result = map[string]interface{}{
-			"connection_id": 1,
+		result, err = h.identify(client, req.Params)
+
+	case "server.websocket.id":
+		result = map[string]interface{}{"websocket_id": client.id}
+
+	case "server.connection.list":
+		result = h.connectionList()
+
+	case "connection.send_event":
+		result, err = "ok", h.sendAgentEvent(client, req.Params)
+
+	case "access.login", "access.logout", "access.refresh_jwt", "access.get_user",
+		"access.post_user", "access.delete_user", "access.users.list", "access.user.role",
+		"access.user.password", "access.get_api_key", "access.post_api_key",
+		"access.oneshot_token", "access.info":
+		result, err = h.server.accessRequest(req.Method, client.user, client.ip, params)
+		if err != nil {
+			break
+		}
+		h.mu.Lock()
+		switch req.Method {
+		case "access.login":
+			client.user = result.(map[string]interface{})["username"].(string)
+		case "access.logout":
+			client.user = ""
 		}
+		h.mu.Unlock()
 
 	case "connection.register_remote_method":
-		resp.Result = "ok"
+		result, err = "ok", h.registerRemoteMethod(client, extractStringParam(req.Params, "method_name"))
 
 	case "printer.info":
-		resp.Result = h.server.printerInfo()
+		result = h.server.printerInfo()
 
 	case "printer.objects.list":
 		objects := &PrinterObjects{server: h.server}
-		resp.Result = map[string]interface{}{
+		result = map[string]interface{}{
 			"objects": objects.AvailableObjects(),
 		}
 
 	case "printer.objects.query":
-		resp.Result = h.handleObjectsQuery(req)
+		result = h.handleObjectsQuery(req)
 
 	case "printer.objects.subscribe":
-		resp.Result = h.handleObjectsSubscribe(client, req)
+		result = h.handleObjectsSubscribe(client, req)
 
 	case "printer.gcode.script":
-		resp.Result = h.handleGCodeScript(req)
+		result, err = map[string]interface{}{}, h.server.runGCodeScript(extractStringParam(req.Params, "script"))
 
 	case "printer.print.start":
-		resp.Result = h.handlePrintStart(req)
+		result, err = map[string]interface{}{}, h.server.printStart(params)
 
 	case "printer.print.pause":
-		resp.Result = h.handlePrintControl("pause")
+		result, err = map[string]interface{}{}, h.server.printControl("pause")
 
 	case "printer.print.resume":
-		resp.Result = h.handlePrintControl("resume")
+		result, err = map[string]interface{}{}, h.server.printControl("resume")
 
 	case "printer.print.cancel":
-		resp.Result = h.handlePrintControl("cancel")
+		result, err = map[string]interface{}{}, h.server.printControl("cancel")
 
 	case "printer.emergency_stop":
-		resp.Result = h.handleEmergencyStop()
+		result, err = map[string]interface{}{}, h.server.emergencyStop()
 
 	case "server.files.list":
 		root := extractStringParam(req.Params, "root")
 		if root == "" {
 			root = "gcodes"
 		}
-		resp.Result = h.server.fileManager.ListFiles(root)
+		if err = h.server.permitPath(client.user, h.server.fileManager.GetRootPath(root)); err == nil {
+			result = h.server.fileManager.ListFiles(root)
+		}
 
 	case "server.config":
-		resp.Result = h.server.serverConfig()
+		result = h.server.serverConfig()
 
 	case "server.files.metadata":
-		resp.Result = h.handleFileMetadata(req)
+		result, err = h.handleFileMetadata(req)
 
 	case "server.files.get_directory":
-		resp.Result = h.handleFilesGetDirectory(req.Params)
+		result, err = h.handleFilesGetDirectory(client.user, req.Params)
 
 	case "server.files.post_directory":
-		resp.Result = h.handleFilesPostDirectory(req.Params)
+		result, err = h.server.createDirectory(client.user, extractStringParam(req.Params, "path"))
 
 	case "server.files.delete_directory":
-		resp.Result = h.handleFilesDeleteDirectory(req.Params)
+		result, err = h.server.deleteDirectory(extractStringParam(req.Params, "path"))
 
 	case "server.files.delete_file":
-		resp.Result = h.handleFilesDeleteFile(req.Params)
+		// Path comes as "root/filename" (e.g., "gcodes/wecreat_test.nc").
+		result, err = h.server.deleteFile(client.user, "gcodes", strings.TrimPrefix(extractStringParam(req.Params, "path"), "gcodes/"))
 
 	case "server.files.move":
-		resp.Result = h.handleFilesMove(req.Params)
+		result, err = h.server.moveFile(client.user, extractStringParam(req.Params, "source"), extractStringParam(req.Params, "dest"))
 
 	case "server.files.roots":
-		resp.Result = h.handleFilesRoots()
+		result = h.handleFilesRoots()
+
+	case "server.files.objects":
+		filename := extractStringParam(req.Params, "filename")
+		if filename == "" {
+			err = &apiError{http.StatusBadRequest, "filename is required"}
+		} else {
+			result, err = h.server.fileObjects(filename)
+		}
+
+	case "server.files.calibration":
+		result, err = h.server.generateCalibration(params)
+
+	case "server.files.validate":
+		filename := extractStringParam(req.Params, "filename")
+		if filename == "" {
+			err = &apiError{http.StatusBadRequest, "filename is required"}
+		} else if opts, optsErr := h.server.printOptions(params); optsErr != nil {
+			err = optsErr
+		} else {
+			result, err = h.server.validateFile(filename, opts)
+		}
 
 	case "machine.system_info":
-		resp.Result = h.server.machineSystemInfo()
+		result = h.server.machineSystemInfo()
 
 	case "machine.proc_stats":
-		resp.Result = h.server.machineProcStats()
+		result = h.server.machineProcStats()
 
 	case "machine.services.list":
-		resp.Result = h.server.machineServicesList()
+		result = h.server.machineServicesList()
 
 	case "machine.services.restart":
-		resp.Result = h.handleMachineServiceAction("restart", req.Params)
+		result, err = "ok", h.server.serviceAction("restart", extractStringParam(req.Params, "service"))
 
 	case "machine.services.stop":
-		resp.Result = h.handleMachineServiceAction("stop", req.Params)
+		result, err = "ok", h.server.serviceAction("stop", extractStringParam(req.Params, "service"))
 
 	case "machine.services.start":
-		resp.Result = h.handleMachineServiceAction("start", req.Params)
+		result, err = "ok", h.server.serviceAction("start", extractStringParam(req.Params, "service"))
 
 	case "server.temperature_store":
-		resp.Result = h.server.temperatureStore()
+		result = h.server.temperatureStore()
 
 	case "server.gcode_store":
-		resp.Result = h.server.gcodeStore()
+		result = h.server.gcodeStore()
 
 	case "server.announcements.list":
-		resp.Result = h.handleAnnouncementsList()
+		result = h.handleAnnouncementsList()
 
 	case "server.announcements.update":
-		resp.Result = h.handleAnnouncementsUpdate()
+		result = h.handleAnnouncementsUpdate()
 
 	case "server.webcams.list":
-		resp.Result = h.server.getWebcamsList()
+		result = h.server.getWebcamsList()
 
 	// Database methods
 	case "server.database.list":
-		resp.Result = h.handleDatabaseList()
+		result = h.handleDatabaseList()
 
 	case "server.database.get_item":
-		resp.Result = h.handleDatabaseGetItem(req.Params)
+		result, err = h.handleDatabaseGetItem(req.Params)
 
 	case "server.database.post_item":
-		resp.Result = h.handleDatabasePostItem(req.Params)
+		result, err = h.handleDatabasePostItem(req.Params)
 
 	case "server.database.delete_item":
-		resp.Result = h.handleDatabaseDeleteItem(req.Params)
+		result, err = h.handleDatabaseDeleteItem(req.Params)
 
 	// History methods
 	case "server.history.list":
-		resp.Result = h.handleHistoryList(req.Params)
+		result = h.handleHistoryList(req.Params)
 
 	case "server.history.get_job":
-		resp.Result = h.handleHistoryGetJob(req.Params)
+		result, err = h.handleHistoryGetJob(req.Params)
 
 	case "server.history.delete_job":
-		resp.Result = h.handleHistoryDeleteJob(req.Params)
+		result, err = h.handleHistoryDeleteJob(req.Params)
 
 	case "server.history.totals":
-		resp.Result = h.handleHistoryTotals()
+		result = h.handleHistoryTotals()
 
 	case "server.history.reset_totals":
-		resp.Result = h.handleHistoryResetTotals()
+		result = h.handleHistoryResetTotals()
 
 	// Spoolman methods
 	case "server.spoolman.status":
-		if h.server.spoolman == nil {
-			resp.Error = &rpcError{Code: -32601, Message: "Spoolman not configured"}
-		} else {
-			resp.Result = h.handleSpoolmanStatus()
-		}
+		result = h.handleSpoolmanStatus()
 
 	case "server.spoolman.get_spool_id":
-		if h.server.spoolman == nil {
-			resp.Error = &rpcError{Code: -32601, Message: "Spoolman not configured"}
-		} else {
-			resp.Result = h.handleSpoolmanGetSpoolID(req.Params)
-		}
+		result = h.handleSpoolmanGetSpoolID(req.Params)
 
 	case "server.spoolman.post_spool_id":
-		if h.server.spoolman == nil {
-			resp.Error = &rpcError{Code: -32601, Message: "Spoolman not configured"}
-		} else {
-			resp.Result = h.handleSpoolmanSetSpoolID(req.Params)
-		}
+		result, err = h.handleSpoolmanSetSpoolID(req.Params)
 
 	case "server.spoolman.proxy":
-		if h.server.spoolman == nil {
-			resp.Error = &rpcError{Code: -32601, Message: "Spoolman not configured"}
-		} else {
-			resp.Result = h.handleSpoolmanProxy(req.Params)
-		}
+		result, err = h.handleSpoolmanProxy(req.Params)
 
 	default:
+		if remote {
+			if err = h.callRemoteMethod(req.Method, req.Params); err != nil {
+				err = &apiError{http.StatusServiceUnavailable, err.Error()}
+			}
+			result = "ok"
+			break
+		}
 		log.Printf("WebSocket RPC: UNKNOWN method=%s", req.Method)
 		resp.Error = &rpcError{
-			Code:    -32601,
+			Code:    rpcMethodNotFound,
 			Message: "Method not found: " + req.Method,
 		}
 	}
 
+	if err != nil {
+		resp.Error = newRPCError(err)
+	} else if resp.Error == nil {
+		resp.Result = result
+	}
 	if resp.Error != nil {
 		log.Printf("WebSocket RPC error: method=%s code=%d msg=%s", req.Method, resp.Error.Code, resp.Error.Message)
 	}
+	return resp
+}
 
-	if err := client.send(resp); err != nil {
-		log.Printf("WebSocket response send error: %v", err)
+// identifyUser authorizes a connection from the access_token or api_key
+// passed to server.connection.identify. It returns "" if neither is given.
+func (h *WSHub) identifyUser(params interface{}) (string, error) {
+	a := h.server.auth
+	if !a.enabled {
+		return "", nil
+	}
+	if token := extractStringParam(params, "access_token"); token != "" {
+		return a.checkToken(token, "access")
+	}
+	if key := extractStringParam(params, "api_key"); key != "" {
+		if !a.checkAPIKey(key) {
+			return "", errUnauthorized
+		}
+		return apiKeyUser, nil
 	}
+	return "", nil
 }
 
 func (h *WSHub) handleObjectsQuery(req *jsonRPCRequest) interface{} {
-	objects := &PrinterObjects{server: h.server}
-	snap := h.server.state.Snapshot()
-
 	requested := extractObjectsParam(req.Params)
-	status := objects.Query(snap, requested)
+	status, _, eventtime := h.server.queryObjects(requested)
 
 	return map[string]interface{}{
-		"eventtime": 0.0,
+		"eventtime": eventtime,
 		"status":    status,
 	}
 }
 
+// handleObjectsSubscribe stores the subscription. Status updates are
+// held until the reply is sent, so none is written ahead of it.
 func (h *WSHub) handleObjectsSubscribe(client *WSClient, req *jsonRPCRequest) interface{} {
-	objects := &PrinterObjects{server: h.server}
-	snap := h.server.state.Snapshot()
-
 	requested := extractObjectsParam(req.Params)
 
-	// Store subscription.
+	// The reply carries the full status, so later updates need only what
+	// changed after its version.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, version, eventtime := h.server.queryObjects(requested)
 	client.subscribed = requested
 	client.isSubscribed = true
-
-	status := objects.Query(snap, requested)
+	client.statusVersion = version
+	client.clearStatus()
 
 	return map[string]interface{}{
-		"eventtime": 0.0,
+		"eventtime": eventtime,
 		"status":    status,
 	}
 }
 
-func (h *WSHub) handleGCodeScript(req *jsonRPCRequest) interface{} {
-	script := extractStringParam(req.Params, "script")
-	if script == "" {
-		return map[string]interface{}{}
-	}
-
-	// Intercept FIRMWARE_RESTART and RESTART to trigger printer reconnection.
-	upperScript := strings.ToUpper(strings.TrimSpace(script))
-	if upperScript == "FIRMWARE_RESTART" || upperScript == "RESTART" {
-		go func() {
-			if err := h.server.printerClient.Reconnect(); err != nil {
-				log.Printf("Reconnect failed: %v", err)
-				h.BroadcastNotification("notify_gcode_response", []interface{}{
-					"Error: reconnect failed - " + err.Error(),
-				})
-			} else {
-				h.BroadcastNotification("notify_gcode_response", []interface{}{
-					"Reconnected to printer successfully",
-				})
-			}
-		}()
-		return map[string]interface{}{}
-	}
-
-	// Intercept ? and HELP — these are Klipper console commands, not real GCode.
-	if upperScript == "?" || upperScript == "HELP" {
-		h.BroadcastNotification("notify_gcode_response", []interface{}{gcodeHelpText()})
-		return map[string]interface{}{}
-	}
-
-	// Intercept Klipper-specific commands (ACTIVATE_EXTRUDER, SET_HEATER_TEMPERATURE, etc.)
-	// and temperature GCodes (M104/M109/M140/M190) to route through SACP directly.
-	if handled, err := h.server.interceptGCode(script); handled {
-		if err != nil {
-			log.Printf("GCode intercept error: %v", err)
-			h.BroadcastNotification("notify_gcode_response", []interface{}{
-				"Error: " + err.Error(),
-			})
-		}
-		return map[string]interface{}{}
-	}
-
-	result, err := h.server.printerClient.ExecuteGCode(script)
-	if err != nil {
-		log.Printf("GCode execution error: %v", err)
-		h.BroadcastNotification("notify_gcode_response", []interface{}{
-			"Error: " + err.Error(),
-		})
-		return map[string]interface{}{}
-	}
-
-	// Send gcode response notification.
-	if result != "" {
-		h.BroadcastNotification("notify_gcode_response", []interface{}{result})
-	}
-
-	return map[string]interface{}{}
+func (h *WSHub) handleFileMetadata(req *jsonRPCRequest) (interface{}, error) {
+	return h.server.fileMetadata(extractStringParam(req.Params, "filename"))
 }
 
-func (h *WSHub) handlePrintStart(req *jsonRPCRequest) interface{} {
-	filename := extractStringParam(req.Params, "filename")
-	if filename == "" {
-		return map[string]interface{}{}
-	}
-
-	if _, err := h.server.fileManager.StatFile("gcodes", filename); err != nil {
-		log.Printf("Error reading file for print: %v", err)
-		return map[string]interface{}{}
-	}
-
-	srcPath := h.server.fileManager.FilePath("gcodes", filename)
-	if err := h.server.printerClient.Upload(filename, srcPath); err != nil {
-		log.Printf("Error uploading to printer: %v", err)
-		return map[string]interface{}{}
-	}
-
-	h.server.StartSpoolmanTracking(filename)
-
-	return map[string]interface{}{}
-}
-
-func (h *WSHub) handlePrintControl(action string) interface{} {
-	var err error
-	switch action {
-	case "pause":
-		err = h.server.printerClient.PausePrint()
-	case "resume":
-		err = h.server.printerClient.ResumePrint()
-	case "cancel":
-		err = h.server.printerClient.StopPrint()
-	}
-
-	if err != nil {
-		log.Printf("Print %s error: %v", action, err)
-	}
-
-	return map[string]interface{}{}
-}
-
-func (h *WSHub) handleEmergencyStop() interface{} {
-	if _, err := h.server.printerClient.ExecuteGCode("M112"); err != nil {
-		log.Printf("Emergency stop error: %v", err)
-	}
-	return map[string]interface{}{}
-}
-
-func (h *WSHub) handleFileMetadata(req *jsonRPCRequest) interface{} {
-	filename := extractStringParam(req.Params, "filename")
-	if filename == "" {
-		return map[string]interface{}{
-			"filename": "",
-			"size":     0,
-			"modified": float64(0),
-		}
-	}
-
-	meta, err := h.server.fileManager.GetMetadata("gcodes", filename)
-	if err != nil {
-		return map[string]interface{}{
-			"filename": filename,
-			"size":     0,
-			"modified": float64(0),
-		}
-	}
-	h.server.enrichMetadataFromHistory(filename, meta)
-	return meta
-}
-
-func (h *WSHub) handleFilesGetDirectory(params interface{}) interface{} {
+func (h *WSHub) handleFilesGetDirectory(user string, params interface{}) (interface{}, error) {
 	path := extractStringParam(params, "path")
 	root := extractStringParam(params, "root")
 	if root == "" {
@@ -596,154 +577,10 @@ func (h *WSHub) handleFilesGetDirectory(params interface{}) interface{} {
 			root = "gcodes"
 		}
 	}
-	return h.server.fileManager.GetDirectory(root, path)
-}
-
-func (h *WSHub) handleFilesDeleteFile(params interface{}) interface{} {
-	path := extractStringParam(params, "path")
-	if path == "" {
-		return map[string]interface{}{}
-	}
-
-	// Path comes as "root/filename" (e.g., "gcodes/wecreat_test.nc").
-	root := "gcodes"
-	filePath := path
-	if strings.HasPrefix(path, "gcodes/") {
-		filePath = strings.TrimPrefix(path, "gcodes/")
-	}
-
-	if err := h.server.fileManager.DeleteFile(root, filePath); err != nil {
-		log.Printf("Delete file error: %v", err)
-		return map[string]interface{}{}
-	}
-
-	h.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "delete_file",
-			"item": map[string]interface{}{
-				"root": root,
-				"path": filePath,
-			},
-		},
-	})
-
-	return map[string]interface{}{
-		"item": map[string]interface{}{
-			"path": filePath,
-			"root": root,
-		},
-		"action": "delete_file",
-	}
-}
-
-func (h *WSHub) handleFilesPostDirectory(params interface{}) interface{} {
-	path := extractStringParam(params, "path")
-	if path == "" {
-		return map[string]interface{}{}
-	}
-
-	root := "gcodes"
-	dirPath := path
-	if strings.HasPrefix(path, "gcodes/") {
-		dirPath = strings.TrimPrefix(path, "gcodes/")
-	} else if path == "gcodes" {
-		dirPath = ""
-	}
-
-	if err := h.server.fileManager.CreateDirectory(root, dirPath); err != nil {
-		log.Printf("Create directory error: %v", err)
-		return map[string]interface{}{}
-	}
-
-	h.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "create_dir",
-			"item": map[string]interface{}{
-				"root": root,
-				"path": dirPath,
-			},
-		},
-	})
-
-	return map[string]interface{}{
-		"item": map[string]interface{}{
-			"path": dirPath,
-			"root": root,
-		},
-		"action": "create_dir",
-	}
-}
-
-func (h *WSHub) handleFilesDeleteDirectory(params interface{}) interface{} {
-	path := extractStringParam(params, "path")
-	if path == "" {
-		return map[string]interface{}{}
-	}
-
-	root := "gcodes"
-	dirPath := path
-	if strings.HasPrefix(path, "gcodes/") {
-		dirPath = strings.TrimPrefix(path, "gcodes/")
-	}
-
-	if err := h.server.fileManager.DeleteDirectory(root, dirPath); err != nil {
-		log.Printf("Delete directory error: %v", err)
-		return map[string]interface{}{}
-	}
-
-	h.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "delete_dir",
-			"item": map[string]interface{}{
-				"root": root,
-				"path": dirPath,
-			},
-		},
-	})
-
-	return map[string]interface{}{
-		"item": map[string]interface{}{
-			"path": dirPath,
-			"root": root,
-		},
-		"action": "delete_dir",
-	}
-}
-
-func (h *WSHub) handleFilesMove(params interface{}) interface{} {
-	source := extractStringParam(params, "source")
-	dest := extractStringParam(params, "dest")
-	if source == "" || dest == "" {
-		return map[string]interface{}{}
-	}
-
-	srcPath := h.server.fileManager.ResolvePath(source)
-	dstPath := h.server.fileManager.ResolvePath(dest)
-
-	if err := h.server.fileManager.MoveFile(srcPath, dstPath); err != nil {
-		log.Printf("Move file error: %v", err)
-		return map[string]interface{}{}
-	}
-
-	h.BroadcastNotification("notify_filelist_changed", []interface{}{
-		map[string]interface{}{
-			"action": "move_file",
-			"item": map[string]interface{}{
-				"path":        dest,
-				"root":        "gcodes",
-				"source_path": source,
-			},
-		},
-	})
-
-	return map[string]interface{}{
-		"item": map[string]interface{}{
-			"path":        dest,
-			"root":        "gcodes",
-			"source_path": source,
-		},
-		"action": "move_file",
+	if err := h.server.permitPath(user, h.server.fileManager.FilePath(root, path)); err != nil {
+		return nil, err
 	}
+	return h.server.fileManager.GetDirectory(root, path), nil
 }
 
 func (h *WSHub) handleFilesRoots() interface{} {
@@ -768,15 +605,6 @@ func (h *WSHub) handleAnnouncementsList() interface{} {
 	}
 }
 
-func (h *WSHub) handleMachineServiceAction(action string, params interface{}) interface{} {
-	service := extractStringParam(params, "service")
-	if err := h.server.serviceAction(action, service); err != nil {
-		log.Printf("Service %s error: %v", action, err)
-		return map[string]interface{}{"error": err.Error()}
-	}
-	return "ok"
-}
-
 func (h *WSHub) handleAnnouncementsUpdate() interface{} {
 	return map[string]interface{}{
 		"modified": false,
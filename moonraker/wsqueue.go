@@ -0,0 +1,312 @@
+package moonraker
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsQueueSize    = 1024             // messages a client may have waiting
+	wsLagDepth     = wsQueueSize / 4  // depth at which a client counts as behind
+	wsLagTimeout   = 30 * time.Second // how long a client may stay behind
+	wsWriteTimeout = 10 * time.Second
+)
+
+// wsDroppable are notifications a client that is behind may miss, as each
+// is superseded by the next. Everything else is delivered or the client
+// is disconnected, so it reconnects and catches up.
+var wsDroppable = map[string]bool{
+	"notify_upload_progress":  true,
+	"notify_proc_stat_update": true,
+}
+
+var errClientClosed = errors.New("websocket client closed")
+
+// wsMessage is an encoded message, or with nil data a marker for where
+// the pending status update of generation gen is written. Notifications
+// carry their method, the event type on an SSE stream.
+type wsMessage struct {
+	data  []byte
+	gen   uint64
+	event string
+}
+
+// wsSlowDisconnects counts clients disconnected for falling behind.
+var wsSlowDisconnects atomic.Int64
+
+// newWSClient returns a client for conn. Its messages are written by
+// writeLoop, so a slow client never holds up broadcasts to the others.
+func newWSClient(conn *websocket.Conn) *WSClient {
+	return &WSClient{
+		id:         lastConnectionID.Add(1),
+		connected:  time.Now(),
+		conn:       conn,
+		subscribed: make(map[string]interface{}),
+		out:        make(chan wsMessage, wsQueueSize),
+		closed:     make(chan struct{}),
+	}
+}
+
+// send queues v for the client. It never blocks.
+func (c *WSClient) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(wsMessage{data: data}, false)
+}
+
+// enqueue queues a message. A client whose queue is full, or that stays
+// behind longer than wsLagTimeout, is disconnected.
+func (c *WSClient) enqueue(msg wsMessage, droppable bool) error {
+	select {
+	case <-c.closed:
+		return errClientClosed
+	default:
+	}
+
+	c.mu.Lock()
+	depth := len(c.out)
+	if depth < wsLagDepth {
+		c.behind = time.Time{}
+	} else {
+		if c.behind.IsZero() {
+			c.behind = time.Now()
+		}
+		if droppable {
+			c.dropped++
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	lagging := !c.behind.IsZero() && time.Since(c.behind) > wsLagTimeout
+	full := false
+	if !lagging {
+		select {
+		case c.out <- msg:
+			if depth+1 > c.peak {
+				c.peak = depth + 1
+			}
+		default:
+			full = true
+		}
+	}
+	c.mu.Unlock()
+
+	switch {
+	case lagging:
+		c.disconnect("behind for over " + wsLagTimeout.String())
+	case full:
+		c.disconnect("outbound queue full")
+	default:
+		return nil
+	}
+	wsSlowDisconnects.Add(1)
+	return errClientClosed
+}
+
+// notify queues a notification encoded once for all clients, unless the
+// client takes only some.
+func (c *WSClient) notify(method string, data []byte) error {
+	if c.events != nil && !c.events[method] {
+		return nil
+	}
+	return c.enqueue(wsMessage{data: data, event: method}, wsDroppable[method])
+}
+
+// queueStatus merges a status delta into the one waiting to be written,
+// so a client that is behind gets one update with the latest values
+// rather than every update in turn.
+func (c *WSClient) queueStatus(status map[string]interface{}, eventtime float64) error {
+	c.mu.Lock()
+	pending := c.status != nil
+	if !pending {
+		c.status = make(map[string]interface{}, len(status))
+	} else {
+		c.coalesced++
+	}
+	for name, obj := range status {
+		fields, _ := obj.(map[string]interface{})
+		merged, ok := c.status[name].(map[string]interface{})
+		if !ok {
+			merged = make(map[string]interface{}, len(fields))
+			c.status[name] = merged
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+	}
+	c.eventtime = eventtime
+	gen, held := c.statusGen, c.statusHeld
+	c.mu.Unlock()
+	if pending || held {
+		return nil
+	}
+	// The marker keeps the update in order with responses and
+	// notifications queued around it.
+	return c.enqueue(wsMessage{gen: gen}, false)
+}
+
+// clearStatus drops a status update waiting to be written, which a new
+// subscription's reply supersedes. Markers already queued are skipped,
+// and later updates are held until releaseStatus, once the reply is
+// queued.
+func (c *WSClient) clearStatus() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = nil
+	c.statusGen++
+	c.statusHeld = true
+}
+
+// releaseStatus queues the status update held by clearStatus, if any.
+func (c *WSClient) releaseStatus() {
+	c.mu.Lock()
+	if !c.statusHeld {
+		c.mu.Unlock()
+		return
+	}
+	c.statusHeld = false
+	pending, gen := c.status != nil, c.statusGen
+	c.mu.Unlock()
+	if pending {
+		c.enqueue(wsMessage{gen: gen}, false)
+	}
+}
+
+// writeLoop writes queued messages until the client closes.
+func (c *WSClient) writeLoop() {
+	for {
+		select {
+		case msg := <-c.out:
+			if msg.data == nil {
+				if msg.data = c.takeStatus(msg.gen); msg.data == nil {
+					continue
+				}
+				msg.event = "notify_status_update"
+			}
+			if err := c.write(msg); err != nil {
+				c.disconnect("write: " + err.Error())
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// write writes a message: a WebSocket text frame, on the Unix socket the
+// message and an ETX byte, as Moonraker frames them, or an SSE event.
+func (c *WSClient) write(msg wsMessage) error {
+	switch {
+	case c.sse != nil:
+		return c.sse.write(msg)
+	case c.sock != nil:
+		c.sock.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		_, err := c.sock.Write(append(msg.data, socketETX))
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, msg.data)
+}
+
+// takeStatus encodes and clears the waiting status update of generation
+// gen, if it hasn't been cleared.
+func (c *WSClient) takeStatus(gen uint64) []byte {
+	c.mu.Lock()
+	if gen != c.statusGen {
+		c.mu.Unlock()
+		return nil
+	}
+	status, eventtime := c.status, c.eventtime
+	c.status = nil
+	c.mu.Unlock()
+	if len(status) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(jsonRPCNotification{
+		JSONRPC: "2.0",
+		Method:  "notify_status_update",
+		Params:  []interface{}{status, eventtime},
+	})
+	if err != nil {
+		log.Printf("WebSocket %d: encoding status update: %v", c.id, err)
+		return nil
+	}
+	return data
+}
+
+// disconnect stops the writer and closes the connection, which ends the
+// read loop and unregisters the client. Clients dropped for falling
+// behind are told to try again later.
+func (c *WSClient) disconnect(reason string) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if reason == "" {
+			return
+		}
+		log.Printf("WebSocket %d disconnected: %s", c.id, reason)
+		if c.sse != nil {
+			return // the handler returns once writeLoop does
+		}
+		if c.sock != nil {
+			c.sock.Close()
+			return
+		}
+		_ = c.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason),
+			time.Now().Add(time.Second),
+		)
+		c.conn.Close()
+	})
+}
+
+// queueInfo reports the client's outbound queue.
+func (c *WSClient) queueInfo() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"depth":     len(c.out),
+		"peak":      c.peak,
+		"dropped":   c.dropped,
+		"coalesced": c.coalesced,
+	}
+}
+
+// queueStats sums the outbound queues of all clients, for proc_stats.
+func (h *WSHub) queueStats() map[string]interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var depth, maxDepth, peak int
+	var dropped, coalesced uint64
+	for c := range h.clients {
+		c.mu.Lock()
+		n := len(c.out)
+		depth += n
+		if n > maxDepth {
+			maxDepth = n
+		}
+		if c.peak > peak {
+			peak = c.peak
+		}
+		dropped += c.dropped
+		coalesced += c.coalesced
+		c.mu.Unlock()
+	}
+	return map[string]interface{}{
+		"connections":      len(h.clients),
+		"queued":           depth,
+		"max_depth":        maxDepth,
+		"peak_depth":       peak,
+		"capacity":         wsQueueSize,
+		"dropped":          dropped,
+		"coalesced":        coalesced,
+		"slow_disconnects": wsSlowDisconnects.Load(),
+	}
+}
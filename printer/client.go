@@ -2,7 +2,9 @@ package printer
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
@@ -39,8 +41,18 @@ type Client struct {
 	totalLines    uint32
 	printTime     uint32 // elapsed seconds
 	printFilename string
+	printIndex    *gcode.PrintIndex // index of indexPath, see SetPrintIndex
+	indexPath     string
+	printSource   string // file last processed for printing, see PrintCacheKey
+	printKey      string // its cache key
 	fanData       []sacp.FanData
 	coordData     sacp.CoordinateData
+	onLine        func(line int) // see SetLineCallback
+	stream        *stream        // print the bridge is streaming, see StreamPrint
+	cache         *gcode.Cache   // processed files, see SetCache
+	uploads       *deliveries    // files on the printer, see SetUploadRecord
+	chunkSize     int            // upload chunk size, 0 for sacp.DataLen
+	onUpload      func(sacp.UploadProgress)
 }
 
 // NewClient creates a new printer client.
@@ -211,43 +223,52 @@ func (c *Client) queryCoordinates() {
 
 // queryFileInfo queries the current print file info (CommandSet 0xAC, CommandID 0x00).
 func (c *Client) queryFileInfo() {
+	fi, err := c.fileInfo()
+	if err != nil {
+		log.Printf("File info query failed: %v", err)
+		return
+	}
+	if fi.Filename != "" {
+		c.subMu.Lock()
+		c.printFilename = fi.Filename
+		c.subMu.Unlock()
+		log.Printf("Print file: %s", fi.Filename)
+	}
+
+	// Also try to get total lines and estimated time from the screen (0xAC/0x1A).
+	c.queryPrintingFileInfo()
+}
+
+// fileInfo asks the controller for the name and MD5 of the file being
+// printed. Both are empty if the reply carries no file.
+func (c *Client) fileInfo() (sacp.PrintFileInfo, error) {
 	c.mu.Lock()
 	conn := c.conn
 	router := c.router
 	c.mu.Unlock()
 	if conn == nil || router == nil {
-		return
+		return sacp.PrintFileInfo{}, fmt.Errorf("not connected")
 	}
 
-	// Query basic file info from the controller.
 	c.writeMu.Lock()
 	seq, err := sacp.WritePacket(conn, 0xAC, 0x00, nil, sacpTimeout)
 	c.writeMu.Unlock()
 	if err != nil {
-		log.Printf("File info query send failed: %v", err)
-		return
+		return sacp.PrintFileInfo{}, err
 	}
 
 	resp, err := router.WaitForResponse(seq, sacpTimeout)
 	if err != nil {
-		log.Printf("File info query timeout: %v", err)
-		return
+		return sacp.PrintFileInfo{}, err
 	}
-
-	if resp != nil && len(resp.Data) > 1 {
-		fi, err := sacp.ParseFileInfo(resp.Data)
-		if err != nil {
-			log.Printf("File info parse error: %v (data=%x)", err, resp.Data)
-			return
-		}
-		c.subMu.Lock()
-		c.printFilename = fi.Filename
-		c.subMu.Unlock()
-		log.Printf("Print file: %s", fi.Filename)
+	if resp == nil || len(resp.Data) <= 1 {
+		return sacp.PrintFileInfo{}, nil
 	}
-
-	// Also try to get total lines and estimated time from the screen (0xAC/0x1A).
-	c.queryPrintingFileInfo()
+	fi, err := sacp.ParseFileInfo(resp.Data)
+	if err != nil {
+		return sacp.PrintFileInfo{}, fmt.Errorf("%w (data=%x)", err, resp.Data)
+	}
+	return fi, nil
 }
 
 // queryPrintingFileInfo queries extended file info from the screen MCU.
@@ -363,7 +384,14 @@ func (c *Client) handleSubscription(commandSet, commandID byte, data []byte) {
 		}
 		c.subMu.Lock()
 		c.currentLine = line
+		onLine := c.onLine
+		streaming := c.stream != nil
 		c.subMu.Unlock()
+		if onLine != nil && !streaming {
+			// Run outside the router goroutine: the callback may send
+			// commands and wait for their replies.
+			go onLine(int(line))
+		}
 
 	case commandSet == 0xAC && commandID == 0xa5:
 		// Elapsed print time.
@@ -467,6 +495,14 @@ func (c *Client) Connected() bool {
 	return c.conn != nil
 }
 
+// link returns the router of the current connection, nil when there is
+// none; it changes on every reconnect.
+func (c *Client) link() *PacketRouter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.router
+}
+
 // SetTotalLines sets the total line count for progress calculation.
 // Used to restore progress tracking after a restart.
 func (c *Client) SetTotalLines(n uint32) {
@@ -475,6 +511,72 @@ func (c *Client) SetTotalLines(n uint32) {
 	c.subMu.Unlock()
 }
 
+// SetPrintIndex sets the print index used while the file at srcPath is
+// printing. The printer reports only the basename, so that is what is
+// matched. Used by Upload and to restore tracking after a restart.
+func (c *Client) SetPrintIndex(srcPath string, idx *gcode.PrintIndex) {
+	c.subMu.Lock()
+	c.printIndex = idx
+	c.indexPath = srcPath
+	c.subMu.Unlock()
+}
+
+// HasPrintIndex reports whether a print index is loaded for filename.
+func (c *Client) HasPrintIndex(filename string) bool {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	return c.printIndex != nil && filepath.Base(c.indexPath) == filepath.Base(filename)
+}
+
+// PrintCacheKey returns the gcode cache key filename was last processed
+// under for printing, or "" if it wasn't processed through the cache.
+func (c *Client) PrintCacheKey(filename string) string {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	if c.printSource == "" || filepath.Base(c.printSource) != filepath.Base(filename) {
+		return ""
+	}
+	return c.printKey
+}
+
+// PrintIndex returns the print index and source path of the file being
+// printed, or nil if none is loaded for it.
+func (c *Client) PrintIndex() (*gcode.PrintIndex, string) {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	filename, _ := c.printing()
+	if c.printIndex == nil || filename == "" || filepath.Base(c.indexPath) != filename {
+		return nil, ""
+	}
+	return c.printIndex, c.indexPath
+}
+
+// printing returns the file being printed and the line it has reached,
+// from the stream if the bridge is streaming one; must hold subMu.
+func (c *Client) printing() (string, uint32) {
+	if c.stream != nil {
+		return c.stream.filename, uint32(c.stream.line())
+	}
+	return c.printFilename, c.currentLine
+}
+
+// SetLineCallback sets a function called whenever the printer reports the
+// line it is executing, about every two seconds while printing, or as a
+// streamed print's lines are acknowledged.
+func (c *Client) SetLineCallback(fn func(line int)) {
+	c.subMu.Lock()
+	c.onLine = fn
+	c.subMu.Unlock()
+}
+
+// CurrentLine returns the line the printer last reported executing.
+func (c *Client) CurrentLine() int {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	_, line := c.printing()
+	return int(line)
+}
+
 // TotalLines returns the current total line count.
 func (c *Client) TotalLines() uint32 {
 	c.subMu.RLock()
@@ -482,6 +584,22 @@ func (c *Client) TotalLines() uint32 {
 	return c.totalLines
 }
 
+// Toolheads returns the extruders the printer currently reports as
+// available, for pre-flight validation. Returns nil before the first
+// extruder subscription update arrives.
+func (c *Client) Toolheads() []gcode.Toolhead {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	var heads []gcode.Toolhead
+	for _, e := range c.extruderData {
+		if !e.Available {
+			continue
+		}
+		heads = append(heads, gcode.Toolhead{Tool: e.HeadID, NozzleDiameter: e.Diameter})
+	}
+	return heads
+}
+
 // IsUploading returns true if an upload is in progress.
 // Used by the state poller to avoid reconnection attempts during upload.
 func (c *Client) IsUploading() bool {
@@ -555,18 +673,30 @@ func (c *Client) sendCommand(commandSet, commandID byte, data []byte) error {
 	return nil
 }
 
-// StopPrint sends the SACP stop/cancel print command (0xAC/0x06).
+// StopPrint sends the SACP stop/cancel print command (0xAC/0x06), or
+// cancels the streamed print.
 func (c *Client) StopPrint() error {
+	if st := c.activeStream(); st != nil {
+		return st.cancel()
+	}
 	return c.sendCommand(0xAC, 0x06, nil)
 }
 
-// PausePrint sends the SACP pause print command (0xAC/0x04).
+// PausePrint sends the SACP pause print command (0xAC/0x04), or pauses the
+// streamed print.
 func (c *Client) PausePrint() error {
+	if st := c.activeStream(); st != nil {
+		return st.pause()
+	}
 	return c.sendCommand(0xAC, 0x04, nil)
 }
 
-// ResumePrint sends the SACP resume print command (0xAC/0x05).
+// ResumePrint sends the SACP resume print command (0xAC/0x05), or resumes
+// the streamed print.
 func (c *Client) ResumePrint() error {
+	if st := c.activeStream(); st != nil {
+		return st.resume()
+	}
 	return c.sendCommand(0xAC, 0x05, nil)
 }
 
@@ -600,8 +730,41 @@ func (c *Client) SetBedTemperature(toolID int, temp int) error {
 // The double disconnect signals the HMI to finalize and index the uploaded file.
 //
 // Memory usage is bounded — the file is processed and uploaded streaming,
-// independent of file size.
-func (c *Client) Upload(filename, srcPath string) error {
+// independent of file size. opts selects the transform stages; its Model is
+// filled in from the client.
+//
+// If the processed file was uploaded under the same name before (see
+// SetUploadRecord), the printer is asked to print its copy and the transfer
+// is skipped, unless the printer can't confirm it has that copy or the print
+// fails to start.
+func (c *Client) Upload(filename, srcPath string, opts gcode.Options) error {
+	if c.Streaming() {
+		return fmt.Errorf("a streamed print is running")
+	}
+	if !c.Connected() {
+		return fmt.Errorf("not connected")
+	}
+
+	processed, err := c.processForPrint(srcPath, opts, ".processed-*.gcode")
+	if err != nil {
+		return err
+	}
+	defer processed.release()
+	log.Printf("Upload: %d lines in processed GCode", processed.lines)
+
+	// Use only the base filename for SACP upload — the printer stores files flat,
+	// and paths with subdirectories confuse the HMI file index.
+	uploadName := filepath.Base(filename)
+
+	if c.hasFile(uploadName, processed.md5) {
+		err := c.reprint(uploadName, processed.md5, processed.path)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Reprint of %s failed, uploading it again: %v", uploadName, err)
+		c.recordUpload(uploadName, "", 0)
+	}
+
 	c.mu.Lock()
 	conn := c.conn
 	router := c.router
@@ -626,38 +789,23 @@ func (c *Client) Upload(filename, srcPath string) error {
 		router.Stop()
 	}
 
-	// Process the source gcode into a temp file alongside it. Keeping the temp
-	// next to the source guarantees we stay on the real filesystem rather than
-	// a possibly-tmpfs /tmp, which would defeat the whole point of streaming.
-	tmpFile, err := os.CreateTemp(filepath.Dir(srcPath), ".processed-*.gcode")
-	if err != nil {
-		return fmt.Errorf("creating processed temp: %w", err)
-	}
-	processedPath := tmpFile.Name()
-	tmpFile.Close()
-	defer os.Remove(processedPath)
-
-	lineCount, err := gcode.ProcessFile(srcPath, processedPath, c.model)
-	if err != nil {
-		return fmt.Errorf("processing gcode: %w", err)
+	c.subMu.RLock()
+	uploadOpts := sacp.UploadOptions{
+		ChunkSize: c.chunkSize,
+		MD5:       processed.md5,
+		Progress:  c.uploadProgress(c.onUpload),
 	}
-
-	c.subMu.Lock()
-	c.totalLines = lineCount
-	c.subMu.Unlock()
-	log.Printf("Upload: %d lines in processed GCode", lineCount)
-
-	// Use only the base filename for SACP upload — the printer stores files flat,
-	// and paths with subdirectories confuse the HMI file index.
-	uploadName := filepath.Base(filename)
-
-	md5hex, err := sacp.StartUpload(conn, uploadName, processedPath, sacpTimeout)
+	c.subMu.RUnlock()
+	md5hex, err := sacp.StartUpload(conn, uploadName, processed.path, uploadOpts, sacpTimeout)
 	if err != nil {
 		// Upload failed — close and schedule reconnect.
 		conn.Close()
 		go c.reconnectAfterUpload()
 		return fmt.Errorf("upload failed: %w", err)
 	}
+	if info, err := os.Stat(processed.path); err == nil {
+		c.recordUpload(uploadName, md5hex, info.Size())
+	}
 
 	// StartUpload sent the first disconnect (inside, after 0xb0/0x02).
 	// Send the second disconnect to match sm2uploader's double-disconnect pattern.
@@ -686,20 +834,7 @@ func (c *Client) Upload(filename, srcPath string) error {
 		return nil
 	}
 
-	// Set IDEX mode via SACP if the gcode requests Duplication or Mirror mode.
-	// The V1 header tells the HMI, but sending the SACP command as well ensures
-	// the controller is in the correct mode before the print starts.
-	if idexMode := idexModeFromHeader(processedPath); idexMode != sacp.IDEXModeDefault {
-		modeNames := map[byte]string{
-			sacp.IDEXModeDuplication: "Duplication",
-			sacp.IDEXModeMirror:      "Mirror",
-			sacp.IDEXModeBackup:       "Backup",
-		}
-		log.Printf("Setting IDEX mode: %s (0x%02x)", modeNames[idexMode], idexMode)
-		if err := c.sendCommand(0xAC, 0x0A, []byte{idexMode}); err != nil {
-			log.Printf("SetPrintMode failed (non-fatal): %v", err)
-		}
-	}
+	c.setIDEXMode(processed.path)
 
 	// Start the print on the fresh connection. The file is now indexed by the HMI.
 	log.Printf("Starting print: filename=%q md5=%s", uploadName, md5hex)
@@ -708,6 +843,140 @@ func (c *Client) Upload(filename, srcPath string) error {
 	return nil
 }
 
+// SetCache makes prints take their processed files from cache, processing
+// into it on a miss. Without a cache every print is processed from scratch.
+func (c *Client) SetCache(cache *gcode.Cache) {
+	c.subMu.Lock()
+	c.cache = cache
+	c.subMu.Unlock()
+}
+
+// SetUploadChunkSize sets the data sent per upload chunk; 0 sends the
+// largest chunks the printer takes. See sacp.CheckChunkSize.
+func (c *Client) SetUploadChunkSize(n int) error {
+	if n != 0 {
+		if err := sacp.CheckChunkSize(n); err != nil {
+			return err
+		}
+	}
+	c.subMu.Lock()
+	c.chunkSize = n
+	c.subMu.Unlock()
+	return nil
+}
+
+// SetUploadCallback sets a function called with the progress of uploads
+// to the printer, at most twice a second and once they are sent.
+func (c *Client) SetUploadCallback(fn func(sacp.UploadProgress)) {
+	c.subMu.Lock()
+	c.onUpload = fn
+	c.subMu.Unlock()
+}
+
+// uploadProgress logs upload progress every 10% and passes it on to fn.
+func (c *Client) uploadProgress(fn func(sacp.UploadProgress)) func(sacp.UploadProgress) {
+	logged := -1
+	return func(p sacp.UploadProgress) {
+		if step := int(p.Percent()) / 10; step > logged {
+			logged = step
+			log.Printf("  SACP upload: %.0f%% of %d bytes, %.0f KB/s, %s left",
+				p.Percent(), p.Total, p.BytesPerSec/1024, p.ETA.Round(time.Second))
+		}
+		if fn != nil {
+			fn(p)
+		}
+	}
+}
+
+// processedFile is a file processed for printing.
+type processedFile struct {
+	path    string
+	lines   uint32
+	md5     string // hex
+	release func() // call once the file is no longer needed
+}
+
+// processForPrint processes the source gcode for printing and loads its
+// print index. With a cache the processed file is taken from it; otherwise
+// it goes to a temp file alongside the source, named after pattern. Keeping
+// the temp next to the source guarantees we stay on the real filesystem
+// rather than a possibly-tmpfs /tmp, which would defeat the whole point of
+// streaming.
+func (c *Client) processForPrint(srcPath string, opts gcode.Options, pattern string) (*processedFile, error) {
+	opts.Model = c.model
+	c.subMu.RLock()
+	cache := c.cache
+	c.subMu.RUnlock()
+
+	if cache != nil {
+		entry, err := cache.Process(srcPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("processing gcode: %w", err)
+		}
+		if entry.Index != nil {
+			c.SetPrintIndex(srcPath, entry.Index)
+			if err := entry.Index.Save(gcode.IndexPath(srcPath)); err != nil {
+				log.Printf("Saving print index: %v", err)
+			}
+		}
+		c.subMu.Lock()
+		c.totalLines = entry.Lines
+		c.printSource, c.printKey = srcPath, entry.Key
+		c.subMu.Unlock()
+		return &processedFile{path: entry.Path, lines: entry.Lines, md5: entry.MD5, release: entry.Release}, nil
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(srcPath), pattern)
+	if err != nil {
+		return nil, fmt.Errorf("creating processed temp: %w", err)
+	}
+	processedPath := tmpFile.Name()
+	tmpFile.Close()
+
+	opts.IndexPath = gcode.IndexPath(srcPath)
+	sum := md5.New()
+	opts.Hash = sum
+	lineCount, err := gcode.ProcessFile(srcPath, processedPath, opts)
+	if err != nil {
+		os.Remove(processedPath)
+		return nil, fmt.Errorf("processing gcode: %w", err)
+	}
+	if idx, err := gcode.LoadIndex(opts.IndexPath); err == nil {
+		c.SetPrintIndex(srcPath, idx)
+	}
+
+	c.subMu.Lock()
+	c.totalLines = lineCount
+	c.printSource, c.printKey = srcPath, ""
+	c.subMu.Unlock()
+	return &processedFile{
+		path:    processedPath,
+		lines:   lineCount,
+		md5:     hex.EncodeToString(sum.Sum(nil)),
+		release: func() { os.Remove(processedPath) },
+	}, nil
+}
+
+// setIDEXMode sets IDEX mode via SACP if the gcode requests Duplication or
+// Mirror mode. The V1 header tells the HMI, but sending the SACP command as
+// well ensures the controller is in the correct mode before the print
+// starts.
+func (c *Client) setIDEXMode(processedPath string) {
+	idexMode := idexModeFromHeader(processedPath)
+	if idexMode == sacp.IDEXModeDefault {
+		return
+	}
+	modeNames := map[byte]string{
+		sacp.IDEXModeDuplication: "Duplication",
+		sacp.IDEXModeMirror:      "Mirror",
+		sacp.IDEXModeBackup:      "Backup",
+	}
+	log.Printf("Setting IDEX mode: %s (0x%02x)", modeNames[idexMode], idexMode)
+	if err := c.sendCommand(0xAC, 0x0A, []byte{idexMode}); err != nil {
+		log.Printf("SetPrintMode failed (non-fatal): %v", err)
+	}
+}
+
 // idexModeFromHeader maps the V1 header's ";Extruder Mode:" string at the top
 // of a processed gcode file to a SACP mode byte.
 func idexModeFromHeader(processedPath string) byte {
@@ -750,13 +1019,27 @@ func (c *Client) reconnectAfterUpload() {
 
 // ExecuteGCode sends a GCode command via SACP.
 func (c *Client) ExecuteGCode(gcode string) (string, error) {
+	wait, err := c.sendGCode(gcode)
+	if err != nil {
+		return "", err
+	}
+	p, err := wait(sacpTimeout)
+	if err != nil {
+		return "", err
+	}
+	return gcodeResult(p)
+}
+
+// sendGCode writes a GCode command and returns a function that waits for
+// the printer's response to it.
+func (c *Client) sendGCode(gcode string) (func(time.Duration) (*sacp.Packet, error), error) {
 	c.mu.Lock()
 	conn := c.conn
 	router := c.router
 	c.mu.Unlock()
 
 	if conn == nil || router == nil {
-		return "", fmt.Errorf("not connected")
+		return nil, fmt.Errorf("not connected")
 	}
 
 	// Build GCode payload: length-prefixed string.
@@ -766,16 +1049,19 @@ func (c *Client) ExecuteGCode(gcode string) (string, error) {
 
 	c.writeMu.Lock()
 	seq, err := sacp.WritePacket(conn, 0x01, 0x02, payload.Bytes(), sacpTimeout)
-	c.writeMu.Unlock()
-	if err != nil {
-		return "", err
+	var wait func(time.Duration) (*sacp.Packet, error)
+	if err == nil {
+		wait = router.Expect(seq)
 	}
-
-	p, err := router.WaitForResponse(seq, sacpTimeout)
+	c.writeMu.Unlock()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return wait, nil
+}
 
+// gcodeResult decodes the printer's response to a GCode command.
+func gcodeResult(p *sacp.Packet) (string, error) {
 	if len(p.Data) < 1 {
 		return "", nil
 	}
@@ -798,9 +1084,17 @@ func (c *Client) GetStatus() (map[string]interface{}, error) {
 	c.subMu.RLock()
 	defer c.subMu.RUnlock()
 
+	// A streamed print stands in for what the printer would report.
+	machineStatus, printFilename := c.machineStatus, c.printFilename
+	currentLine, totalLines, printTime := c.currentLine, c.totalLines, c.printTime
+	if st := c.stream; st != nil {
+		printFilename, totalLines = st.filename, st.total
+		currentLine, printTime, machineStatus = st.progress()
+	}
+
 	// Map machine status to the string format expected by parseStatus.
 	status := "IDLE"
-	switch c.machineStatus {
+	switch machineStatus {
 	case sacp.MachineStatusIdle, sacp.MachineStatusCompleted, sacp.MachineStatusStopped:
 		status = "IDLE"
 	case sacp.MachineStatusPrinting, sacp.MachineStatusStarting,
@@ -814,10 +1108,11 @@ func (c *Client) GetStatus() (map[string]interface{}, error) {
 		status = "PAUSED"
 	}
 
-	// Calculate progress from current/total lines.
+	// Calculate progress from current/total lines (replaced below when a
+	// print index with a time estimate is available).
 	progress := 0.0
-	if c.totalLines > 0 {
-		progress = float64(c.currentLine) / float64(c.totalLines) * 100.0
+	if totalLines > 0 {
+		progress = float64(currentLine) / float64(totalLines) * 100.0
 		if progress > 100 {
 			progress = 100
 		}
@@ -838,18 +1133,57 @@ func (c *Client) GetStatus() (map[string]interface{}, error) {
 		}
 	}
 
+	// Source file position, layers and time-based progress from the print
+	// index, if it belongs to the file being printed. Remaining time is corrected by how the print
+	// is actually running against the estimate.
+	currentLayer, totalLayer := 0, 0
+	estimatedTime, remainingTime := 0.0, 0.0
+	filePath, filePosition, fileSize := "", int64(0), int64(0)
+	var objects []gcode.Object
+	var excludedObjects []string
+	currentObject := ""
+	if idx := c.printIndex; idx != nil && printFilename != "" && filepath.Base(c.indexPath) == printFilename {
+		line := int(currentLine)
+		filePath = c.indexPath
+		filePosition = idx.FilePosition(line)
+		fileSize = idx.SourceSize
+		objects, excludedObjects = idx.Objects, idx.Excluded
+		currentObject = idx.CurrentObject(line)
+		currentLayer = idx.Layer(line)
+		totalLayer = idx.TotalLayers
+		if p := idx.Progress(line); p >= 0 {
+			progress = p * 100
+			elapsed := idx.Elapsed(line)
+			estimatedTime = idx.EstimatedTime
+			remainingTime = estimatedTime - elapsed
+			if elapsed > 60 && printTime > 0 {
+				remainingTime *= float64(printTime) / elapsed
+			}
+		}
+	}
+
 	result := map[string]interface{}{
-		"status":      status,
-		"progress":    progress,
-		"elapsedTime": float64(c.printTime),
-		"fileName":    c.printFilename,
-		"currentLine": c.currentLine,
-		"x":           c.coordData.X,
-		"y":           c.coordData.Y,
-		"z":           c.coordData.Z,
-		"fan0Speed":   fan0Speed,
-		"fan1Speed":   fan1Speed,
-		"homed":       c.coordData.Homed,
+		"status":       status,
+		"progress":     progress,
+		"currentLayer": currentLayer,
+		"totalLayer":   totalLayer,
+		"estTime":      estimatedTime,
+		"remainTime":   remainingTime,
+		"filePath":     filePath,
+		"filePosition": filePosition,
+		"fileSize":     fileSize,
+		"objects":      objects,
+		"excluded":     excludedObjects,
+		"curObject":    currentObject,
+		"elapsedTime":  float64(printTime),
+		"fileName":     printFilename,
+		"currentLine":  currentLine,
+		"x":            c.coordData.X,
+		"y":            c.coordData.Y,
+		"z":            c.coordData.Z,
+		"fan0Speed":    fan0Speed,
+		"fan1Speed":    fan1Speed,
+		"homed":        c.coordData.Homed,
 	}
 
 	// Temperature data.
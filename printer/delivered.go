@@ -0,0 +1,157 @@
+package printer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/john/snapmaker_moonraker/sacp"
+)
+
+// reprintTimeout bounds the wait for a print started from a file already
+// on the printer to begin.
+const reprintTimeout = 20 * time.Second
+
+// deliveries records which processed files have been uploaded to each
+// printer, by name and MD5, so printing one again can skip the transfer.
+// The printer keeps one file per name, so a later upload under the same
+// name replaces the record.
+type deliveries struct {
+	path string
+
+	mu       sync.Mutex
+	printers map[string]map[string]delivery // by printer IP, then file name
+}
+
+type delivery struct {
+	MD5  string    `json:"md5"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// SetUploadRecord keeps the record of files uploaded to printers at path,
+// loading what it already holds. Without one every print is uploaded.
+func (c *Client) SetUploadRecord(path string) error {
+	d := &deliveries{path: path, printers: make(map[string]map[string]delivery)}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &d.printers); err != nil {
+			return fmt.Errorf("parsing upload record: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	c.subMu.Lock()
+	c.uploads = d
+	c.subMu.Unlock()
+	return nil
+}
+
+func (c *Client) uploadRecord() *deliveries {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	return c.uploads
+}
+
+// hasFile reports whether name was last uploaded to the printer with this
+// MD5.
+func (c *Client) hasFile(name, md5hex string) bool {
+	d := c.uploadRecord()
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.printers[c.ip][name]
+	return ok && strings.EqualFold(f.MD5, md5hex)
+}
+
+// recordUpload notes that name was uploaded with this MD5, or that the
+// printer no longer has it if md5hex is "".
+func (c *Client) recordUpload(name, md5hex string, size int64) {
+	d := c.uploadRecord()
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := d.printers[c.ip]
+	if files == nil {
+		files = make(map[string]delivery)
+		d.printers[c.ip] = files
+	}
+	if md5hex == "" {
+		delete(files, name)
+	} else {
+		files[name] = delivery{MD5: md5hex, Size: size, Time: time.Now()}
+	}
+	data, err := json.MarshalIndent(d.printers, "", "  ")
+	if err == nil {
+		err = os.WriteFile(d.path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to write upload record: %v", err)
+	}
+}
+
+// reprint starts name, already on the printer, without uploading it. The
+// record may be stale (the file deleted or replaced on the printer), and
+// there is no SACP file listing, so the printer is first asked for the file
+// it has loaded: only a copy it reports by name and MD5 is started, and a
+// failed query counts as not having it, so the caller uploads instead. The
+// printer says nothing when it can't find the file either, so reprint then
+// waits for the print to begin and checks the MD5 again.
+func (c *Client) reprint(name, md5hex, processedPath string) error {
+	c.subMu.RLock()
+	status := c.machineStatus
+	c.subMu.RUnlock()
+	switch status {
+	case sacp.MachineStatusIdle, sacp.MachineStatusCompleted, sacp.MachineStatusStopped:
+	default:
+		return fmt.Errorf("printer is busy (%s)", status)
+	}
+
+	fi, err := c.fileInfo()
+	if err != nil {
+		return fmt.Errorf("checking the printer's copy: %w", err)
+	}
+	if filepath.Base(fi.Filename) != name || !strings.EqualFold(fi.MD5, md5hex) {
+		return fmt.Errorf("printer has %q (md5 %s) loaded, not this copy", fi.Filename, fi.MD5)
+	}
+
+	log.Printf("%s is already on the printer (md5=%s), starting it without uploading", name, md5hex)
+	c.setIDEXMode(processedPath)
+	c.startPrint(name, md5hex)
+
+	deadline := time.Now().Add(reprintTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		c.subMu.RLock()
+		status := c.machineStatus
+		c.subMu.RUnlock()
+		switch status {
+		case sacp.MachineStatusIdle, sacp.MachineStatusCompleted, sacp.MachineStatusStopped:
+			continue
+		}
+
+		fi, err := c.fileInfo()
+		if err != nil {
+			// The printer started something and had this file loaded;
+			// trust it was this one.
+			log.Printf("Reprint: file info unavailable, assuming %s started: %v", name, err)
+			return nil
+		}
+		if fi.MD5 != "" && !strings.EqualFold(fi.MD5, md5hex) {
+			c.StopPrint()
+			return fmt.Errorf("printer started %s with md5 %s", fi.Filename, fi.MD5)
+		}
+		return nil
+	}
+	return fmt.Errorf("print did not start within %s", reprintTimeout)
+}
@@ -1,6 +1,7 @@
 package printer
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -110,21 +111,34 @@ func (r *PacketRouter) readLoop() {
 // WaitForResponse registers for a response with the given sequence number
 // and blocks until it arrives or times out.
 func (r *PacketRouter) WaitForResponse(seq uint16, timeout time.Duration) (*sacp.Packet, error) {
+	return r.Expect(seq)(timeout)
+}
+
+// errResponseTimeout is returned by Expect when no response arrives in
+// time, as opposed to the connection closing.
+var errResponseTimeout = errors.New("timeout waiting for response")
+
+// Expect registers for a response with the given sequence number and
+// returns a function that blocks until it arrives or times out. Lets a
+// caller keep several commands in flight and collect their responses later.
+func (r *PacketRouter) Expect(seq uint16) func(timeout time.Duration) (*sacp.Packet, error) {
 	ch := make(chan *sacp.Packet, 1)
 	r.mu.Lock()
 	r.pending[seq] = ch
 	r.mu.Unlock()
 
-	select {
-	case p, ok := <-ch:
-		if !ok {
-			return nil, fmt.Errorf("connection closed while waiting for response")
+	return func(timeout time.Duration) (*sacp.Packet, error) {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return nil, fmt.Errorf("connection closed while waiting for response")
+			}
+			return p, nil
+		case <-time.After(timeout):
+			r.mu.Lock()
+			delete(r.pending, seq)
+			r.mu.Unlock()
+			return nil, fmt.Errorf("%w seq=%d", errResponseTimeout, seq)
 		}
-		return p, nil
-	case <-time.After(timeout):
-		r.mu.Lock()
-		delete(r.pending, seq)
-		r.mu.Unlock()
-		return nil, fmt.Errorf("timeout waiting for response seq=%d", seq)
 	}
 }
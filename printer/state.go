@@ -4,6 +4,8 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/john/snapmaker_moonraker/gcode"
 )
 
 // StatusCallback is called when printer status is updated.
@@ -33,7 +35,20 @@ type StateData struct {
 	PrintProgress float64 `json:"print_progress"` // 0.0 - 1.0
 	PrintFileName string  `json:"print_file_name"`
 	PrintDuration float64 `json:"print_duration"` // seconds
+	EstimatedTime float64 `json:"estimated_time"` // seconds, 0 = unknown
+	RemainingTime float64 `json:"remaining_time"` // seconds, 0 = unknown
+	ETA           float64 `json:"eta"`            // Unix time, 0 = unknown
 	CurrentLine   int     `json:"current_line"`
+	FilePath      string  `json:"file_path"`     // source file on disk, "" = unknown
+	FilePosition  int64   `json:"file_position"` // byte offset in FilePath
+	FileSize      int64   `json:"file_size"`
+	CurrentLayer  int     `json:"current_layer"` // 0 = unknown
+	TotalLayer    int     `json:"total_layer"`   // 0 = unknown
+
+	// Labelled objects of the file being printed (exclude_object)
+	Objects         []gcode.Object `json:"objects"`
+	ExcludedObjects []string       `json:"excluded_objects"`
+	CurrentObject   string         `json:"current_object"` // "" = none
 
 	// Homing
 	HomedAxes string `json:"homed_axes"` // e.g. "xyz"
@@ -60,6 +75,11 @@ type StateData struct {
 type State struct {
 	mu   sync.RWMutex
 	data StateData
+
+	// Layer values set with SET_PRINT_STATS_INFO, -1 when unset. They take
+	// precedence over the print index until the printer goes idle.
+	infoCurrentLayer int
+	infoTotalLayer   int
 }
 
 // NewState creates a default state.
@@ -72,6 +92,8 @@ func NewState() *State {
 			ExtrudeFactor:  1.0,
 			ActiveExtruder: "extruder",
 		},
+		infoCurrentLayer: -1,
+		infoTotalLayer:   -1,
 	}
 }
 
@@ -89,6 +111,21 @@ func (s *State) SetActiveExtruder(name string) {
 	s.data.ActiveExtruder = name
 }
 
+// SetPrintStatsInfo records the layer values of a SET_PRINT_STATS_INFO
+// command; pass -1 to leave a value unchanged.
+func (s *State) SetPrintStatsInfo(currentLayer, totalLayer int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if currentLayer >= 0 {
+		s.infoCurrentLayer = currentLayer
+		s.data.CurrentLayer = currentLayer
+	}
+	if totalLayer >= 0 {
+		s.infoTotalLayer = totalLayer
+		s.data.TotalLayer = totalLayer
+	}
+}
+
 // AdjustZOffset adds a delta to the Z offset and returns the new value.
 func (s *State) AdjustZOffset(delta float64) float64 {
 	s.mu.Lock()
@@ -258,6 +295,19 @@ func (sp *StatePoller) parseStatus(status map[string]interface{}) {
 	// Current line number from SACP subscription.
 	sp.state.data.CurrentLine = int(floatFromMap(status, "currentLine"))
 
+	// Layers: SET_PRINT_STATS_INFO values win over the print index.
+	if sp.state.data.PrinterState == "idle" {
+		sp.state.infoCurrentLayer, sp.state.infoTotalLayer = -1, -1
+	}
+	sp.state.data.CurrentLayer = int(floatFromMap(status, "currentLayer"))
+	sp.state.data.TotalLayer = int(floatFromMap(status, "totalLayer"))
+	if sp.state.infoCurrentLayer >= 0 {
+		sp.state.data.CurrentLayer = sp.state.infoCurrentLayer
+	}
+	if sp.state.infoTotalLayer >= 0 {
+		sp.state.data.TotalLayer = sp.state.infoTotalLayer
+	}
+
 	// Filename: update from HTTP response; clear when idle.
 	if v, ok := status["fileName"].(string); ok {
 		sp.state.data.PrintFileName = v
@@ -268,6 +318,27 @@ func (sp *StatePoller) parseStatus(status map[string]interface{}) {
 	// Duration: always update so it resets to 0 when print completes.
 	sp.state.data.PrintDuration = floatFromMap(status, "elapsedTime", "printTime")
 
+	// Source file position from the print index.
+	sp.state.data.FilePath, _ = status["filePath"].(string)
+	sp.state.data.FilePosition, _ = status["filePosition"].(int64)
+	sp.state.data.FileSize, _ = status["fileSize"].(int64)
+
+	// Objects from the print index.
+	sp.state.data.Objects, _ = status["objects"].([]gcode.Object)
+	sp.state.data.ExcludedObjects, _ = status["excluded"].([]string)
+	sp.state.data.CurrentObject, _ = status["curObject"].(string)
+
+	// Time estimate from the print index. The ETA only moves when the
+	// remaining time does, so an unchanged estimate isn't a status change.
+	sp.state.data.EstimatedTime = floatFromMap(status, "estTime")
+	remaining := floatFromMap(status, "remainTime")
+	if remaining <= 0 {
+		sp.state.data.ETA = 0
+	} else if remaining != sp.state.data.RemainingTime || sp.state.data.ETA == 0 {
+		sp.state.data.ETA = float64(time.Now().UnixNano())/1e9 + remaining
+	}
+	sp.state.data.RemainingTime = remaining
+
 	// Fan speeds (per-extruder, reported as percentage 0-100, convert to 0.0-1.0).
 	// Always update so they reset to 0 when fans stop.
 	sp.state.data.FanSpeed[0] = floatFromMap(status, "fan0Speed") / 100.0
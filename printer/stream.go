@@ -0,0 +1,789 @@
+package printer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/john/snapmaker_moonraker/gcode"
+	"github.com/john/snapmaker_moonraker/sacp"
+)
+
+// Streaming prints: instead of uploading the file and starting it on the
+// printer, the bridge keeps the processed file and sends it one command at
+// a time with ExecuteGCode. A few commands are kept in flight so the
+// printer's planner doesn't run dry between them; the line of the last
+// acknowledged command is the print's current line. Because every line
+// passes through the bridge, objects can be excluded and the Z offset
+// changed while the print runs.
+const (
+	DefaultStreamWindow = 4
+	MaxStreamWindow     = 32
+
+	// How long to wait for a command to be acknowledged. Heating, homing
+	// and dwells are acknowledged only once done.
+	streamAckTimeout     = 2 * time.Minute
+	streamSlowAckTimeout = 30 * time.Minute
+
+	// How long a stream waits for the SACP link to come back before
+	// holding the print for the user to resume it.
+	streamRecoverTimeout = 2 * time.Minute
+
+	// How often the line callback runs while streaming.
+	streamNotifyInterval = 250 * time.Millisecond
+
+	streamParkLift      = 5.0 // mm the head lifts while paused
+	streamTravelFeed    = 6000
+	streamZFeed         = 600
+	streamScannerBuffer = 1024 * 1024
+)
+
+// streamCancelScript runs after a cancelled stream has stopped.
+var streamCancelScript = []string{"M107", "M104 S0 T0", "M104 S0 T1", "M140 S0"}
+
+type streamState int
+
+const (
+	streamPrinting streamState = iota
+	streamPaused
+	streamRecovering // SACP link lost, waiting for it to come back
+	streamCancelling
+)
+
+// streamModal follows the state the file sets up that a resumed stream has
+// to restore: positioning and extrusion modes, position and feedrate.
+type streamModal struct {
+	relative  bool
+	relativeE bool
+	pos       [4]float64 // X Y Z E in file coordinates
+	known     [3]bool    // X Y Z set since the last home
+	feedrate  float64
+}
+
+func (m *streamModal) apply(line string) {
+	fields := strings.Fields(strings.ToUpper(line))
+	if len(fields) == 0 {
+		return
+	}
+	switch fields[0] {
+	case "G90":
+		m.relative, m.relativeE = false, false
+	case "G91":
+		m.relative, m.relativeE = true, true
+	case "M82":
+		m.relativeE = false
+	case "M83":
+		m.relativeE = true
+	case "G28":
+		m.known = [3]bool{}
+	case "G92":
+		for i, axis := range []byte("XYZE") {
+			if v, ok := streamParam(fields, axis); ok {
+				m.pos[i] = v
+				if i < 3 {
+					m.known[i] = true
+				}
+			}
+		}
+	case "G0", "G1", "G2", "G3":
+		for i, axis := range []byte("XYZE") {
+			v, ok := streamParam(fields, axis)
+			if !ok {
+				continue
+			}
+			rel := m.relative
+			if i == 3 {
+				rel = m.relativeE
+			}
+			if rel {
+				m.pos[i] += v
+			} else {
+				m.pos[i] = v
+				if i < 3 {
+					m.known[i] = true
+				}
+			}
+		}
+		if f, ok := streamParam(fields, 'F'); ok && f > 0 {
+			m.feedrate = f
+		}
+	}
+}
+
+// restore returns the lines that bring the printer back to this state, with
+// zOffset added to Z: the head travels back to the position, then the modes,
+// E position and feedrate are set again.
+func (m *streamModal) restore(zOffset float64) []string {
+	lines := []string{"G90"}
+	if m.known[0] && m.known[1] {
+		lines = append(lines, fmt.Sprintf("G0 X%.3f Y%.3f F%d", m.pos[0], m.pos[1], streamTravelFeed))
+	}
+	if m.known[2] {
+		lines = append(lines, fmt.Sprintf("G0 Z%.3f F%d", m.pos[2]+zOffset, streamZFeed))
+	}
+	if m.relative {
+		lines = append(lines, "G91")
+	}
+	if m.relativeE {
+		lines = append(lines, "M83")
+	} else {
+		lines = append(lines, "M82", fmt.Sprintf("G92 E%.5f", m.pos[3]))
+	}
+	if m.feedrate > 0 {
+		lines = append(lines, fmt.Sprintf("G1 F%.0f", m.feedrate))
+	}
+	return lines
+}
+
+// streamParam returns the value of an axis word in upper-cased fields.
+func streamParam(fields []string, axis byte) (float64, bool) {
+	for _, f := range fields[1:] {
+		if len(f) > 1 && f[0] == axis {
+			if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// streamCommand returns the command part of a line if it is one the printer
+// runs (a G, M or T code), or "" for comments, blank lines and
+// Klipper-only commands.
+func streamCommand(line string) string {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if len(line) < 2 {
+		return ""
+	}
+	switch line[0] {
+	case 'G', 'g', 'M', 'm', 'T', 't':
+		if line[1] >= '0' && line[1] <= '9' {
+			return line
+		}
+	}
+	return ""
+}
+
+// slowCommand reports whether the printer acknowledges line only once it
+// has finished running it.
+func slowCommand(line string) bool {
+	fields := strings.Fields(strings.ToUpper(line))
+	switch fields[0] {
+	case "M109", "M190", "G28", "G29", "M400", "G4":
+		return true
+	}
+	return false
+}
+
+// streamCmd is a command of the file in flight or waiting to be (re)sent.
+type streamCmd struct {
+	line int    // output line of the file
+	text string // command as filtered, before the Z offset is applied
+	wait func(time.Duration) (*sacp.Packet, error)
+}
+
+// stream is a print the bridge is streaming to the printer.
+type stream struct {
+	c        *Client
+	filename string // basename reported as the print file
+	path     string // processed file
+	release  func() // called when the stream ends, see processForPrint
+	total    uint32
+	window   int
+	filter   *gcode.ObjectFilter
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	state       streamState
+	resumeTo    streamState   // state after the link comes back
+	lostLink    *PacketRouter // connection that was lost, see recover
+	acked       int           // output line of the last acknowledged command
+	started     time.Time
+	pausedSince time.Time
+	pausedFor   time.Duration
+	zOffset     float64
+	zChanged    bool // zOffset changed since the last Z move
+	parked      bool // lifted on pause, so resuming must move back
+	resync      bool // state must be restored before sending more
+	message     string
+	notified    time.Time // last line callback
+
+	// Run goroutine only.
+	sent  streamModal // state after the last command sent
+	done  streamModal // state after the last command acknowledged
+	queue []streamCmd // in flight, then waiting to be resent
+}
+
+// StreamPrint processes the file at srcPath and streams it to the printer
+// line by line, keeping up to window commands in flight. It returns once
+// the stream has started; PausePrint, ResumePrint and StopPrint control it
+// like a print started on the printer.
+func (c *Client) StreamPrint(filename, srcPath string, opts gcode.Options, window int) error {
+	if !c.Connected() {
+		return fmt.Errorf("not connected")
+	}
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+	if window > MaxStreamWindow {
+		return fmt.Errorf("stream window %d is larger than %d", window, MaxStreamWindow)
+	}
+	c.subMu.RLock()
+	busy := c.stream != nil
+	status := c.machineStatus
+	c.subMu.RUnlock()
+	if busy {
+		return fmt.Errorf("a streamed print is already running")
+	}
+	switch status {
+	case sacp.MachineStatusIdle, sacp.MachineStatusCompleted, sacp.MachineStatusStopped:
+	default:
+		return fmt.Errorf("printer is busy (%s)", status)
+	}
+
+	processed, err := c.processForPrint(srcPath, opts, ".stream-*.gcode")
+	if err != nil {
+		return err
+	}
+	c.subMu.RLock()
+	idx := c.printIndex
+	c.subMu.RUnlock()
+	if idx == nil {
+		idx = &gcode.PrintIndex{}
+	}
+	c.setIDEXMode(processed.path)
+
+	st := &stream{
+		c:        c,
+		filename: filepath.Base(filename),
+		path:     processed.path,
+		release:  processed.release,
+		total:    processed.lines,
+		window:   window,
+		filter:   gcode.NewObjectFilter(idx),
+		started:  time.Now(),
+	}
+	st.cond = sync.NewCond(&st.mu)
+	c.subMu.Lock()
+	c.stream = st
+	c.subMu.Unlock()
+
+	log.Printf("Streaming %s: %d lines, window %d", st.filename, processed.lines, window)
+	go st.run()
+	return nil
+}
+
+// Streaming reports whether the bridge is streaming a print.
+func (c *Client) Streaming() bool {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	return c.stream != nil
+}
+
+// activeStream returns the stream being printed, or nil.
+func (c *Client) activeStream() *stream {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	return c.stream
+}
+
+// StreamExcludeObject leaves an object out of the streamed print from the
+// next command sent on. The print index saved beside the source records it
+// too, so it is still excluded after a bridge restart.
+func (c *Client) StreamExcludeObject(name string) error {
+	st := c.activeStream()
+	if st == nil {
+		return fmt.Errorf("no streamed print is running")
+	}
+	st.filter.Exclude(name)
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if c.printIndex != nil {
+		c.printIndex.Excluded = append(c.printIndex.Excluded, name)
+		if err := c.printIndex.Save(gcode.IndexPath(c.indexPath)); err != nil {
+			log.Printf("Saving print index: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetStreamZOffset sets the Z offset added to the streamed print's moves.
+// It takes effect before the next move sent.
+func (c *Client) SetStreamZOffset(offset float64) error {
+	st := c.activeStream()
+	if st == nil {
+		return fmt.Errorf("no streamed print is running")
+	}
+	st.mu.Lock()
+	if offset != st.zOffset {
+		st.zOffset, st.zChanged = offset, true
+	}
+	st.mu.Unlock()
+	return nil
+}
+
+// line returns the line reached.
+func (st *stream) line() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.acked
+}
+
+// progress returns the line reached, the seconds printed (pauses left out)
+// and the machine status the stream stands for.
+func (st *stream) progress() (uint32, uint32, sacp.MachineStatus) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	elapsed := time.Since(st.started) - st.pausedFor
+	status := sacp.MachineStatusPrinting
+	switch st.state {
+	case streamPaused, streamRecovering:
+		status = sacp.MachineStatusPaused
+		elapsed -= time.Since(st.pausedSince)
+	case streamCancelling:
+		status = sacp.MachineStatusStopping
+	}
+	return uint32(st.acked), uint32(elapsed / time.Second), status
+}
+
+func (st *stream) pause() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch st.state {
+	case streamPrinting:
+		st.setState(streamPaused)
+	case streamRecovering:
+		st.resumeTo = streamPaused
+	}
+	return nil
+}
+
+func (st *stream) resume() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch st.state {
+	case streamPaused:
+		st.setState(streamPrinting)
+	case streamRecovering:
+		return fmt.Errorf("the printer link is down, the print resumes once it is back")
+	}
+	return nil
+}
+
+func (st *stream) cancel() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.setState(streamCancelling)
+	return nil
+}
+
+// setState changes the state and wakes the run goroutine; must hold mu.
+func (st *stream) setState(state streamState) {
+	paused := func(s streamState) bool { return s == streamPaused || s == streamRecovering }
+	switch {
+	case paused(state) && !paused(st.state):
+		st.pausedSince = time.Now()
+	case !paused(state) && paused(st.state):
+		st.pausedFor += time.Since(st.pausedSince)
+	}
+	st.state = state
+	st.cond.Broadcast()
+}
+
+func (st *stream) run() {
+	c := st.c
+	defer func() {
+		st.release()
+		c.subMu.Lock()
+		c.stream = nil
+		c.subMu.Unlock()
+	}()
+
+	f, err := os.Open(st.path)
+	if err != nil {
+		log.Printf("Stream %s: %v", st.filename, err)
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), streamScannerBuffer)
+	lineNo, eof := 0, false
+	sentAt := 0 // queue[:sentAt] is in flight
+
+	for {
+		st.mu.Lock()
+		state, resync := st.state, st.resync
+		st.mu.Unlock()
+
+		switch {
+		case state == streamCancelling:
+			st.stop(sentAt)
+			return
+
+		case state == streamPrinting && resync:
+			if err := st.restore(); err != nil {
+				st.lost(err, sentAt)
+				sentAt = 0
+				continue
+			}
+
+		case state == streamPrinting && sentAt < st.window && (sentAt < len(st.queue) || !eof):
+			if sentAt == len(st.queue) {
+				if !scanner.Scan() {
+					if err := scanner.Err(); err != nil {
+						log.Printf("Stream %s: reading line %d: %v", st.filename, lineNo+1, err)
+						st.hold(fmt.Sprintf("Reading the file failed: %v", err))
+					}
+					eof = true
+					continue
+				}
+				lineNo++
+				n := lineNo
+				st.filter.Line(scanner.Text(), func(l string) error {
+					if cmd := streamCommand(l); cmd != "" {
+						st.queue = append(st.queue, streamCmd{line: n, text: cmd})
+					}
+					return nil
+				})
+				if len(st.queue) == 0 {
+					// Nothing in flight: comments and blank lines count
+					// as reached.
+					st.setAcked(n, false)
+				}
+				continue
+			}
+			if err := st.send(&st.queue[sentAt]); err != nil {
+				st.lost(err, sentAt)
+				sentAt = 0
+				continue
+			}
+			sentAt++
+
+		case sentAt > 0:
+			cmd := st.queue[0]
+			p, err := cmd.wait(ackTimeout(cmd.text))
+			if err != nil {
+				st.lost(err, sentAt)
+				sentAt = 0
+				continue
+			}
+			if _, err := gcodeResult(p); err != nil {
+				log.Printf("Stream %s: line %d %q: %v", st.filename, cmd.line, cmd.text, err)
+			}
+			st.done.apply(cmd.text)
+			st.queue = st.queue[1:]
+			sentAt--
+			st.setAcked(cmd.line, true)
+
+		case state == streamPrinting && eof && len(st.queue) == 0:
+			log.Printf("Stream %s: finished", st.filename)
+			return
+
+		case state == streamPaused:
+			st.park()
+			st.mu.Lock()
+			for st.state == streamPaused {
+				st.cond.Wait()
+			}
+			st.mu.Unlock()
+
+		default:
+			st.mu.Lock()
+			for st.state == streamRecovering {
+				st.cond.Wait()
+			}
+			st.mu.Unlock()
+		}
+	}
+}
+
+// send writes a command, first moving Z to a changed offset, applying the
+// offset to the command's own Z and recording what it sets up.
+func (st *stream) send(cmd *streamCmd) error {
+	st.mu.Lock()
+	zOffset, zChanged := st.zOffset, st.zChanged
+	st.mu.Unlock()
+
+	text := cmd.text
+	fields := strings.Fields(strings.ToUpper(text))
+	move := fields[0] == "G0" || fields[0] == "G1"
+	if move && !st.sent.relative {
+		if z, ok := streamParam(fields, 'Z'); ok {
+			if zOffset != 0 {
+				text = replaceZ(text, z+zOffset)
+			}
+			zChanged = false
+		} else if zChanged && st.sent.known[2] {
+			// Babystep: apply the new offset before the next move.
+			if err := st.sendRaw(fmt.Sprintf("G1 Z%.3f", st.sent.pos[2]+zOffset)); err != nil {
+				return err
+			}
+			zChanged = false
+		}
+		st.mu.Lock()
+		st.zChanged = st.zChanged && zChanged
+		st.mu.Unlock()
+	}
+
+	wait, err := st.c.sendGCode(text)
+	if err != nil {
+		return err
+	}
+	cmd.wait = wait
+	st.sent.apply(cmd.text)
+	return nil
+}
+
+// sendRaw runs a command of the bridge's own and waits for it.
+func (st *stream) sendRaw(line string) error {
+	wait, err := st.c.sendGCode(line)
+	if err != nil {
+		return err
+	}
+	p, err := wait(ackTimeout(line))
+	if err != nil {
+		return err
+	}
+	if _, err := gcodeResult(p); err != nil {
+		log.Printf("Stream %s: %q: %v", st.filename, line, err)
+	}
+	return nil
+}
+
+// replaceZ rewrites the Z word of a move.
+func replaceZ(line string, z float64) string {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if len(f) > 1 && (f[0] == 'Z' || f[0] == 'z') {
+			fields[i] = fmt.Sprintf("Z%.3f", z)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// setAcked records the line the print has reached; notify runs the line
+// callback, as for lines the printer reports, though not more often than
+// streamNotifyInterval.
+func (st *stream) setAcked(line int, notify bool) {
+	st.mu.Lock()
+	st.acked = line
+	notify = notify && time.Since(st.notified) >= streamNotifyInterval
+	if notify {
+		st.notified = time.Now()
+	}
+	st.mu.Unlock()
+	if !notify {
+		return
+	}
+	st.c.subMu.RLock()
+	onLine := st.c.onLine
+	st.c.subMu.RUnlock()
+	if onLine != nil {
+		go onLine(line)
+	}
+}
+
+// stop ends a cancelled stream without waiting out the commands in flight.
+// The heaters are turned off over SACP first, which ends an M109 or M190
+// wait, M108 breaks off any other heating wait and M410 drops the moves
+// the printer has planned; the commands in flight are then acknowledged
+// quickly and the cancel script runs.
+func (st *stream) stop(sentAt int) {
+	c := st.c
+	heads := c.Toolheads()
+	if len(heads) == 0 {
+		heads = []gcode.Toolhead{{Tool: 0}}
+	}
+	for _, t := range heads {
+		if err := c.SetToolTemperature(t.Tool, 0); err != nil {
+			log.Printf("Stream %s: cancel: turning off T%d: %v", st.filename, t.Tool, err)
+		}
+	}
+	if err := c.SetBedTemperature(0, 0); err != nil {
+		log.Printf("Stream %s: cancel: turning off the bed: %v", st.filename, err)
+	}
+	for _, l := range []string{"M108", "M410"} {
+		if _, err := c.ExecuteGCode(l); err != nil {
+			log.Printf("Stream %s: cancel: %s: %v", st.filename, l, err)
+		}
+	}
+	st.drain(sentAt)
+	log.Printf("Stream %s: cancelled at line %d", st.filename, st.line())
+	for _, l := range streamCancelScript {
+		if _, err := c.ExecuteGCode(l); err != nil {
+			log.Printf("Stream %s: cancel script %s: %v", st.filename, l, err)
+		}
+	}
+}
+
+// drain waits for the commands in flight, as long as the send path would,
+// and takes them off the queue whether or not they are acknowledged.
+func (st *stream) drain(sentAt int) {
+	for _, cmd := range st.queue[:sentAt] {
+		if _, err := cmd.wait(ackTimeout(cmd.text)); err != nil {
+			log.Printf("Stream %s: line %d %q not acknowledged: %v", st.filename, cmd.line, cmd.text, err)
+			break
+		}
+		st.done.apply(cmd.text)
+	}
+	st.queue = st.queue[sentAt:]
+}
+
+// ackTimeout returns how long to wait for line to be acknowledged.
+func ackTimeout(line string) time.Duration {
+	if slowCommand(line) {
+		return streamSlowAckTimeout
+	}
+	return streamAckTimeout
+}
+
+// park lifts the head clear of the print once a pause has drained.
+func (st *stream) park() {
+	st.mu.Lock()
+	if st.parked {
+		st.mu.Unlock()
+		return
+	}
+	st.parked, st.resync = true, true
+	st.mu.Unlock()
+	for _, l := range []string{"M400", "G91", fmt.Sprintf("G0 Z%.1f F%d", streamParkLift, streamZFeed), "G90"} {
+		if err := st.sendRaw(l); err != nil {
+			log.Printf("Stream %s: parking failed: %v", st.filename, err)
+			return
+		}
+	}
+}
+
+// restore puts back the state of the last acknowledged command before the
+// stream goes on after a pause or a lost link.
+func (st *stream) restore() error {
+	st.mu.Lock()
+	zOffset := st.zOffset
+	st.mu.Unlock()
+	for _, l := range st.done.restore(zOffset) {
+		if err := st.sendRaw(l); err != nil {
+			return err
+		}
+	}
+	st.sent = st.done
+	st.mu.Lock()
+	st.resync, st.parked, st.zChanged = false, false, false
+	st.mu.Unlock()
+	return nil
+}
+
+// lost handles a command that failed or wasn't acknowledged. If it just
+// timed out and the link is still up, the printer is caught up with instead
+// (see settle). Otherwise the link is lost: commands in flight are resent
+// once the printer has reconnected, after the state of the last acknowledged
+// one is restored; in relative mode, moves the printer did run before the
+// link went down run twice, so the window bounds how much can be repeated.
+func (st *stream) lost(err error, sentAt int) {
+	if errors.Is(err, errResponseTimeout) && st.c.Connected() && st.settle(err, sentAt) {
+		return
+	}
+	for i := range st.queue[:sentAt] {
+		st.queue[i].wait = nil
+	}
+	st.mu.Lock()
+	line := st.acked
+	st.lostLink = st.c.link()
+	if st.state != streamRecovering {
+		st.resumeTo = st.state
+		if st.resumeTo == streamRecovering {
+			st.resumeTo = streamPrinting
+		}
+		st.setState(streamRecovering)
+	}
+	st.resync = true
+	st.message = fmt.Sprintf("Printer link lost at line %d", line)
+	st.mu.Unlock()
+	log.Printf("Stream %s: %v at line %d, waiting for the printer", st.filename, err, line)
+
+	go st.recover()
+}
+
+// settle catches up with the printer after a command timed out on a link
+// that is still up. The printer got the commands in flight and runs them in
+// order, so once an M400 behind them is acknowledged they have all run and
+// count as acknowledged rather than being sent again. It reports false if
+// the link went down meanwhile; if M400 fails on a live link, the stream is
+// held for the user.
+func (st *stream) settle(err error, sentAt int) bool {
+	log.Printf("Stream %s: %v at line %d, waiting for the printer to catch up", st.filename, err, st.line())
+	if err := st.sendRaw("M400"); err != nil {
+		if !st.c.Connected() {
+			return false
+		}
+		st.hold(fmt.Sprintf("The printer stopped responding at line %d: %v", st.line(), err))
+		return true
+	}
+	for _, cmd := range st.queue[:sentAt] {
+		st.done.apply(cmd.text)
+		st.setAcked(cmd.line, true)
+	}
+	st.queue = st.queue[sentAt:]
+	return true
+}
+
+// recover waits for the SACP link to be re-established and continues the
+// stream, or holds it paused if it takes too long. A connection that is
+// still the lost one doesn't count: resending on it would repeat commands
+// the printer may have run.
+func (st *stream) recover() {
+	deadline := time.Now().Add(streamRecoverTimeout)
+	for time.Now().Before(deadline) {
+		st.mu.Lock()
+		recovering, lostLink := st.state == streamRecovering, st.lostLink
+		st.mu.Unlock()
+		if !recovering {
+			return
+		}
+		if link := st.c.link(); link != nil && link != lostLink {
+			st.mu.Lock()
+			if st.state == streamRecovering {
+				st.message = ""
+				st.setState(st.resumeTo)
+			}
+			st.mu.Unlock()
+			log.Printf("Stream %s: printer link back", st.filename)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	st.hold("Printer link lost, resume the print once the printer is back")
+}
+
+// hold pauses the stream for the user to resume.
+func (st *stream) hold(message string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.state == streamCancelling {
+		return
+	}
+	st.message = message
+	st.resync = true
+	st.setState(streamPaused)
+	log.Printf("Stream %s: %s", st.filename, message)
+}
+
+// StreamMessage returns why the streamed print is held, if it is.
+func (c *Client) StreamMessage() string {
+	st := c.activeStream()
+	if st == nil {
+		return ""
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.message
+}
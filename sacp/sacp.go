@@ -384,7 +384,8 @@ func Subscribe(conn net.Conn, commandSet uint8, commandID uint8, intervalMs uint
 //	index(1) + filament_status(1) + filament_enable(1) + is_available(1) + type(1)
 //	+ diameter(int32 LE, 4) + cur_temp(int32 LE, 4) + target_temp(int32 LE, 4)
 //
-// Temperatures are int32 LE in millidegrees (÷1000 for °C).
+// Temperatures are int32 LE in millidegrees (÷1000 for °C); the nozzle
+// diameter uses the same fixed-point scale (÷1000 for mm).
 func ParseExtruderInfo(data []byte) (extruders []ExtruderData) {
 	if len(data) < 3 {
 		return nil
@@ -396,10 +397,13 @@ func ParseExtruderInfo(data []byte) (extruders []ExtruderData) {
 
 	for i := 0; i < count && offset+recordSize <= len(data); i++ {
 		e := ExtruderData{
-			Index:  int(data[offset]),
-			HeadID: headID,
+			Index:     int(data[offset]),
+			HeadID:    headID,
+			Available: data[offset+3] != 0,
 		}
-		raw := int32(binary.LittleEndian.Uint32(data[offset+9 : offset+13]))
+		raw := int32(binary.LittleEndian.Uint32(data[offset+5 : offset+9]))
+		e.Diameter = float64(raw) / 1000.0
+		raw = int32(binary.LittleEndian.Uint32(data[offset+9 : offset+13]))
 		e.CurrentTemp = float64(raw) / 1000.0
 		raw = int32(binary.LittleEndian.Uint32(data[offset+13 : offset+17]))
 		e.TargetTemp = float64(raw) / 1000.0
@@ -450,6 +454,8 @@ func ParseBedInfo(data []byte) (zones []BedZoneData) {
 type ExtruderData struct {
 	Index       int
 	HeadID      int // from header byte[1]: 0=T0 (left), 1=T1 (right) on J1S
+	Available   bool
+	Diameter    float64 // nozzle diameter in mm
 	CurrentTemp float64
 	TargetTemp  float64
 }
@@ -758,12 +764,154 @@ func StartScreenPrint(conn net.Conn, filename string, md5hex string, headType by
 	return err
 }
 
-// StartUpload uploads gcode data to the printer via the SACP file transfer protocol.
-// Returns the MD5 hex string of the uploaded data (needed for StartScreenPrint).
-// StartUpload streams the gcode at srcPath to the printer over SACP.
-// Memory usage is bounded to one chunk (DataLen, currently 60 KB) plus
-// hashing buffers, regardless of file size.
-func StartUpload(conn net.Conn, filename, srcPath string, timeout time.Duration) (string, error) {
+// hashFile stream-hashes f. Memory cost: just the hash state and a 32 KB
+// buffer.
+func hashFile(f *os.File) (string, error) {
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("hashing gcode: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// UploadOptions tunes StartUpload.
+type UploadOptions struct {
+	// ChunkSize is the data sent per chunk, up to DataLen; 0 means DataLen.
+	ChunkSize int
+	// MD5 is the file's MD5 hex string, if already known. Otherwise the
+	// file is hashed before the transfer starts.
+	MD5 string
+	// Progress, if set, is called as chunks go out, at most every
+	// progressInterval, and once the last chunk is sent.
+	Progress func(UploadProgress)
+}
+
+// UploadProgress reports how far an upload has got.
+type UploadProgress struct {
+	Filename    string
+	Sent        int64 // bytes
+	Total       int64
+	BytesPerSec float64
+	ETA         time.Duration
+}
+
+// Percent returns the share of the file sent.
+func (p UploadProgress) Percent() float64 {
+	return float64(p.Sent) / float64(p.Total) * 100
+}
+
+// MinChunkSize is the smallest upload chunk StartUpload accepts.
+const MinChunkSize = 1024
+
+const progressInterval = 500 * time.Millisecond
+
+// CheckChunkSize reports whether n is a usable upload chunk size. The
+// printer takes chunks of up to DataLen.
+func CheckChunkSize(n int) error {
+	if n < MinChunkSize || n > DataLen {
+		return fmt.Errorf("chunk size %d out of range (%d to %d bytes)", n, MinChunkSize, DataLen)
+	}
+	return nil
+}
+
+// chunkReader reads upload chunks, reading the next one ahead while the
+// current one is on the wire. It alternates between two buffers: a chunk
+// returned by read stays valid until the following read.
+type chunkReader struct {
+	src   *os.File
+	size  int64
+	chunk int
+	bufs  [2][]byte
+	cur   int // buffer of the last chunk returned
+
+	ahead     int // chunk being read ahead, or -1
+	aheadDone chan error
+}
+
+func newChunkReader(src *os.File, size int64, chunk int) *chunkReader {
+	return &chunkReader{
+		src:   src,
+		size:  size,
+		chunk: chunk,
+		bufs:  [2][]byte{make([]byte, chunk), make([]byte, chunk)},
+		ahead: -1,
+	}
+}
+
+// bounds returns the byte range of chunk n.
+func (r *chunkReader) bounds(n int) (int64, int) {
+	offset := int64(n) * int64(r.chunk)
+	length := r.chunk
+	if remaining := r.size - offset; remaining < int64(r.chunk) {
+		length = int(max(remaining, 0))
+	}
+	return offset, length
+}
+
+func (r *chunkReader) readInto(buf []byte, n int) ([]byte, error) {
+	offset, length := r.bounds(n)
+	data := buf[:length]
+	if _, err := r.src.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading chunk %d: %w", n, err)
+	}
+	return data, nil
+}
+
+// read returns chunk n, from the read-ahead if it was n, and starts
+// reading n+1 ahead.
+func (r *chunkReader) read(n int) ([]byte, error) {
+	next := 1 - r.cur
+	var data []byte
+	var err error
+	if r.ahead >= 0 {
+		aheadErr := <-r.aheadDone
+		if r.ahead == n && aheadErr == nil {
+			_, length := r.bounds(n)
+			data = r.bufs[next][:length]
+		}
+		r.ahead = -1
+	}
+	if data == nil {
+		if data, err = r.readInto(r.bufs[next], n); err != nil {
+			return nil, err
+		}
+	}
+	r.cur = next
+
+	if offset, _ := r.bounds(n + 1); offset < r.size {
+		r.ahead = n + 1
+		r.aheadDone = make(chan error, 1)
+		go func(buf []byte, n int) {
+			_, err := r.readInto(buf, n)
+			r.aheadDone <- err
+		}(r.bufs[1-r.cur], n+1)
+	}
+	return data, nil
+}
+
+// wait lets a read-ahead finish before the file is closed.
+func (r *chunkReader) wait() {
+	if r.ahead >= 0 {
+		<-r.aheadDone
+		r.ahead = -1
+	}
+}
+
+// StartUpload streams the gcode at srcPath to the printer over the SACP
+// file transfer protocol. Returns the MD5 hex string of the uploaded data
+// (needed for StartScreenPrint). Memory usage is bounded to two chunks
+// (DataLen, currently 60 KB, each) regardless of file size: the printer
+// requests chunks one at a time, and the next is read from disk while the
+// current one is in flight.
+func StartUpload(conn net.Conn, filename, srcPath string, opts UploadOptions, timeout time.Duration) (string, error) {
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DataLen
+	}
+	if err := CheckChunkSize(chunkSize); err != nil {
+		return "", err
+	}
+
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return "", fmt.Errorf("opening gcode for upload: %w", err)
@@ -778,17 +926,18 @@ func StartUpload(conn net.Conn, filename, srcPath string, timeout time.Duration)
 	if size == 0 {
 		return "", fmt.Errorf("empty gcode file")
 	}
-
-	// Stream-hash the file. Memory cost: just the hash state and a 32 KB buffer.
-	hasher := md5.New()
-	if _, err := io.Copy(hasher, src); err != nil {
-		return "", fmt.Errorf("hashing gcode: %w", err)
+	count := size/int64(chunkSize) + 1
+	if count > math.MaxUint16 {
+		return "", fmt.Errorf("file too large for %d byte chunks (%d chunks, at most %d)", chunkSize, count, math.MaxUint16)
 	}
-	var md5hash [16]byte
-	hasher.Sum(md5hash[:0])
-	md5hex := hex.EncodeToString(md5hash[:])
+	packageCount := uint16(count)
 
-	packageCount := uint16((size / int64(DataLen)) + 1)
+	md5hex := opts.MD5
+	if md5hex == "" {
+		if md5hex, err = hashFile(src); err != nil {
+			return "", err
+		}
+	}
 
 	data := bytes.Buffer{}
 	writeString(&data, filename)
@@ -809,7 +958,29 @@ func StartUpload(conn net.Conn, filename, srcPath string, timeout time.Duration)
 		return "", err
 	}
 
-	chunkBuf := make([]byte, DataLen)
+	chunks := newChunkReader(src, size, chunkSize)
+	defer chunks.wait()
+	var (
+		started  time.Time
+		sent     int64
+		reported time.Time
+		finished bool
+	)
+	report := func() {
+		final := sent == size
+		if opts.Progress == nil || finished || (!final && time.Since(reported) < progressInterval) {
+			return
+		}
+		reported, finished = time.Now(), final
+		p := UploadProgress{Filename: filename, Sent: sent, Total: size}
+		if elapsed := time.Since(started).Seconds(); elapsed > 0 {
+			p.BytesPerSec = float64(sent) / elapsed
+			if p.BytesPerSec > 0 {
+				p.ETA = time.Duration(float64(size-sent) / p.BytesPerSec * float64(time.Second))
+			}
+		}
+		opts.Progress(p)
+	}
 
 	for {
 		conn.SetReadDeadline(time.Now().Add(timeout))
@@ -836,15 +1007,9 @@ func StartUpload(conn net.Conn, filename, srcPath string, timeout time.Duration)
 			}
 
 			pkgRequested := binary.LittleEndian.Uint16(p.Data[2+md5Len : 2+md5Len+2])
-			offset := int64(pkgRequested) * int64(DataLen)
-			pkgSize := DataLen
-			if remaining := size - offset; remaining < int64(DataLen) {
-				pkgSize = int(remaining)
-			}
-
-			pkgData := chunkBuf[:pkgSize]
-			if _, err := src.ReadAt(pkgData, offset); err != nil && err != io.EOF {
-				return "", fmt.Errorf("reading chunk %d: %w", pkgRequested, err)
+			pkgData, err := chunks.read(int(pkgRequested))
+			if err != nil {
+				return "", err
 			}
 
 			respBuf := bytes.Buffer{}
@@ -853,9 +1018,9 @@ func StartUpload(conn net.Conn, filename, srcPath string, timeout time.Duration)
 			writeLE(&respBuf, pkgRequested)
 			writeBytes(&respBuf, pkgData)
 
-			perc := float64(pkgRequested+1) / float64(packageCount) * 100.0
-			log.Printf("  SACP upload: %.1f%%", perc)
-
+			if started.IsZero() {
+				started = time.Now()
+			}
 			conn.SetWriteDeadline(time.Now().Add(timeout))
 			if _, err := conn.Write(Packet{
 				ReceiverID: 2,
@@ -868,6 +1033,9 @@ func StartUpload(conn net.Conn, filename, srcPath string, timeout time.Duration)
 			}.Encode()); err != nil {
 				return "", err
 			}
+			offset, _ := chunks.bounds(int(pkgRequested))
+			sent = max(sent, offset+int64(len(pkgData)))
+			report()
 
 		case p.CommandSet == 0xb0 && p.CommandID == 2:
 			// Upload complete — send first disconnect to signal the HMI to